@@ -1,20 +1,28 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"flag"
 	"fmt"
+	"log"
 	gohttp "net/http"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	minio "github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/redis/go-redis/v9"
 	"github.com/thehowl/diffy/pkg/db"
 	"github.com/thehowl/diffy/pkg/http"
+	"github.com/thehowl/diffy/pkg/janitor"
 	"github.com/thehowl/diffy/pkg/storage"
 	"go.etcd.io/bbolt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type optsType struct {
@@ -25,7 +33,50 @@ type optsType struct {
 	s3AccessKey    string
 	s3AccessSecret string
 	s3Bucket       string
+	s3Prefix       string
+	dbBucket       string
 	s3SecureSSL    bool
+	cacheBackend   string
+	cacheDir       string
+	cacheSize      uint64
+	cacheEviction  string
+	trustProxy     bool
+	trustedProxies string
+	maxLines       uint64
+	defaultFormat  string
+	archiveCodec   string
+	rateLimit      bool
+	redisURL       string
+	logFile        string
+	dedupeContent  bool
+	maxTotalBytes  uint64
+	readHeaderTO   time.Duration
+	readTO         time.Duration
+	writeTO        time.Duration
+	idleTO         time.Duration
+	maxHeaderBytes uint64
+	h2c            bool
+	tlsCert        string
+	tlsKey         string
+	noExample      bool
+	exampleAliases string
+	reservedIDs    string
+	compareURLs    bool
+	csrfKey        string
+	maxArchiveSize uint64
+	verifyWrites   bool
+	extraCSSURL    string
+	extraCSSHosts  string
+	maxColumns     uint64
+	idCase         string
+	idBytes        uint64
+	diffTimeout    time.Duration
+	maxTTL         time.Duration
+	maxUploads     uint64
+	dbTimeout      time.Duration
+	dbNoSync       bool
+	noHomepage     bool
+	homeRedirect   string
 }
 
 func defaultEnv(s, def string) string {
@@ -58,6 +109,166 @@ func boolVar(p *bool, fg string, valBool bool, usage string) {
 	flag.BoolVar(p, fg, valBool, usage+". env var: "+ev)
 }
 
+func uint64Var(p *uint64, fg string, valUint uint64, usage string) {
+	ev := strings.ReplaceAll(strings.ToUpper(fg), "-", "_")
+	valStr := defaultEnv(ev, strconv.FormatUint(valUint, 10))
+	valUint, err := strconv.ParseUint(valStr, 10, 64)
+	if err != nil {
+		panic(
+			fmt.Errorf(
+				"error parsing value %q for flag %q: %w, unsigned integer expected",
+				valStr,
+				fg,
+				err,
+			),
+		)
+	}
+	flag.Uint64Var(p, fg, valUint, usage+". env var: "+ev)
+}
+
+func durationVar(p *time.Duration, fg string, valDur time.Duration, usage string) {
+	ev := strings.ReplaceAll(strings.ToUpper(fg), "-", "_")
+	valStr := defaultEnv(ev, valDur.String())
+	valDur, err := time.ParseDuration(valStr)
+	if err != nil {
+		panic(
+			fmt.Errorf(
+				"error parsing value %q for flag %q: %w, duration expected",
+				valStr,
+				fg,
+				err,
+			),
+		)
+	}
+	flag.DurationVar(p, fg, valDur, usage+". env var: "+ev)
+}
+
+// splitList splits the comma-separated values of a flag, ignoring empty ones.
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// withCache wraps permanent with the cache backend specified in opts.
+func withCache(permanent storage.Storage, kvDB *bbolt.DB, opts optsType) storage.Storage {
+	var cache storage.ListStorage
+	switch opts.cacheBackend {
+	case "none", "":
+		return permanent
+	case "db":
+		cache = storage.NewDBStorage(kvDB, []byte("cache"))
+	case "fs":
+		var err error
+		cache, err = storage.NewFSStorage(opts.cacheDir)
+		if err != nil {
+			panic(fmt.Errorf("cache init error: %w", err))
+		}
+	default:
+		panic(fmt.Errorf("invalid cache backend %q", opts.cacheBackend))
+	}
+	policy, err := storage.ParseEvictionPolicy(opts.cacheEviction)
+	if err != nil {
+		panic(fmt.Errorf("cache init error: %w", err))
+	}
+	fmt.Printf("using %s cache [size: %d bytes, eviction: %s]\n", opts.cacheBackend, opts.cacheSize, opts.cacheEviction)
+	cs, err := storage.NewCachedStorage(cache, permanent, opts.cacheSize, policy)
+	if err != nil {
+		panic(fmt.Errorf("cache init error: %w", err))
+	}
+	return cs
+}
+
+func reconcile(d *db.DB, st storage.Storage, args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	del := fs.Bool("delete", false, "delete the orphaned records and objects")
+	fs.Parse(args)
+
+	res, err := janitor.Reconcile(context.Background(), d, st, *del)
+	fmt.Print(res)
+	if err != nil {
+		panic(fmt.Errorf("reconcile error: %w", err))
+	}
+}
+
+// list prints the diffs in the database, with their upload time and size.
+// With -after or -before, only the diffs uploaded in that range are printed,
+// in order of upload.
+func list(d *db.DB, args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	afterStr := fs.String("after", "", "only list the diffs uploaded at or after this time (RFC3339)")
+	beforeStr := fs.String("before", "", "only list the diffs uploaded before this time (RFC3339)")
+	fs.Parse(args)
+	var after, before time.Time
+	for _, v := range []struct {
+		s *string
+		t *time.Time
+	}{{afterStr, &after}, {beforeStr, &before}} {
+		if *v.s == "" {
+			continue
+		}
+		var err error
+		if *v.t, err = time.Parse(time.RFC3339, *v.s); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	printFile := func(name string, f db.File) error {
+		size := "?"
+		if f.Size > 0 {
+			size = strconv.FormatUint(f.Size, 10)
+		}
+		fmt.Printf("%s\t%s\t%s\n", name, f.CreatedAt.UTC().Format(time.RFC3339), size)
+		return nil
+	}
+	var err error
+	if after.IsZero() && before.IsZero() {
+		err = d.ListFiles(printFile)
+	} else {
+		err = d.ListFilesCreated(after, before, printFile)
+	}
+	if err != nil {
+		panic(fmt.Errorf("list error: %w", err))
+	}
+}
+
+// quotaInterval is how often the storage quota is enforced, and the expired
+// diffs are deleted.
+const quotaInterval = 10 * time.Minute
+
+// enforceQuota periodically deletes the oldest diffs, so that the total size
+// of the stored diffs is at most maxBytes.
+func enforceQuota(d *db.DB, st storage.Storage, maxBytes uint64) {
+	for {
+		res, err := janitor.EnforceQuota(context.Background(), d, st, maxBytes)
+		if err != nil {
+			log.Printf("quota error: %v", err)
+		} else if len(res.Deleted) > 0 {
+			log.Print("quota: ", res)
+		}
+		time.Sleep(quotaInterval)
+	}
+}
+
+// deleteExpired periodically deletes the diffs uploaded with a ttl which have
+// expired.
+func deleteExpired(d *db.DB, st storage.Storage) {
+	for {
+		res, err := janitor.DeleteExpired(context.Background(), d, st, time.Now())
+		if err != nil {
+			log.Printf("expire error: %v", err)
+		} else if len(res.Deleted) > 0 {
+			log.Print("expire: ", res)
+		}
+		time.Sleep(quotaInterval)
+	}
+}
+
 func main() {
 	var opts optsType
 	stringVar(&opts.listenAddr, "listen-addr", ":18844", "listen address for the web server")
@@ -69,10 +280,101 @@ func main() {
 	stringVar(&opts.s3AccessSecret, "s3-access-secret", "", "s3 access secret")
 	boolVar(&opts.s3SecureSSL, "s3-secure-ssl", true, "s3 access secret")
 	stringVar(&opts.s3Bucket, "s3-bucket", "diffy", "s3 bucket")
+	stringVar(&opts.s3Prefix, "s3-prefix", "", "prefix for the keys of the objects in the s3 bucket (ie. diffy/)")
+	stringVar(&opts.dbBucket, "db-storage-bucket", "storage", "bucket of db-file used for storage, if not using s3")
+	stringVar(&opts.cacheBackend, "cache-backend", "none", "cache in front of s3 storage: fs, db or none")
+	stringVar(&opts.cacheDir, "cache-dir", "data/cache", "directory for the fs cache backend")
+	uint64Var(&opts.cacheSize, "cache-size", 256<<20, "maximum size of the cache, in bytes")
+	stringVar(&opts.cacheEviction, "cache-eviction", "lru", "objects evicted first from the full cache: "+
+		"lru (least recently accessed) or lfu (least frequently accessed)")
+	boolVar(&opts.trustProxy, "trust-proxy", false, "trust the X-Real-IP and X-Forwarded-For headers "+
+		"when the request comes from one of the trusted-proxies")
+	stringVar(&opts.trustedProxies, "trusted-proxies", "127.0.0.0/8,::1/128",
+		"comma-separated list of networks (in CIDR notation) of trusted reverse proxies")
+	uint64Var(&opts.maxLines, "max-lines", 100_000, "maximum number of lines in each uploaded file (0: unlimited)")
+	stringVar(&opts.defaultFormat, "default-format", "plain", "format for clients which are not "+
+		"recognized as browsers or command line tools: html or plain")
+	stringVar(&opts.archiveCodec, "archive-codec", "gzip", "compression of newly stored archives: gzip or zstd")
+	boolVar(&opts.rateLimit, "rate-limit", true, "enforce the weekly per-ip upload limits")
+	stringVar(&opts.redisURL, "redis-url", "", "redis url (ie. redis://localhost:6379/0) to store the "+
+		"upload usage statistics, sharing the limits across instances. if empty, they are stored in db-file")
+	stringVar(&opts.logFile, "log-file", "", "file where to write the request logs, instead of stdout. "+
+		"it is reopened on SIGHUP, to allow for log rotation")
+	boolVar(&opts.dedupeContent, "dedupe-content-only", false, "identify uploads only by the contents "+
+		"of the files, ignoring their names, so that renamed files are deduplicated")
+	uint64Var(&opts.maxTotalBytes, "max-total-bytes", 0, "maximum total size of the stored diffs, in bytes; "+
+		"when exceeded, the oldest diffs are deleted (0: unlimited)")
+	durationVar(&opts.readHeaderTO, "read-header-timeout", 10*time.Second, "maximum time to read the headers of a request")
+	durationVar(&opts.readTO, "read-timeout", time.Minute, "maximum time to read a request, including the body")
+	// longer than the timeout of the handlers, so that they can respond
+	// when it is exceeded.
+	durationVar(&opts.writeTO, "write-timeout", 90*time.Second, "maximum time to write a response")
+	durationVar(&opts.idleTO, "idle-timeout", 2*time.Minute, "maximum time to wait for the next request "+
+		"on a keep-alive connection")
+	uint64Var(&opts.maxHeaderBytes, "max-header-bytes", gohttp.DefaultMaxHeaderBytes, "maximum size of the headers of a request, in bytes")
+	boolVar(&opts.h2c, "h2c", false, "serve HTTP/2 without TLS (h2c), ie. behind a reverse proxy which supports it")
+	stringVar(&opts.tlsCert, "tls-cert", "", "certificate file to serve HTTPS (and HTTP/2); requires tls-key")
+	stringVar(&opts.tlsKey, "tls-key", "", "private key file of tls-cert")
+	boolVar(&opts.noExample, "disable-example", false, "disable the example diff at /example")
+	stringVar(&opts.exampleAliases, "example-aliases", "", "comma-separated list of additional ids "+
+		"serving the example diff (ie. demo)")
+	stringVar(&opts.reservedIDs, "reserved-ids", "", "comma-separated list of additional ids which are never "+
+		"served as diffs, nor accepted as example-aliases")
+	uint64Var(&opts.maxColumns, "max-columns", 1000, "number of characters after which lines are truncated "+
+		"in the html diff, unless set with ?maxcol= (0: never)")
+	uint64Var(&opts.idBytes, "id-bytes", http.DefaultIDBytes, "number of bytes of the hash of the diffs "+
+		"used for their ids, from 4 to 16; longer ids make collisions less likely. existing ids keep working")
+	stringVar(&opts.idCase, "id-case", "lower", "case of the ids in the links returned on upload: lower or upper. "+
+		"ids are looked up regardless of their case")
+	// shorter than the timeout of the handlers (60s), so that there is time
+	// left to render the diff.
+	durationVar(&opts.diffTimeout, "diff-timeout", 20*time.Second, "maximum time to compute a diff (0: unlimited)")
+	uint64Var(&opts.maxUploads, "max-concurrent-uploads", 16, "maximum number of uploads processed at the same time; "+
+		"the ones exceeding it get a 503 response (0: unlimited)")
+	durationVar(&opts.dbTimeout, "db-timeout", 10*time.Second, "maximum time to wait for the lock on db-file, "+
+		"if another process has it open (0: forever)")
+	boolVar(&opts.dbNoSync, "db-no-sync", false, "do not fsync db-file after each write. faster, but "+
+		"the latest writes can be lost or the db corrupted if the system crashes; only for ephemeral instances")
+	boolVar(&opts.noHomepage, "disable-homepage", false, "always return the usage at /, even to browsers")
+	stringVar(&opts.homeRedirect, "homepage-redirect", "", "url to redirect browsers visiting / to, instead of the homepage")
+	boolVar(&opts.compareURLs, "compare-urls", false, "allow uploading a file from a github compare page, "+
+		"with the compare_url and path fields; the server fetches the files from raw.githubusercontent.com")
+	stringVar(&opts.csrfKey, "csrf-key", "", "secret protecting the form of the homepage from cross-site requests; "+
+		"must be the same on all the instances serving the same domain (default: random)")
+	uint64Var(&opts.maxArchiveSize, "max-archive-size", 32<<20, "maximum size of the archive of a diff once "+
+		"decompressed, in bytes; larger archives are not read (0: unlimited)")
+	durationVar(&opts.maxTTL, "max-ttl", 0, "maximum ttl which can be set on upload, after which the diff "+
+		"expires; longer ttls are reduced to it (0: unlimited)")
+	boolVar(&opts.verifyWrites, "verify-writes", false, "read back each uploaded diff after storing it, "+
+		"deleting it and failing the upload if it was not stored correctly")
+	stringVar(&opts.extraCSSURL, "extra-css-url", "", "url of a stylesheet added to the pages after the default one, "+
+		"to change their colors or fonts; it must be a path, or on the origin of public-url or of extra-css-hosts")
+	stringVar(&opts.extraCSSHosts, "extra-css-hosts", "", "comma-separated list of hosts, other than the one of "+
+		"public-url, from which extra-css-url may be loaded over https")
 	flag.Parse()
+	if opts.idBytes < http.MinIDBytes || opts.idBytes > http.MaxIDBytes {
+		fmt.Fprintf(os.Stderr, "invalid id-bytes %d: must be from %d to %d\n",
+			opts.idBytes, http.MinIDBytes, http.MaxIDBytes)
+		os.Exit(2)
+	}
+	if opts.idCase != "lower" && opts.idCase != "upper" {
+		fmt.Fprintf(os.Stderr, "invalid id-case %q\n", opts.idCase)
+		os.Exit(2)
+	}
+	if opts.archiveCodec != "gzip" && opts.archiveCodec != "zstd" {
+		fmt.Fprintf(os.Stderr, "invalid archive-codec %q\n", opts.archiveCodec)
+		os.Exit(2)
+	}
+	if opts.defaultFormat != "html" && opts.defaultFormat != "plain" {
+		fmt.Fprintf(os.Stderr, "invalid default-format %q\n", opts.defaultFormat)
+		os.Exit(2)
+	}
 
 	// Set up database.
-	kvDB, err := bbolt.Open(opts.dbFile, 0o600, nil)
+	kvDB, err := bbolt.Open(opts.dbFile, 0o600, &bbolt.Options{
+		Timeout: opts.dbTimeout,
+		NoSync:  opts.dbNoSync,
+	})
 	if err != nil {
 		panic(fmt.Errorf("db open error: %w", err))
 	}
@@ -81,9 +383,9 @@ func main() {
 	var serverStorage storage.Storage
 	if opts.s3Endpoint == "" {
 		fmt.Println("using db storage")
-		serverStorage = storage.NewDBStorage(kvDB, []byte("storage"))
+		serverStorage = storage.NewDBStorage(kvDB, []byte(opts.dbBucket))
 	} else {
-		fmt.Printf("using s3 storage [endpoint: %s, bucket: %s]\n", opts.s3Endpoint, opts.s3Bucket)
+		fmt.Printf("using s3 storage [endpoint: %s, bucket: %s, prefix: %q]\n", opts.s3Endpoint, opts.s3Bucket, opts.s3Prefix)
 		minioClient, err := minio.New(opts.s3Endpoint, &minio.Options{
 			Creds:  credentials.NewStaticV4(opts.s3AccessKey, opts.s3AccessSecret, ""),
 			Secure: opts.s3SecureSSL,
@@ -91,15 +393,115 @@ func main() {
 		if err != nil {
 			panic(fmt.Errorf("minio init error: %w", err))
 		}
-		serverStorage = storage.NewMinioStorage(minioClient, opts.s3Bucket)
+		serverStorage = storage.NewMinioStorage(minioClient, opts.s3Bucket, opts.s3Prefix)
+	}
+
+	serverDB := &db.DB{DB: kvDB}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "reconcile":
+		reconcile(serverDB, serverStorage, flag.Args()[1:])
+		return
+	case "list":
+		list(serverDB, flag.Args()[1:])
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		os.Exit(2)
+	}
+
+	if opts.s3Endpoint != "" {
+		serverStorage = withCache(serverStorage, kvDB, opts)
 	}
 
 	ht := &http.Server{
 		PublicURL: opts.publicURL,
-		DB:        &db.DB{DB: kvDB},
+		DB:        serverDB,
 		Storage:   serverStorage,
+		MaxLines:  int(opts.maxLines),
+
+		DefaultFormat:    opts.defaultFormat,
+		ArchiveCodec:     opts.archiveCodec,
+		DisableRateLimit: !opts.rateLimit,
+
+		DedupeContentOnly: opts.dedupeContent,
+		DisableExample:    opts.noExample,
+		MaxColumns:        int(opts.maxColumns),
+		IDCase:            opts.idCase,
+		IDBytes:           int(opts.idBytes),
+		DiffTimeout:       opts.diffTimeout,
+
+		MaxConcurrentUploads: int(opts.maxUploads),
+		DisableHomepage:      opts.noHomepage,
+		HomepageRedirect:     opts.homeRedirect,
+		CompareURLs:          opts.compareURLs,
+		CSRFKey:              []byte(opts.csrfKey),
+		MaxArchiveSize:       int64(opts.maxArchiveSize),
+		ExtraCSSURL:          opts.extraCSSURL,
+		VerifyWrites:         opts.verifyWrites,
+		MaxTTL:               opts.maxTTL,
+	}
+	ht.ExampleAliases = splitList(opts.exampleAliases)
+	ht.ReservedIDs = splitList(opts.reservedIDs)
+	if err := ht.CheckExampleAliases(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	ht.ExtraCSSHosts = splitList(opts.extraCSSHosts)
+	if err := ht.CheckExtraCSS(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.logFile != "" {
+		lf, err := openLogFile(opts.logFile)
+		if err != nil {
+			panic(fmt.Errorf("log file open error: %w", err))
+		}
+		ht.Output = lf
+		log.SetOutput(lf)
+	}
+	if opts.redisURL != "" {
+		redisOpts, err := redis.ParseURL(opts.redisURL)
+		if err != nil {
+			panic(fmt.Errorf("invalid redis url: %w", err))
+		}
+		fmt.Printf("using redis for usage statistics [addr: %s]\n", redisOpts.Addr)
+		// limits are weekly; keep the stats for a bit longer than that.
+		ht.Usage = db.NewRedisUsageStore(redis.NewClient(redisOpts), "diffy:", 8*24*time.Hour)
+	}
+	if opts.trustProxy {
+		for _, cidr := range strings.Split(opts.trustedProxies, ",") {
+			pfx, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if err != nil {
+				panic(fmt.Errorf("invalid trusted proxy %q: %w", cidr, err))
+			}
+			ht.TrustedProxies = append(ht.TrustedProxies, pfx)
+		}
 	}
 
+	if opts.maxTotalBytes > 0 {
+		go enforceQuota(serverDB, serverStorage, opts.maxTotalBytes)
+	}
+	go deleteExpired(serverDB, serverStorage)
+
+	srv := &gohttp.Server{
+		Addr:              opts.listenAddr,
+		Handler:           ht.Router(),
+		ReadHeaderTimeout: opts.readHeaderTO,
+		ReadTimeout:       opts.readTO,
+		WriteTimeout:      opts.writeTO,
+		IdleTimeout:       opts.idleTO,
+		MaxHeaderBytes:    int(opts.maxHeaderBytes),
+	}
+	if opts.tlsCert != "" {
+		// HTTP/2 is enabled by default with TLS.
+		fmt.Println("listening on", opts.listenAddr, "(https)")
+		panic(srv.ListenAndServeTLS(opts.tlsCert, opts.tlsKey))
+	}
+	if opts.h2c {
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{IdleTimeout: opts.idleTO})
+	}
 	fmt.Println("listening on", opts.listenAddr)
-	panic(gohttp.ListenAndServe(opts.listenAddr, ht.Router()))
+	panic(srv.ListenAndServe())
 }
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,22 +29,37 @@ func (d *DB) init() error {
 var (
 	bFiles = []byte("files")
 	bStats = []byte("stats")
+	// bCreated indexes the files by their creation time; see createdKey.
+	bCreated = []byte("created")
 
 	buckets = [...][]byte{
 		bFiles,
 		bStats,
+		bCreated,
 	}
 )
 
 func (d *DB) _init() {
 	err := d.DB.Update(func(tx *bbolt.Tx) error {
+		// databases created before the index need it to be built.
+		indexed := tx.Bucket(bCreated) != nil
 		for _, buck := range buckets {
 			_, err := tx.CreateBucketIfNotExists(buck)
 			if err != nil {
 				return err
 			}
 		}
-		return nil
+		if indexed {
+			return nil
+		}
+		idx := tx.Bucket(bCreated)
+		return tx.Bucket(bFiles).ForEach(func(k, v []byte) error {
+			var f File
+			if err := json.Unmarshal(v, &f); err != nil {
+				return fmt.Errorf("decoding file %q: %w", k, err)
+			}
+			return idx.Put(createdKey(f.CreatedAt, string(k)), nil)
+		})
 	})
 	if err != nil {
 		d.err = fmt.Errorf("initialization error: %w", err)
@@ -56,12 +73,38 @@ func (d *DB) _init() {
 type File struct {
 	CreatedAt time.Time `json:"created_at"`
 	Sum       string    `json:"sum"`
+	// Size is the size of the stored archive, in bytes. It is 0 for the
+	// records created before it was introduced.
+	Size uint64 `json:"size,omitempty"`
+	// ExpiresAt is the time after which the diff is no longer served, and
+	// is deleted. It is zero for diffs which do not expire.
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 func (f File) IsZero() bool {
 	return f.Sum == ""
 }
 
+// Expired reports whether f has an expiry time, and it is before now.
+func (f File) Expired(now time.Time) bool {
+	return !f.ExpiresAt.IsZero() && f.ExpiresAt.Before(now)
+}
+
+// Ping checks that the database can be read.
+func (d *DB) Ping() error {
+	if err := d.init(); err != nil {
+		return err
+	}
+	return d.DB.View(func(tx *bbolt.Tx) error {
+		for _, buck := range buckets {
+			if tx.Bucket(buck) == nil {
+				return fmt.Errorf("bucket %q does not exist", buck)
+			}
+		}
+		return nil
+	})
+}
+
 func (d *DB) HasFile(name string) (bool, error) {
 	if err := d.init(); err != nil {
 		return false, err
@@ -86,6 +129,12 @@ func (d *DB) PutFile(name string, f File) error {
 	}
 
 	return d.DB.Batch(func(tx *bbolt.Tx) error {
+		if err := unindexFile(tx, name); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bCreated).Put(createdKey(f.CreatedAt, name), nil); err != nil {
+			return err
+		}
 		return tx.Bucket(bFiles).Put([]byte(name), encoded)
 	})
 }
@@ -110,6 +159,172 @@ func (d *DB) GetFile(name string) (File, error) {
 	return f, err
 }
 
+// UpdateFile calls update with the file with the given name, if it exists,
+// and stores it if update returns true, reading and writing it in the same
+// transaction, so that concurrent writes are not lost. It reports whether the
+// file was stored.
+func (d *DB) UpdateFile(name string, update func(f *File) bool) (bool, error) {
+	if err := d.init(); err != nil {
+		return false, err
+	}
+
+	var updated bool
+	err := d.DB.Batch(func(tx *bbolt.Tx) error {
+		// Batch may call the function more than once.
+		updated = false
+		v := tx.Bucket(bFiles).Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		var f File
+		if err := json.Unmarshal(v, &f); err != nil {
+			return fmt.Errorf("decoding file %q: %w", name, err)
+		}
+		old := f.CreatedAt
+		if !update(&f) {
+			return nil
+		}
+		encoded, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(bCreated).Delete(createdKey(old, name)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bCreated).Put(createdKey(f.CreatedAt, name), nil); err != nil {
+			return err
+		}
+		updated = true
+		return tx.Bucket(bFiles).Put([]byte(name), encoded)
+	})
+	return updated, err
+}
+
+// DelFile removes the file with the given name. It returns nil if it doesn't
+// exist.
+func (d *DB) DelFile(name string) error {
+	if err := d.init(); err != nil {
+		return err
+	}
+
+	return d.DB.Batch(func(tx *bbolt.Tx) error {
+		if err := unindexFile(tx, name); err != nil {
+			return err
+		}
+		return tx.Bucket(bFiles).Delete([]byte(name))
+	})
+}
+
+// DelFileIf removes the file with the given name if it exists and cond
+// returns true for it, reading and removing it in the same transaction, so
+// that concurrent writes are not lost. It reports whether the file was
+// removed.
+func (d *DB) DelFileIf(name string, cond func(f File) bool) (bool, error) {
+	if err := d.init(); err != nil {
+		return false, err
+	}
+
+	var deleted bool
+	err := d.DB.Batch(func(tx *bbolt.Tx) error {
+		// Batch may call the function more than once.
+		deleted = false
+		v := tx.Bucket(bFiles).Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		var f File
+		if err := json.Unmarshal(v, &f); err != nil {
+			return fmt.Errorf("decoding file %q: %w", name, err)
+		}
+		if !cond(f) {
+			return nil
+		}
+		if err := tx.Bucket(bCreated).Delete(createdKey(f.CreatedAt, name)); err != nil {
+			return err
+		}
+		deleted = true
+		return tx.Bucket(bFiles).Delete([]byte(name))
+	})
+	return deleted, err
+}
+
+// createdKey returns the key of the file name in bCreated: the seconds since
+// the unix epoch, with the sign bit flipped so that negative values sort
+// first, and the nanoseconds, both big-endian, followed by the name. Keys are
+// thus ordered by creation time.
+func createdKey(t time.Time, name string) []byte {
+	k := make([]byte, 12, 12+len(name))
+	binary.BigEndian.PutUint64(k, uint64(t.Unix())^1<<63)
+	binary.BigEndian.PutUint32(k[8:], uint32(t.Nanosecond()))
+	return append(k, name...)
+}
+
+// unindexFile removes the existing file name, if any, from bCreated.
+func unindexFile(tx *bbolt.Tx, name string) error {
+	v := tx.Bucket(bFiles).Get([]byte(name))
+	if v == nil {
+		return nil
+	}
+	var f File
+	if err := json.Unmarshal(v, &f); err != nil {
+		return fmt.Errorf("decoding file %q: %w", name, err)
+	}
+	return tx.Bucket(bCreated).Delete(createdKey(f.CreatedAt, name))
+}
+
+// ListFiles calls cb for each file in the database, in lexicographical order
+// of their names. If cb returns an error, iteration stops and the error is
+// returned.
+func (d *DB) ListFiles(cb func(name string, f File) error) error {
+	if err := d.init(); err != nil {
+		return err
+	}
+
+	return d.DB.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bFiles).ForEach(func(k, v []byte) error {
+			var f File
+			if err := json.Unmarshal(v, &f); err != nil {
+				return fmt.Errorf("decoding file %q: %w", k, err)
+			}
+			return cb(string(k), f)
+		})
+	})
+}
+
+// ListFilesCreated is like ListFiles, but only calls cb for the files created
+// at or after after, and before before, in order of creation. A zero after or
+// before leaves the range open on that side. Only the files in the range are
+// read.
+func (d *DB) ListFilesCreated(after, before time.Time, cb func(name string, f File) error) error {
+	if err := d.init(); err != nil {
+		return err
+	}
+
+	return d.DB.View(func(tx *bbolt.Tx) error {
+		files := tx.Bucket(bFiles)
+		c := tx.Bucket(bCreated).Cursor()
+		k, _ := c.First()
+		if !after.IsZero() {
+			k, _ = c.Seek(createdKey(after, ""))
+		}
+		var end []byte
+		if !before.IsZero() {
+			end = createdKey(before, "")
+		}
+		for ; k != nil && (end == nil || bytes.Compare(k, end) < 0); k, _ = c.Next() {
+			name := k[12:]
+			var f File
+			if err := json.Unmarshal(files.Get(name), &f); err != nil {
+				return fmt.Errorf("decoding file %q: %w", name, err)
+			}
+			if err := cb(string(name), f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // UsageStat
 // -----------------------------------------------------------------------------
 
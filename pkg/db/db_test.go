@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.etcd.io/bbolt"
@@ -56,6 +58,149 @@ func TestFiles(t *testing.T) {
 	}
 }
 
+func TestListDelFiles(t *testing.T) {
+	d := newDB(t)
+	for _, name := range []string{"b", "a", "c"} {
+		require.NoError(t, d.PutFile(name, File{Sum: name + "sum"}))
+	}
+
+	require.NoError(t, d.DelFile("b"))
+	// deleting a non-existing file is not an error.
+	require.NoError(t, d.DelFile("d"))
+
+	var names []string
+	err := d.ListFiles(func(name string, f File) error {
+		assert.Equal(t, name+"sum", f.Sum)
+		names = append(names, name)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, names)
+}
+
+func TestUpdateFile(t *testing.T) {
+	d := newDB(t)
+	setSize := func(f *File) bool {
+		if f.Size != 0 {
+			return false
+		}
+		f.Size = 10
+		return true
+	}
+
+	// missing files are not created.
+	updated, err := d.UpdateFile("a", setSize)
+	require.NoError(t, err)
+	assert.False(t, updated)
+	has, err := d.HasFile("a")
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	require.NoError(t, d.PutFile("a", File{Sum: "asum"}))
+	updated, err = d.UpdateFile("a", setSize)
+	require.NoError(t, err)
+	assert.True(t, updated)
+	require.NoError(t, d.PutFile("b", File{Sum: "bsum", Size: 20}))
+	updated, err = d.UpdateFile("b", setSize)
+	require.NoError(t, err)
+	assert.False(t, updated)
+
+	f, err := d.GetFile("a")
+	require.NoError(t, err)
+	assert.Equal(t, File{Sum: "asum", Size: 10}, f)
+	f, err = d.GetFile("b")
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, f.Size)
+}
+
+func TestDelFileIf(t *testing.T) {
+	d := newDB(t)
+	now := time.Now()
+	require.NoError(t, d.PutFile("a", File{Sum: "asum", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)}))
+	expired := func(f File) bool { return f.Expired(now) }
+
+	deleted, err := d.DelFileIf("b", expired)
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	// the file was uploaded again without expiry.
+	require.NoError(t, d.PutFile("a", File{Sum: "asum", CreatedAt: now}))
+	deleted, err = d.DelFileIf("a", expired)
+	require.NoError(t, err)
+	assert.False(t, deleted)
+	has, err := d.HasFile("a")
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	deleted, err = d.DelFileIf("a", func(f File) bool { return f.Sum == "asum" })
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	has, err = d.HasFile("a")
+	require.NoError(t, err)
+	assert.False(t, has)
+	var n int
+	require.NoError(t, d.ListFilesCreated(time.Time{}, now.Add(time.Hour), func(string, File) error {
+		n++
+		return nil
+	}))
+	assert.Zero(t, n)
+}
+
+func TestListFilesCreated(t *testing.T) {
+	d := newDB(t)
+	day := func(n int) time.Time { return time.Date(2025, time.March, n, 12, 0, 0, 0, time.UTC) }
+	for name, created := range map[string]time.Time{
+		"old":    {},
+		"a":      day(1),
+		"b":      day(2),
+		"c":      day(2).Add(time.Nanosecond),
+		"d":      day(3),
+		"e":      day(4),
+		"before": time.Date(1960, time.January, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		require.NoError(t, d.PutFile(name, File{CreatedAt: created, Sum: name + "sum"}))
+	}
+	// updating and deleting files updates the index.
+	require.NoError(t, d.PutFile("e", File{CreatedAt: day(5), Sum: "esum", Size: 10}))
+	require.NoError(t, d.DelFile("d"))
+
+	list := func(after, before time.Time) []string {
+		var names []string
+		err := d.ListFilesCreated(after, before, func(name string, f File) error {
+			assert.Equal(t, name+"sum", f.Sum)
+			names = append(names, name)
+			return nil
+		})
+		require.NoError(t, err)
+		return names
+	}
+	assert.Equal(t, []string{"old", "before", "a", "b", "c", "e"}, list(time.Time{}, time.Time{}))
+	assert.Equal(t, []string{"old", "before", "a"}, list(time.Time{}, day(2)))
+	assert.Equal(t, []string{"b", "c", "e"}, list(day(2), time.Time{}))
+	assert.Equal(t, []string{"c"}, list(day(2).Add(time.Nanosecond), day(4)))
+	assert.Empty(t, list(day(4), day(5)))
+	assert.Equal(t, []string{"e"}, list(day(5), day(6)))
+}
+
+func TestCreatedIndexMigration(t *testing.T) {
+	d := newDB(t)
+	// a database created before the index.
+	require.NoError(t, d.DB.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket(bFiles)
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("b"), []byte(`{"created_at":"2025-01-02T00:00:00Z","sum":"bsum"}`)))
+		return b.Put([]byte("a"), []byte(`{"created_at":"2025-01-03T00:00:00Z","sum":"asum"}`))
+	}))
+
+	var names []string
+	err := d.ListFilesCreated(time.Time{}, time.Time{}, func(name string, f File) error {
+		names = append(names, name)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "a"}, names)
+}
+
 func TestAddAmountsAndCompare(t *testing.T) {
 	type call struct {
 		name   string
@@ -89,19 +234,41 @@ func TestAddAmountsAndCompare(t *testing.T) {
 				{"morgan", UsageStat{Period: "2025/2", NumBytes: 100, NumCalls: 1}, UploadLimits{MaxBytes: 1 << 30, MaxCalls: 1}, ErrLimitsExceeded},
 			},
 		},
+		{
+			"rejected_not_counted",
+			[]call{
+				{"morgan", UsageStat{Period: "2025/1", NumBytes: 100, NumCalls: 1}, UploadLimits{MaxBytes: 150, MaxCalls: 10}, nil},
+				{"morgan", UsageStat{Period: "2025/1", NumBytes: 100, NumCalls: 1}, UploadLimits{MaxBytes: 150, MaxCalls: 10}, ErrLimitsExceeded},
+				{"morgan", UsageStat{Period: "2025/1", NumBytes: 50, NumCalls: 1}, UploadLimits{MaxBytes: 150, MaxCalls: 10}, nil},
+			},
+		},
+	}
+
+	stores := []struct {
+		name string
+		new  func(t *testing.T) UsageStore
+	}{
+		{"bolt", func(t *testing.T) UsageStore { return newDB(t) }},
+		{"redis", func(t *testing.T) UsageStore {
+			cl := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+			t.Cleanup(func() { cl.Close() })
+			return NewRedisUsageStore(cl, "diffy:", 8*24*time.Hour)
+		}},
 	}
 
-	for _, tc := range tt {
-		t.Run(tc.name, func(t *testing.T) {
-			db := newDB(t)
-			for _, cal := range tc.calls {
-				err := db.AddAmountsAndCompare(cal.name, cal.d, cal.lim)
-				if cal.result == nil {
-					assert.NoError(t, err)
-				} else {
-					assert.ErrorIs(t, err, cal.result)
+	for _, st := range stores {
+		for _, tc := range tt {
+			t.Run(st.name+"/"+tc.name, func(t *testing.T) {
+				store := st.new(t)
+				for _, cal := range tc.calls {
+					err := store.AddAmountsAndCompare(cal.name, cal.d, cal.lim)
+					if cal.result == nil {
+						assert.NoError(t, err)
+					} else {
+						assert.ErrorIs(t, err, cal.result)
+					}
 				}
-			}
-		})
+			})
+		}
 	}
 }
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// UsageStore records the usage of the upload endpoint, and enforces the limits
+// on it. [*DB] is the default implementation.
+type UsageStore interface {
+	// AddAmountsAndCompare increases the stats for name, and ensures that the
+	// updated stats are within the given limits. If the limits are exceeded,
+	// [ErrLimitsExceeded] is returned and the stats are not changed.
+	// The operation must be atomic.
+	AddAmountsAndCompare(name string, deltaStat UsageStat, limits UploadLimits) error
+}
+
+// RedisUsageStore is a [UsageStore] backed by Redis, which allows multiple
+// instances of diffy to share the same limits.
+type RedisUsageStore struct {
+	cl     redis.UniversalClient
+	prefix string
+	expiry time.Duration
+}
+
+// NewRedisUsageStore creates a new [RedisUsageStore]. The keys are prefixed
+// with prefix. The stats of each period expire after expiry, which should be
+// longer than the period itself.
+func NewRedisUsageStore(cl redis.UniversalClient, prefix string, expiry time.Duration) *RedisUsageStore {
+	return &RedisUsageStore{cl: cl, prefix: prefix, expiry: expiry}
+}
+
+// addAmountsScript atomically adds the amounts to the stats in the hash at
+// KEYS[1], unless the result would exceed the limits, in which case it
+// returns 0.
+//
+// ARGV: bytes, calls, max bytes, max calls, expiry in milliseconds.
+var addAmountsScript = redis.NewScript(`
+local nb = tonumber(redis.call('HGET', KEYS[1], 'nb') or '0') + tonumber(ARGV[1])
+local nc = tonumber(redis.call('HGET', KEYS[1], 'nc') or '0') + tonumber(ARGV[2])
+if nb > tonumber(ARGV[3]) or nc > tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'nb', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'nc', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// AddAmountsAndCompare implements [UsageStore].
+func (r *RedisUsageStore) AddAmountsAndCompare(name string, deltaStat UsageStat, limits UploadLimits) error {
+	// the period is part of the key, so a new period starts from zero.
+	key := r.prefix + "usage:" + deltaStat.Period + ":" + name
+	ok, err := addAmountsScript.Run(
+		context.Background(), r.cl, []string{key},
+		deltaStat.NumBytes, deltaStat.NumCalls,
+		limits.MaxBytes, limits.MaxCalls,
+		r.expiry.Milliseconds(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLimitsExceeded
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package diff
+
+import "strings"
+
+// ExpandBlocks expands the context of the hunks of u up to the nearest blank
+// lines of the old file, so that the blocks around each change are shown
+// whole. At most max lines are added before and after each hunk. old are the
+// lines of the old file, as returned by [SplitLines]. Hunks which become
+// adjacent are merged.
+func ExpandBlocks(u Unified, old []string, max int) Unified {
+	blank := func(i int) bool { return strings.TrimSpace(old[i]) == "" }
+
+	hunks := make([]Hunk, 0, len(u.Hunks))
+	for i, h := range u.Hunks {
+		// the 0-indexed lines of the hunk in the old file are [start, end);
+		// startNew is the first line in the new file.
+		start, startNew := h.LineOld-1, h.LineNew-1
+		if h.CountOld == 0 {
+			start = h.LineOld
+		}
+		if h.CountNew == 0 {
+			startNew = h.LineNew
+		}
+		end := start + h.CountOld
+
+		// the expanded context must not reach into the hunks around.
+		prevEnd, nextStart := 0, len(old)
+		if len(hunks) > 0 {
+			last := hunks[len(hunks)-1]
+			prevEnd = last.LineOld - 1 + last.CountOld
+		}
+		if i+1 < len(u.Hunks) {
+			next := u.Hunks[i+1]
+			nextStart = next.LineOld - 1
+			if next.CountOld == 0 {
+				nextStart = next.LineOld
+			}
+		}
+
+		var before []HunkLine
+		for n := 0; n < max && start > prevEnd && !blank(start-1); n++ {
+			start--
+			startNew--
+			before = append(before, HunkLine{NumberX: start + 1, NumberY: startNew + 1, Value: " " + old[start]})
+		}
+		lines := make([]HunkLine, 0, len(before)+len(h.Lines))
+		for j := len(before) - 1; j >= 0; j-- {
+			lines = append(lines, before[j])
+		}
+		lines = append(lines, h.Lines...)
+		endNew := startNew + h.CountNew + len(before)
+		for n := 0; n < max && end < nextStart && !blank(end); n++ {
+			lines = append(lines, HunkLine{NumberX: end + 1, NumberY: endNew + 1, Value: " " + old[end]})
+			end++
+			endNew++
+		}
+
+		h = Hunk{
+			LineOld:  start + 1,
+			CountOld: end - start,
+			LineNew:  startNew + 1,
+			CountNew: endNew - startNew,
+			Lines:    lines,
+		}
+		if h.CountOld == 0 {
+			h.LineOld--
+		}
+		if h.CountNew == 0 {
+			h.LineNew--
+		}
+		if len(hunks) > 0 && start == prevEnd {
+			last := &hunks[len(hunks)-1]
+			last.CountOld += h.CountOld
+			last.CountNew += h.CountNew
+			last.Lines = append(last.Lines, h.Lines...)
+			continue
+		}
+		hunks = append(hunks, h)
+	}
+	u.Hunks = hunks
+	return u
+}
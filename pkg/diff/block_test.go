@@ -0,0 +1,52 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandBlocks(t *testing.T) {
+	old := "func a() {\n\tx := 1\n\ty := 2\n\tz := 3\n}\n\nfunc b() {\n\treturn\n}\n"
+	for _, tc := range []struct {
+		name string
+		new  string
+		max  int
+		want string
+	}{
+		{
+			"Block",
+			"func a() {\n\tx := 1\n\ty := 5\n\tz := 3\n}\n\nfunc b() {\n\treturn\n}\n", 50,
+			"@@ -1,5 +1,5 @@\n func a() {\n \tx := 1\n-\ty := 2\n+\ty := 5\n \tz := 3\n }\n",
+		},
+		{
+			"Max",
+			"func a() {\n\tx := 1\n\ty := 5\n\tz := 3\n}\n\nfunc b() {\n\treturn\n}\n", 1,
+			"@@ -2,3 +2,3 @@\n \tx := 1\n-\ty := 2\n+\ty := 5\n \tz := 3\n",
+		},
+		{
+			"Merge",
+			"func a() {\n\tx := 4\n\ty := 2\n\tz := 6\n}\n\nfunc b() {\n\treturn\n}\n", 50,
+			"@@ -1,5 +1,5 @@\n func a() {\n-\tx := 1\n+\tx := 4\n \ty := 2\n-\tz := 3\n+\tz := 6\n }\n",
+		},
+		{
+			"Insert",
+			"func a() {\n\tx := 1\n\tw := 0\n\ty := 2\n\tz := 3\n}\n\nfunc b() {\n\treturn\n}\n", 50,
+			"@@ -1,5 +1,6 @@\n func a() {\n \tx := 1\n+\tw := 0\n \ty := 2\n \tz := 3\n }\n",
+		},
+		{
+			"Separate",
+			"func a() {\n\tx := 1\n\ty := 2\n\tz := 3\n}\n\nfunc b() {\n\treturn nil\n}\n", 50,
+			"@@ -7,3 +7,3 @@\n func b() {\n-\treturn\n+\treturn nil\n }\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := DiffWithOptions("old", []byte(old), "new", []byte(tc.new), Options{})
+			u = ExpandBlocks(u, SplitLines([]byte(old)), tc.max)
+			var b strings.Builder
+			u.writeHunks(&b)
+			if have := b.String(); have != tc.want {
+				t.Errorf("have:\n%s\nwant:\n%s", have, tc.want)
+			}
+		})
+	}
+}
@@ -11,8 +11,11 @@ package diff
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -20,7 +23,55 @@ import (
 type Unified struct {
 	OldName string
 	NewName string
-	Hunks   []Hunk
+	// OldMode and NewMode are the optional git modes of the files, like
+	// "100644". They are not set by [Diff].
+	OldMode string
+	NewMode string
+	// OldDevNull and NewDevNull mark the old or the new file as nonexistent
+	// (/dev/null), for diffs adding or deleting a whole file. They are not
+	// set by [Diff].
+	OldDevNull bool
+	NewDevNull bool
+	// OldLabel and NewLabel are optional labels of the files, like revisions.
+	// They are shown after the names in the headers, separated by a tab,
+	// where diff shows the modification times; patch and git apply ignore
+	// them. They are not set by [Diff].
+	OldLabel string
+	NewLabel string
+	Hunks    []Hunk
+}
+
+// devNull is the name of the nonexistent file in diff headers.
+const devNull = "/dev/null"
+
+// defaultGitMode is the git mode of new and deleted files whose mode is not
+// known.
+const defaultGitMode = "100644"
+
+// ModeChanged reports whether the modes of both files are known, and differ.
+// It is false for added or deleted files.
+func (d Unified) ModeChanged() bool {
+	return !d.OldDevNull && !d.NewDevNull &&
+		d.OldMode != "" && d.NewMode != "" && d.OldMode != d.NewMode
+}
+
+// headerNames returns the names of the files in the --- and +++ lines, with
+// the given prefixes.
+func (d Unified) headerNames(oldPrefix, newPrefix string) (string, string) {
+	oldName, newName := oldPrefix+d.OldName, newPrefix+d.NewName
+	if d.OldLabel != "" {
+		oldName += "\t" + d.OldLabel
+	}
+	if d.NewLabel != "" {
+		newName += "\t" + d.NewLabel
+	}
+	if d.OldDevNull {
+		oldName = devNull
+	}
+	if d.NewDevNull {
+		newName = devNull
+	}
+	return oldName, newName
 }
 
 // Hunk is a single hunk of the [Unified] diff.
@@ -32,13 +83,27 @@ type Hunk struct {
 	Lines    []HunkLine
 }
 
+// Header returns the header line of the hunk, without the newline. Like git,
+// the count of lines is omitted if it is 1.
+func (h Hunk) Header() string {
+	return "@@ -" + hunkRange(h.LineOld, h.CountOld) + " +" + hunkRange(h.LineNew, h.CountNew) + " @@"
+}
+
+func hunkRange(line, count int) string {
+	if count == 1 {
+		return strconv.Itoa(line)
+	}
+	return strconv.Itoa(line) + "," + strconv.Itoa(count)
+}
+
 // SplitViewPaddings is used by the eventual template to determine the padding
 // lines to write on the left and right hand side to align the diffs correctly.
 func (h Hunk) SplitViewPaddings() struct{ Red, Green map[int]int } {
 	red, green := map[int]int{}, map[int]int{}
 	for i := 0; i < len(h.Lines); i++ {
 		l := h.Lines[i]
-		if l.Type() == TypeEqual {
+		if t := l.Type(); t == TypeEqual || t == TypeInvalid {
+			// invalid lines are shown on both sides, like equal ones.
 			continue
 		}
 		ins, del := countNextInsertDelete(h.Lines[i:])
@@ -75,6 +140,12 @@ type HunkLine struct {
 	NumberX int
 	NumberY int
 	Value   string
+	// Normalized is set, with [Options.ShowNormalized], on equal lines which
+	// differ in the two files, and only compare equal once normalized by
+	// [Options.Normal]. Value is then the line of the old file, and ValueY
+	// the line of the new file, with the same symbol.
+	Normalized bool
+	ValueY     string
 }
 
 // Possible results of [HunkLine.Type].
@@ -86,6 +157,9 @@ const (
 )
 
 func (l HunkLine) Type() string {
+	if l.Value == "" {
+		return TypeInvalid
+	}
 	switch l.Value[0] {
 	case '+':
 		return TypeInsert
@@ -97,29 +171,191 @@ func (l HunkLine) Type() string {
 	return TypeInvalid
 }
 
+// Symbol returns the first character of the line in the unified diff: '+',
+// '-' or ' '. For invalid lines, it returns '?'.
 func (l HunkLine) Symbol() byte {
+	if l.Type() == TypeInvalid {
+		return '?'
+	}
 	return l.Value[0]
 }
 
-func (l HunkLine) Content() string { return string(l.Value[1:]) }
+// Content returns the line without the symbol. Invalid lines are returned
+// verbatim.
+func (l HunkLine) Content() string {
+	if l.Type() == TypeInvalid {
+		return l.Value
+	}
+	return l.Value[1:]
+}
+
+// NewContent is like Content, but returns the line of the new file for
+// Normalized lines.
+func (l HunkLine) NewContent() string {
+	if l.Normalized {
+		return l.ValueY[1:]
+	}
+	return l.Content()
+}
+
+// OldLine returns the line number in the old file, or an empty string if the
+// line was inserted.
+func (l HunkLine) OldLine() string { return lineNumber(l.NumberX) }
+
+// NewLine returns the line number in the new file, or an empty string if the
+// line was deleted.
+func (l HunkLine) NewLine() string { return lineNumber(l.NumberY) }
+
+func lineNumber(n int) string {
+	if n == -1 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
 
 func (d Unified) String() string {
 	if len(d.Hunks) == 0 {
 		return ""
 	}
 	var b strings.Builder
-	fmt.Fprintf(&b, "diff %s %s\n", d.OldName, d.NewName)
-	fmt.Fprintf(&b, "--- %s\n", d.OldName)
-	fmt.Fprintf(&b, "+++ %s\n", d.NewName)
+	d.writeHeader(&b)
+	d.writeHunks(&b)
+	return b.String()
+}
+
+// NumberedString is like String, but each line of the hunks is prefixed with
+// its numbers in the old and in the new file, so that the lines can be
+// referenced. The result is not a valid diff.
+func (d Unified) NumberedString() string {
+	if len(d.Hunks) == 0 {
+		return ""
+	}
+	width := 1
+	for _, hunk := range d.Hunks {
+		width = max(width,
+			len(strconv.Itoa(hunk.LineOld+hunk.CountOld)),
+			len(strconv.Itoa(hunk.LineNew+hunk.CountNew)))
+	}
+	var b strings.Builder
+	d.writeHeader(&b)
+	for _, hunk := range d.Hunks {
+		b.WriteString(hunk.Header())
+		b.WriteByte('\n')
+		for _, l := range hunk.Lines {
+			fmt.Fprintf(&b, "%*s %*s %s\n", width, l.OldLine(), width, l.NewLine(), l.Value)
+		}
+	}
+	return b.String()
+}
+
+func (d Unified) writeHeader(b *strings.Builder) {
+	oldName, newName := d.headerNames("", "")
+	fmt.Fprintf(b, "diff %s %s\n", d.OldName, d.NewName)
+	fmt.Fprintf(b, "--- %s\n", oldName)
+	fmt.Fprintf(b, "+++ %s\n", newName)
+}
+
+// GitPatch returns the diff in the format of git diff, which can be applied
+// using git apply. Like String, it returns an empty string if there are no
+// hunks, unless the file was added or deleted, or its mode changed.
+func (d Unified) GitPatch() string {
+	if len(d.Hunks) == 0 && !d.ModeChanged() && !d.OldDevNull && !d.NewDevNull {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "diff --git a/%s b/%s\n", d.OldName, d.NewName)
+	switch {
+	case d.OldDevNull:
+		fmt.Fprintf(&b, "new file mode %s\n", cmp.Or(d.NewMode, defaultGitMode))
+	case d.NewDevNull:
+		fmt.Fprintf(&b, "deleted file mode %s\n", cmp.Or(d.OldMode, defaultGitMode))
+	case d.ModeChanged():
+		fmt.Fprintf(&b, "old mode %s\nnew mode %s\n", d.OldMode, d.NewMode)
+	}
+	if len(d.Hunks) == 0 {
+		return b.String()
+	}
+	oldName, newName := d.headerNames("a/", "b/")
+	fmt.Fprintf(&b, "--- %s\n", oldName)
+	fmt.Fprintf(&b, "+++ %s\n", newName)
+	d.writeHunks(&b)
+	return b.String()
+}
 
+func (d Unified) writeHunks(b *strings.Builder) {
 	for _, hunk := range d.Hunks {
-		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", hunk.LineOld, hunk.CountOld, hunk.LineNew, hunk.CountNew)
+		b.WriteString(hunk.Header())
+		b.WriteByte('\n')
 		for _, s := range hunk.Lines {
 			b.WriteString(string(s.Value))
 			b.WriteByte('\n')
 		}
 	}
-	return b.String()
+}
+
+// Stats holds the number of lines added and deleted in a diff.
+type Stats struct {
+	Added   int
+	Deleted int
+}
+
+// Stats counts the lines added and deleted in d.
+func (d Unified) Stats() Stats {
+	var st Stats
+	for _, h := range d.Hunks {
+		for _, l := range h.Lines {
+			switch l.Type() {
+			case TypeInsert:
+				st.Added++
+			case TypeDelete:
+				st.Deleted++
+			}
+		}
+	}
+	return st
+}
+
+// Range is a range of lines of the new file of a diff, from Start to End
+// excluded. Lines are 1-indexed. An empty range, where Start == End, marks
+// the place of deleted lines: they were before line Start.
+type Range struct {
+	Start int
+	End   int
+}
+
+// ChangedRanges returns the ranges of the lines of the new file which were
+// changed in d, in order: one for each run of inserted and deleted lines.
+func (d Unified) ChangedRanges() []Range {
+	var rs []Range
+	for _, h := range d.Hunks {
+		// next is the number of the next line of the new file, and start
+		// the first line of the current run of changes, or -1.
+		next, start := h.LineNew, -1
+		if h.CountNew == 0 {
+			// the hunk is after line LineNew.
+			next++
+		}
+		for _, l := range h.Lines {
+			t := l.Type()
+			if (t == TypeInsert || t == TypeDelete) && start == -1 {
+				start = next
+			}
+			switch t {
+			case TypeInsert:
+				next++
+			case TypeEqual:
+				if start != -1 {
+					rs = append(rs, Range{start, next})
+					start = -1
+				}
+				next++
+			}
+		}
+		if start != -1 {
+			rs = append(rs, Range{start, next})
+		}
+	}
+	return rs
 }
 
 // A pair is a pair of values tracked for both the x and y side of a diff.
@@ -162,22 +398,73 @@ func Diff(oldName string, old []byte, newName string, new []byte) Unified {
 
 // Options are the options that can be passed to [DiffWithOptions].
 type Options struct {
+	// PreProcess, if set, transforms the whole of each input before the diff
+	// is computed. It affects both what is displayed and what is compared.
+	// It is applied before the input is split into lines, and thus before
+	// Normal.
+	PreProcess func(b []byte) []byte
 	// Normal is a function that "normalizes" the strings, to correct comparison.
+	// It is applied to each line, and only affects comparison.
 	Normal func(s string) string
+	// ShowNormalized, if set, makes the lines which only compare equal
+	// thanks to Normal part of the hunks, with the context around them,
+	// as if they were changes; see [HunkLine.Normalized]. Otherwise, they
+	// are only shown if they are in the context of other changes.
+	ShowNormalized bool
 	// Context are the lines of context to add to the hunks.
 	// [Diff] uses a default value of 3.
 	Context int
+	// Algorithm is the algorithm used to match the lines of the two inputs.
+	Algorithm Algorithm
+	// DebugAnchors, if set, is called with the pairs of lines matched by the
+	// algorithm, before they are expanded into hunks: for [Anchored], these
+	// are the unique lines anchoring the diff. It is meant to debug
+	// unexpected diffs, and does not change the result.
+	DebugAnchors func(anchors []Anchor)
+}
+
+// Anchor is a pair of matching lines of the two inputs; see
+// [Options.DebugAnchors]. The line numbers are 1-indexed.
+type Anchor struct {
+	Old int
+	New int
 }
 
+// Algorithm is a diff algorithm; see [Options].
+type Algorithm int
+
+const (
+	// Anchored is the default algorithm; see [Diff] for a description.
+	Anchored Algorithm = iota
+	// Myers is the algorithm described by Eugene W. Myers in
+	// "An O(ND) Difference Algorithm and Its Variations". It finds a diff
+	// with the smallest number of inserted and deleted lines, which is
+	// generally what traditional diff tools output. Unlike [Anchored],
+	// it may match unrelated lines, like blank lines or closing braces, to
+	// achieve this.
+	Myers
+)
+
 // DiffWithOptions performs the diff on the given files, using the given [Options].
 func DiffWithOptions(oldName string, old []byte, newName string, new []byte, opts Options) Unified {
+	u, _ := DiffContext(context.Background(), oldName, old, newName, new, opts)
+	return u
+}
+
+// DiffContext is like [DiffWithOptions], but it stops computing the diff when
+// ctx is done, returning ctx.Err().
+func DiffContext(ctx context.Context, oldName string, old []byte, newName string, new []byte, opts Options) (Unified, error) {
 	// TODO: Context lines should likely "intelligently" choose between the old
 	// and new depending on whether the previous line was from the new or old text.
 	// (This is useful when doing diff ignoring whitespace).
 
+	if opts.PreProcess != nil {
+		old, new = opts.PreProcess(old), opts.PreProcess(new)
+	}
+
 	u := Unified{OldName: oldName, NewName: newName}
 	if bytes.Equal(old, new) {
-		return u
+		return u, nil
 	}
 	xDisp, x := lines(old, opts.Normal)
 	yDisp, y := lines(new, opts.Normal)
@@ -186,7 +473,7 @@ func DiffWithOptions(oldName string, old []byte, newName string, new []byte, opt
 	// expanding each match to include surrounding lines,
 	// and then printing diff chunks.
 	// To avoid setup/teardown cases outside the loop,
-	// tgs returns a leading {0,0} and trailing {len(x), len(y)} pair
+	// tgs and myers return a leading {0,0} and trailing {len(x), len(y)} pair
 	// in the sequence of matches.
 	var (
 		done  pair       // printed up to x[:done.x] and y[:done.y]
@@ -194,8 +481,46 @@ func DiffWithOptions(oldName string, old []byte, newName string, new []byte, opt
 		count pair       // number of lines from each side in current chunk
 		ctext []HunkLine // lines for current chunk
 	)
-	for _, m := range tgs(x, y) {
-		if m.x < done.x {
+	// common returns the next line of the chunk, for the old line x[i]
+	// matching the new line y[j].
+	common := func(i, j int) HunkLine {
+		count.x++
+		count.y++
+		l := HunkLine{
+			NumberX: chunk.x + count.x,
+			NumberY: chunk.y + count.y,
+			Value:   " " + xDisp[i],
+		}
+		if opts.ShowNormalized && xDisp[i] != yDisp[j] {
+			l.Normalized, l.ValueY = true, " "+yDisp[j]
+		}
+		return l
+	}
+	var matches []pair
+	switch opts.Algorithm {
+	case Myers:
+		var err error
+		matches, err = myers(ctx, x, y)
+		if err != nil {
+			return Unified{}, err
+		}
+	default:
+		// tgs runs in O(n log n) time; only check ctx once it's done.
+		matches = tgs(x, y)
+		if err := ctx.Err(); err != nil {
+			return Unified{}, err
+		}
+	}
+	if opts.DebugAnchors != nil {
+		// skip the sentinels.
+		anchors := make([]Anchor, 0, len(matches)-2)
+		for _, m := range matches[1 : len(matches)-1] {
+			anchors = append(anchors, Anchor{Old: m.x + 1, New: m.y + 1})
+		}
+		opts.DebugAnchors(anchors)
+	}
+	for _, m := range matches {
+		if m.x < done.x || m.y < done.y {
 			// Already handled scanning forward from earlier match.
 			continue
 		}
@@ -226,70 +551,88 @@ func DiffWithOptions(oldName string, old []byte, newName string, new []byte, opt
 			ctext = append(ctext, HunkLine{NumberX: -1, NumberY: chunk.y + count.y, Value: "+" + s})
 		}
 
-		// If we're not at EOF and have too few common lines,
-		// the chunk includes all the common lines and continues.
-		if (end.x < len(x) || end.y < len(y)) &&
-			(end.x-start.x < opts.Context || (len(ctext) > 0 && end.x-start.x < 2*opts.Context)) {
-			for _, s := range xDisp[start.x:end.x] {
-				count.x++
-				count.y++
-				ctext = append(ctext, HunkLine{NumberX: chunk.x + count.x, NumberY: chunk.y + count.y, Value: " " + s})
-			}
-			done = end
-			continue
-		}
-
-		// End chunk with common lines for context.
-		if len(ctext) > 0 {
-			n := end.x - start.x
-			if n > opts.Context {
-				n = opts.Context
+		for {
+			// With ShowNormalized, the common lines which only compare equal
+			// once normalized are handled like changes: the run of common
+			// lines is cut before each of them.
+			cut := end
+			if opts.ShowNormalized {
+				for i := start.x; i < end.x; i++ {
+					if j := start.y + i - start.x; xDisp[i] != yDisp[j] {
+						cut = pair{i, j}
+						break
+					}
+				}
 			}
-			for _, s := range xDisp[start.x : start.x+n] {
-				count.x++
-				count.y++
-				ctext = append(ctext, HunkLine{NumberX: chunk.x + count.x, NumberY: chunk.y + count.y, Value: " " + s})
-			}
-			done = pair{start.x + n, start.y + n}
-
-			// Format and emit chunk.
-			// Convert line numbers to 1-indexed.
-			// Special case: empty file shows up as 0,0 not 1,0.
-			if count.x > 0 {
-				chunk.x++
+			eof := cut.x >= len(x) && cut.y >= len(y)
+
+			// If we're not at EOF and have too few common lines,
+			// the chunk includes all the common lines and continues.
+			if !eof && (cut.x-start.x < opts.Context || (len(ctext) > 0 && cut.x-start.x < 2*opts.Context)) {
+				for i := start.x; i < cut.x; i++ {
+					ctext = append(ctext, common(i, start.y+i-start.x))
+				}
+			} else {
+				// End chunk with common lines for context.
+				if len(ctext) > 0 {
+					n := min(cut.x-start.x, opts.Context)
+					for i := start.x; i < start.x+n; i++ {
+						ctext = append(ctext, common(i, start.y+i-start.x))
+					}
+
+					// Format and emit chunk.
+					// Convert line numbers to 1-indexed.
+					// Special case: empty file shows up as 0,0 not 1,0.
+					if count.x > 0 {
+						chunk.x++
+					}
+					if count.y > 0 {
+						chunk.y++
+					}
+					u.Hunks = append(u.Hunks, Hunk{
+						LineOld:  chunk.x,
+						CountOld: count.x,
+						LineNew:  chunk.y,
+						CountNew: count.y,
+						// Copy slice, as we re-use ctext.
+						Lines: append(make([]HunkLine, 0, len(ctext)), ctext...),
+					})
+					count.x = 0
+					count.y = 0
+					ctext = ctext[:0]
+				}
+
+				// If we reached EOF, we're done.
+				if eof {
+					return u, nil
+				}
+
+				// Otherwise start a new chunk.
+				chunk = pair{cut.x - opts.Context, cut.y - opts.Context}
+				for i := chunk.x; i < cut.x; i++ {
+					ctext = append(ctext, common(i, chunk.y+i-chunk.x))
+				}
 			}
-			if count.y > 0 {
-				chunk.y++
+			done = cut
+			if cut == end {
+				break
 			}
-			u.Hunks = append(u.Hunks, Hunk{
-				LineOld:  chunk.x,
-				CountOld: count.x,
-				LineNew:  chunk.y,
-				CountNew: count.y,
-				// Copy slice, as we re-use ctext.
-				Lines: append(make([]HunkLine, 0, len(ctext)), ctext...),
-			})
-			count.x = 0
-			count.y = 0
-			ctext = ctext[:0]
-		}
-
-		// If we reached EOF, we're done.
-		if end.x >= len(x) && end.y >= len(y) {
-			break
-		}
-
-		// Otherwise start a new chunk.
-		chunk = pair{end.x - opts.Context, end.y - opts.Context}
-		for _, s := range xDisp[chunk.x:end.x] {
-			count.x++
-			count.y++
-			ctext = append(ctext, HunkLine{NumberX: chunk.x + count.x, NumberY: chunk.y + count.y, Value: " " + s})
+			// the line which was cut is shown, marked as Normalized.
+			ctext = append(ctext, common(cut.x, cut.y))
+			start = pair{cut.x + 1, cut.y + 1}
+			done = start
 		}
-		done = end
 	}
 
-	return u
+	return u, nil
+}
+
+// SplitLines splits x into lines as they are displayed in the diff.
+// It does not include the trailing newlines; if x does not end with a newline,
+// the last line has the "No newline at end of file" warning attached.
+func SplitLines(x []byte) []string {
+	disp, _ := lines(x, nil)
+	return disp
 }
 
 // lines returns the lines in the file x, including newlines.
@@ -398,3 +741,115 @@ func tgs(x, y []string) []pair {
 	seq[0] = pair{0, 0} // sentinel at start
 	return seq
 }
+
+// myers returns the pairs of indexes of a longest common subsequence of x and
+// y, using the linear space variant of Myers' algorithm.
+// Like tgs, it adds the sentinel pairs {0,0} and {len(x),len(y)}.
+// It returns ctx.Err() if ctx is done before the subsequence is found.
+func myers(ctx context.Context, x, y []string) ([]pair, error) {
+	seq := []pair{{0, 0}}
+	seq, err := myersLCS(ctx, x, y, 0, len(x), 0, len(y), seq)
+	if err != nil {
+		return nil, err
+	}
+	return append(seq, pair{len(x), len(y)}), nil
+}
+
+// myersLCS appends to seq the common subsequence of x[x0:x1] and y[y0:y1].
+func myersLCS(ctx context.Context, x, y []string, x0, x1, y0, y1 int, seq []pair) ([]pair, error) {
+	// Strip the common prefix and suffix.
+	for x0 < x1 && y0 < y1 && x[x0] == y[y0] {
+		seq = append(seq, pair{x0, y0})
+		x0++
+		y0++
+	}
+	suffix := 0
+	for x0 < x1 && y0 < y1 && x[x1-1] == y[y1-1] {
+		x1--
+		y1--
+		suffix++
+	}
+
+	// If both sides are non-empty, there are at least two edits; split the
+	// problem on the middle snake, which is on an optimal path.
+	if x0 < x1 && y0 < y1 {
+		start, end, err := middleSnake(ctx, x[x0:x1], y[y0:y1])
+		if err != nil {
+			return nil, err
+		}
+		seq, err = myersLCS(ctx, x, y, x0, x0+start.x, y0, y0+start.y, seq)
+		if err != nil {
+			return nil, err
+		}
+		for i := start.x; i < end.x; i++ {
+			seq = append(seq, pair{x0 + i, y0 + start.y + i - start.x})
+		}
+		seq, err = myersLCS(ctx, x, y, x0+end.x, x1, y0+end.y, y1, seq)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < suffix; i++ {
+		seq = append(seq, pair{x1 + i, y1 + i})
+	}
+	return seq, nil
+}
+
+// middleSnake returns the start and end of the middle snake of an optimal
+// edit path between x and y. ctx is checked at each step of the search, as
+// the time it takes is quadratic in the worst case.
+func middleSnake(ctx context.Context, x, y []string) (start, end pair, err error) {
+	n, m := len(x), len(y)
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+	// vf[off+k] is the furthest x reached on diagonal k going forwards;
+	// vb[off+k] is the same, going backwards (ie. on the reversed inputs).
+	off := maxD + 1
+	vf := make([]int, 2*off+1)
+	vb := make([]int, 2*off+1)
+
+	for d := 0; d <= maxD; d++ {
+		if err := ctx.Err(); err != nil {
+			return start, end, err
+		}
+		for k := -d; k <= d; k += 2 {
+			var i int
+			if k == -d || (k != d && vf[off+k-1] < vf[off+k+1]) {
+				i = vf[off+k+1]
+			} else {
+				i = vf[off+k-1] + 1
+			}
+			j := i - k
+			si, sj := i, j
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+			vf[off+k] = i
+			if kb := delta - k; odd && kb >= -(d-1) && kb <= d-1 && i+vb[off+kb] >= n {
+				return pair{si, sj}, pair{i, j}, nil
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var i int
+			if k == -d || (k != d && vb[off+k-1] < vb[off+k+1]) {
+				i = vb[off+k+1]
+			} else {
+				i = vb[off+k-1] + 1
+			}
+			j := i - k
+			si, sj := i, j
+			for i < n && j < m && x[n-1-i] == y[m-1-j] {
+				i++
+				j++
+			}
+			vb[off+k] = i
+			if kf := delta - k; !odd && kf >= -d && kf <= d && i+vf[off+kf] >= n {
+				return pair{n - i, m - j}, pair{n - si, m - sj}, nil
+			}
+		}
+	}
+	panic("unreachable")
+}
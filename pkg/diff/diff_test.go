@@ -5,7 +5,13 @@
 package diff
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"golang.org/x/tools/txtar"
@@ -42,3 +48,345 @@ func Test(t *testing.T) {
 		})
 	}
 }
+
+func TestPreProcess(t *testing.T) {
+	stripCR := func(b []byte) []byte {
+		return bytes.ReplaceAll(b, []byte("\r"), nil)
+	}
+	old := []byte("a\r\nb\r\nc\r\n")
+	new := []byte("a\nb\nd\n")
+
+	u := DiffWithOptions("old", old, "new", new, Options{Context: 3, PreProcess: stripCR})
+	want := "diff old new\n--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n b\n-c\n+d\n"
+	if have := u.String(); have != want {
+		t.Fatalf("have:\n%s\nwant:\n%s", have, want)
+	}
+
+	// identical after pre-processing.
+	u = DiffWithOptions("old", old, "new", []byte("a\nb\nc\n"), Options{Context: 3, PreProcess: stripCR})
+	if len(u.Hunks) != 0 {
+		t.Fatalf("expected no hunks, got %d", len(u.Hunks))
+	}
+}
+
+func TestStats(t *testing.T) {
+	u := Diff("old", []byte("a\nb\nc\nd\n"), "new", []byte("a\nx\ny\nd\ne\n"))
+	if have, want := u.Stats(), (Stats{Added: 3, Deleted: 2}); have != want {
+		t.Fatalf("have %+v want %+v", have, want)
+	}
+	u = Diff("old", []byte("a\n"), "new", []byte("a\n"))
+	if have, want := u.Stats(), (Stats{}); have != want {
+		t.Fatalf("have %+v want %+v", have, want)
+	}
+}
+
+func TestFullContext(t *testing.T) {
+	// A context as large as the files should yield a single hunk
+	// spanning both files entirely.
+	old := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n")
+	new := []byte("1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n")
+	u := DiffWithOptions("old", old, "new", new, Options{Context: 11})
+	if len(u.Hunks) != 1 {
+		t.Fatalf("expected 1 hunk, got %d", len(u.Hunks))
+	}
+	want := "@@ -1,10 +1,11 @@\n"
+	if have := u.String(); !strings.Contains(have, want) {
+		t.Fatalf("have:\n%s\nwant header %q", have, want)
+	}
+}
+
+func TestMyers(t *testing.T) {
+	// The anchored diff only matches the unique line "a", while Myers
+	// finds the longest common subsequence (a, c, b).
+	old := []byte("a\nc\nc\nc\nb\n")
+	new := []byte("b\na\nb\nc\na\nb\n")
+
+	anchored := Diff("old", old, "new", new)
+	wantAnchored := "diff old new\n--- old\n+++ new\n@@ -1,5 +1,6 @@\n" +
+		"-a\n-c\n-c\n-c\n+b\n+a\n+b\n+c\n+a\n b\n"
+	if have := anchored.String(); have != wantAnchored {
+		t.Errorf("anchored: have:\n%s\nwant:\n%s", have, wantAnchored)
+	}
+
+	myers := DiffWithOptions("old", old, "new", new, Options{Context: 3, Algorithm: Myers})
+	wantMyers := "diff old new\n--- old\n+++ new\n@@ -1,5 +1,6 @@\n" +
+		"+b\n a\n+b\n c\n-c\n-c\n+a\n b\n"
+	if have := myers.String(); have != wantMyers {
+		t.Errorf("myers: have:\n%s\nwant:\n%s", have, wantMyers)
+	}
+}
+
+func TestMyersMinimal(t *testing.T) {
+	// Check that Myers always finds a diff with the minimum number of
+	// edits, computing the longest common subsequence with dynamic
+	// programming.
+	rnd := rand.New(rand.NewSource(42))
+	gen := func() []string {
+		s := make([]string, rnd.Intn(12))
+		for i := range s {
+			s[i] = string("abc}"[rnd.Intn(4)])
+		}
+		return s
+	}
+	for i := 0; i < 5000; i++ {
+		x, y := gen(), gen()
+		lcs := make([][]int, len(x)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(y)+1)
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				if x[i] == y[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		old, new := strings.Join(append(x, ""), "\n"), strings.Join(append(y, ""), "\n")
+		u := DiffWithOptions("old", []byte(old), "new", []byte(new), Options{Context: 3, Algorithm: Myers})
+		st := u.Stats()
+		if st.Added+st.Deleted != len(x)+len(y)-2*lcs[0][0] {
+			t.Fatalf("diff of %q and %q is not minimal:\n%s", old, new, u)
+		}
+	}
+}
+
+func TestHunkLineNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		line     HunkLine
+		old, new string
+	}{
+		{HunkLine{NumberX: 3, NumberY: 4, Value: " x"}, "3", "4"},
+		{HunkLine{NumberX: -1, NumberY: 12, Value: "+x"}, "", "12"},
+		{HunkLine{NumberX: 7, NumberY: -1, Value: "-x"}, "7", ""},
+	} {
+		if have := tc.line.OldLine(); have != tc.old {
+			t.Errorf("%s: OldLine: have %q want %q", tc.line.Type(), have, tc.old)
+		}
+		if have := tc.line.NewLine(); have != tc.new {
+			t.Errorf("%s: NewLine: have %q want %q", tc.line.Type(), have, tc.new)
+		}
+	}
+}
+
+func TestHunkHeader(t *testing.T) {
+	// The headers are the ones of git diff --no-index (without the function
+	// context) for the same files.
+	for _, tc := range []struct {
+		old, new string
+		context  int
+		want     string
+	}{
+		{"a\nb\nc\n", "a\nx\nc\n", 0, "@@ -2 +2 @@"},
+		{"a\n", "b\n", 3, "@@ -1 +1 @@"},
+		{"", "a\nb\n", 3, "@@ -0,0 +1,2 @@"},
+		{"x\n", "", 3, "@@ -1 +0,0 @@"},
+		{"a\nb\nc\n", "a\nb\nnew\nc\n", 0, "@@ -2,0 +3 @@"},
+		{"a\nb\nc\n", "a\nc\n", 0, "@@ -2 +1,0 @@"},
+		{"a\n", "new\na\n", 0, "@@ -0,0 +1 @@"},
+		{"a\nb\n", "a\nb\nc\n", 0, "@@ -2,0 +3 @@"},
+		{"a\nb\nc\nd\ne\nf\ng\nh\n", "a\nb\nc\nd\nE\nf\ng\nh\n", 1, "@@ -4,3 +4,3 @@"},
+	} {
+		u := DiffWithOptions("old", []byte(tc.old), "new", []byte(tc.new), Options{Context: tc.context})
+		if len(u.Hunks) != 1 {
+			t.Errorf("%q %q: expected 1 hunk, got %d", tc.old, tc.new, len(u.Hunks))
+			continue
+		}
+		if have := u.Hunks[0].Header(); have != tc.want {
+			t.Errorf("%q %q: have %q want %q", tc.old, tc.new, have, tc.want)
+		}
+		if have := u.GitPatch(); !strings.Contains(have, "\n"+tc.want+"\n") {
+			t.Errorf("%q %q: header %q not in patch:\n%s", tc.old, tc.new, tc.want, have)
+		}
+	}
+}
+
+func TestInvalidHunkLine(t *testing.T) {
+	for _, v := range []string{"", "x"} {
+		l := HunkLine{NumberX: 1, NumberY: 1, Value: v}
+		if l.Type() != TypeInvalid || l.Symbol() != '?' || l.Content() != v {
+			t.Errorf("%q: have type %q symbol %q content %q", v, l.Type(), l.Symbol(), l.Content())
+		}
+	}
+
+	// must not loop forever.
+	h := Hunk{Lines: []HunkLine{{Value: "-a"}, {Value: "x"}, {Value: "+b"}, {Value: "+c"}}}
+	pads := h.SplitViewPaddings()
+	if pads.Green[0] != 1 || pads.Red[2] != 2 {
+		t.Errorf("unexpected paddings: %+v", pads)
+	}
+}
+
+// countdownContext is a context which is canceled after Err is called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestDiffContext(t *testing.T) {
+	var old, new bytes.Buffer
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&old, "%d\n", r.Intn(10))
+		fmt.Fprintf(&new, "%d\n", r.Intn(10))
+	}
+
+	for _, algo := range []Algorithm{Anchored, Myers} {
+		opts := Options{Context: 3, Algorithm: algo}
+		// canceled in the middle of the diff; for anchored, only at the end.
+		ctx := &countdownContext{Context: context.Background(), n: 10}
+		if algo == Anchored {
+			ctx.n = 0
+		}
+		_, err := DiffContext(ctx, "old", old.Bytes(), "new", new.Bytes(), opts)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("algo %d: expected context.Canceled, got %v", algo, err)
+		}
+
+		u, err := DiffContext(context.Background(), "old", old.Bytes(), "new", new.Bytes(), opts)
+		if err != nil {
+			t.Fatalf("algo %d: %v", algo, err)
+		}
+		if have, want := u.String(), DiffWithOptions("old", old.Bytes(), "new", new.Bytes(), opts).String(); have != want {
+			t.Errorf("algo %d: DiffContext differs from DiffWithOptions", algo)
+		}
+	}
+}
+
+func TestDebugAnchors(t *testing.T) {
+	old := []byte("a\nc\nc\nc\nb\n")
+	new := []byte("b\na\nb\nc\na\nb\n")
+	for _, tc := range []struct {
+		algo Algorithm
+		want []Anchor
+	}{
+		// no line appears exactly once in both inputs.
+		{Anchored, []Anchor{}},
+		{Myers, []Anchor{{1, 2}, {2, 4}, {5, 6}}},
+	} {
+		var anchors []Anchor
+		opts := Options{Context: 3, Algorithm: tc.algo}
+		want := DiffWithOptions("old", old, "new", new, opts).String()
+		opts.DebugAnchors = func(a []Anchor) { anchors = a }
+		have := DiffWithOptions("old", old, "new", new, opts).String()
+		if !reflect.DeepEqual(anchors, tc.want) {
+			t.Errorf("algo %d: anchors: have %v want %v", tc.algo, anchors, tc.want)
+		}
+		if have != want {
+			t.Errorf("algo %d: the diff changed with DebugAnchors", tc.algo)
+		}
+	}
+
+	var anchors []Anchor
+	DiffWithOptions("old", []byte("x\na\ny\n"), "new", []byte("a\nz\n"), Options{
+		DebugAnchors: func(a []Anchor) { anchors = a },
+	})
+	if want := []Anchor{{2, 1}}; !reflect.DeepEqual(anchors, want) {
+		t.Errorf("anchors: have %v want %v", anchors, want)
+	}
+}
+
+func TestNumberedString(t *testing.T) {
+	old := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	new := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nJ\nk\n")
+	u := Diff("old", old, "new", new)
+	want := "diff old new\n--- old\n+++ new\n@@ -7,4 +7,5 @@\n" +
+		" 7  7  g\n" +
+		" 8  8  h\n" +
+		" 9  9  i\n" +
+		"10    -j\n" +
+		"   10 +J\n" +
+		"   11 +k\n"
+	if have := u.NumberedString(); have != want {
+		t.Errorf("have:\n%s\nwant:\n%s", have, want)
+	}
+	if have := Diff("old", old, "new", old).NumberedString(); have != "" {
+		t.Errorf("identical files: have %q", have)
+	}
+}
+
+func TestShowNormalized(t *testing.T) {
+	old := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	new := []byte("a\n  b\nc\nd\ne\nf\ng\nh\nI\nj\n")
+	opts := Options{Context: 1, Normal: strings.TrimSpace}
+
+	u := DiffWithOptions("old", old, "new", new, opts)
+	want := "diff old new\n--- old\n+++ new\n@@ -8,3 +8,3 @@\n h\n-i\n+I\n j\n"
+	if have := u.String(); have != want {
+		t.Errorf("have:\n%s\nwant:\n%s", have, want)
+	}
+
+	opts.ShowNormalized = true
+	u = DiffWithOptions("old", old, "new", new, opts)
+	want = "diff old new\n--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n b\n c\n@@ -8,3 +8,3 @@\n h\n-i\n+I\n j\n"
+	if have := u.String(); have != want {
+		t.Errorf("have:\n%s\nwant:\n%s", have, want)
+	}
+	for i, h := range u.Hunks {
+		for j, l := range h.Lines {
+			if l.Normalized != (i == 0 && j == 1) {
+				t.Errorf("hunk %d line %d %q: have Normalized %v", i, j, l.Value, l.Normalized)
+			}
+		}
+	}
+
+	if l := u.Hunks[0].Lines[1]; l.Content() != "b" || l.NewContent() != "  b" {
+		t.Errorf("line 2: have %q and %q", l.Content(), l.NewContent())
+	}
+
+	// without ShowNormalized, the lines in the context of other changes
+	// are not marked.
+	opts.ShowNormalized, opts.Context = false, 10
+	u = DiffWithOptions("old", old, "new", new, opts)
+	if len(u.Hunks) != 1 || u.Hunks[0].Lines[1].Normalized || u.Hunks[0].Lines[1].NewContent() != "b" {
+		t.Errorf("line 2 marked: %+v", u.Hunks)
+	}
+
+	// files which only differ in whitespace.
+	new = []byte("a\n  b\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	opts.Context = 3
+	if u = DiffWithOptions("old", old, "new", new, opts); len(u.Hunks) != 0 {
+		t.Errorf("have %d hunks, want 0", len(u.Hunks))
+	}
+	opts.ShowNormalized = true
+	u = DiffWithOptions("old", old, "new", new, opts)
+	want = "diff old new\n--- old\n+++ new\n@@ -1,5 +1,5 @@\n a\n b\n c\n d\n e\n"
+	if have := u.String(); have != want {
+		t.Errorf("have:\n%s\nwant:\n%s", have, want)
+	}
+}
+
+func TestChangedRanges(t *testing.T) {
+	for _, tc := range []struct {
+		old, new string
+		want     []Range
+	}{
+		// a changed line, and two inserted ones.
+		{"a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n", "a\nB\nc\nd\ne\nf\ng\nh\nx\ny\ni\nj\n", []Range{{2, 3}, {9, 11}}},
+		// deleted lines, at the start, in the middle and at the end.
+		{"a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n", "b\nc\nd\ne\ng\nh\ni\n", []Range{{1, 1}, {5, 5}, {8, 8}}},
+		// lines replaced by more lines.
+		{"a\nb\nc\n", "a\nx\ny\nz\nc\n", []Range{{2, 5}}},
+		// whole files.
+		{"", "a\nb\n", []Range{{1, 3}}},
+		{"a\nb\n", "", []Range{{1, 1}}},
+		{"a\n", "a\n", nil},
+	} {
+		for _, context := range []int{0, 3} {
+			u := DiffWithOptions("old", []byte(tc.old), "new", []byte(tc.new), Options{Context: context})
+			if have := u.ChangedRanges(); !reflect.DeepEqual(have, tc.want) {
+				t.Errorf("%q %q: context %d: have %v want %v", tc.old, tc.new, context, have, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package diff
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Parse reads the unified diffs in r, one for each file, like the output of
+// [Unified.String], [Unified.GitPatch], diff -u or git diff. Lines outside of
+// the diffs, like the message of a commit, are ignored.
+//
+// The "\ No newline at end of file" markers are attached to the line before
+// them, as done by [Diff]. In git diffs, the a/ and b/ prefixes are removed
+// from the names of the files, and the modes are set.
+func Parse(r io.Reader) ([]Unified, error) {
+	p := parser{r: bufio.NewReader(r)}
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.n, err)
+	}
+	return p.files, nil
+}
+
+type parser struct {
+	r     *bufio.Reader
+	n     int // number of the last line read.
+	files []Unified
+	// cur is the file being parsed, or nil. git is set if it started with a
+	// diff --git line, and header once its --- line has been read.
+	cur         *Unified
+	git, header bool
+}
+
+// next returns the next line, without the newline.
+func (p *parser) next() (string, error) {
+	s, err := p.r.ReadString('\n')
+	if err == io.EOF && s != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	p.n++
+	return strings.TrimSuffix(s, "\n"), nil
+}
+
+func (p *parser) start(git bool) {
+	p.files = append(p.files, Unified{})
+	p.cur, p.git, p.header = &p.files[len(p.files)-1], git, false
+}
+
+func (p *parser) parse() error {
+	for {
+		s, err := p.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(s, "diff --git "):
+			p.start(true)
+			p.cur.OldName, p.cur.NewName = splitNames(s[len("diff --git "):])
+			p.cur.OldName = strings.TrimPrefix(p.cur.OldName, "a/")
+			p.cur.NewName = strings.TrimPrefix(p.cur.NewName, "b/")
+		case strings.HasPrefix(s, "diff "):
+			p.start(false)
+			p.cur.OldName, p.cur.NewName = splitNames(s[len("diff "):])
+		case strings.HasPrefix(s, "--- "):
+			// diff -u has no diff lines, so a --- line starts a new file if
+			// the current one already has its own.
+			if p.cur == nil || p.header {
+				p.start(false)
+			}
+			p.header = true
+			p.cur.OldName, p.cur.OldLabel, p.cur.OldDevNull = p.headerName(s[len("--- "):], "a/", p.cur.OldName)
+		case strings.HasPrefix(s, "+++ ") && p.header && len(p.cur.Hunks) == 0:
+			p.cur.NewName, p.cur.NewLabel, p.cur.NewDevNull = p.headerName(s[len("+++ "):], "b/", p.cur.NewName)
+		case strings.HasPrefix(s, "@@ ") && p.header:
+			if err := p.hunk(s); err != nil {
+				return err
+			}
+		case strings.HasPrefix(s, `\`) && p.cur != nil && len(p.cur.Hunks) > 0:
+			h := &p.cur.Hunks[len(p.cur.Hunks)-1]
+			if len(h.Lines) > 0 {
+				h.Lines[len(h.Lines)-1].Value += "\n" + s
+			}
+		case p.git && !p.header:
+			p.gitHeader(s)
+		}
+	}
+}
+
+// splitNames splits the names in a diff line. Names containing spaces are
+// split in the middle, if they are the same; either way, they are replaced
+// by the names in the --- and +++ lines, if any.
+func splitNames(s string) (string, string) {
+	if n := len(s); n%2 == 1 && s[n/2] == ' ' {
+		if a, b := s[:n/2], s[n/2+1:]; strings.TrimPrefix(a, "a/") == strings.TrimPrefix(b, "b/") {
+			return a, b
+		}
+	}
+	a, b, _ := strings.Cut(s, " ")
+	return a, b
+}
+
+// headerName parses the name of a --- or +++ line, returning name if the
+// file is /dev/null.
+func (p *parser) headerName(s, prefix, name string) (string, string, bool) {
+	s, label, _ := strings.Cut(s, "\t")
+	if s == devNull {
+		return name, "", true
+	}
+	if p.git {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	return s, label, false
+}
+
+// gitHeader parses the extended header lines of git diffs which are before
+// the --- line.
+func (p *parser) gitHeader(s string) {
+	key, mode, _ := strings.Cut(s, " mode ")
+	switch key {
+	case "new file":
+		p.cur.OldDevNull, p.cur.NewMode = true, mode
+	case "deleted file":
+		p.cur.NewDevNull, p.cur.OldMode = true, mode
+	case "old":
+		p.cur.OldMode = mode
+	case "new":
+		p.cur.NewMode = mode
+	}
+}
+
+// hunk parses the hunk with the given header line, reading its lines.
+func (p *parser) hunk(header string) error {
+	h, ok := parseHunkHeader(header)
+	if !ok {
+		return fmt.Errorf("invalid hunk header %q", header)
+	}
+	x, y := h.LineOld, h.LineNew
+	for ox, oy := h.CountOld, h.CountNew; ox > 0 || oy > 0; {
+		s, err := p.next()
+		if err == io.EOF {
+			return errors.New("unexpected end of hunk")
+		}
+		if err != nil {
+			return err
+		}
+		if s == "" {
+			// some tools strip the trailing space of empty context lines.
+			s = " "
+		}
+		l := HunkLine{NumberX: -1, NumberY: -1, Value: s}
+		switch {
+		case s[0] == ' ' && ox > 0 && oy > 0:
+			l.NumberX, l.NumberY = x, y
+			x, y, ox, oy = x+1, y+1, ox-1, oy-1
+		case s[0] == '-' && ox > 0:
+			l.NumberX = x
+			x, ox = x+1, ox-1
+		case s[0] == '+' && oy > 0:
+			l.NumberY = y
+			y, oy = y+1, oy-1
+		case s[0] == '\\' && len(h.Lines) > 0:
+			h.Lines[len(h.Lines)-1].Value += "\n" + s
+			continue
+		default:
+			return fmt.Errorf("unexpected line in hunk %q", s)
+		}
+		h.Lines = append(h.Lines, l)
+	}
+	p.cur.Hunks = append(p.cur.Hunks, h)
+	return nil
+}
+
+// parseHunkHeader parses a line like "@@ -1,3 +1,4 @@ func main() {",
+// returning the hunk without lines.
+func parseHunkHeader(s string) (Hunk, bool) {
+	s = strings.TrimPrefix(s, "@@ ")
+	ranges, _, ok := strings.Cut(s, " @@")
+	if !ok {
+		return Hunk{}, false
+	}
+	old, new, ok := strings.Cut(ranges, " ")
+	if !ok || !strings.HasPrefix(old, "-") || !strings.HasPrefix(new, "+") {
+		return Hunk{}, false
+	}
+	var h Hunk
+	var okOld, okNew bool
+	h.LineOld, h.CountOld, okOld = parseHunkRange(old[1:])
+	h.LineNew, h.CountNew, okNew = parseHunkRange(new[1:])
+	return h, okOld && okNew
+}
+
+// parseHunkRange parses a range written by hunkRange.
+func parseHunkRange(s string) (line, count int, ok bool) {
+	ls, cs, hasCount := strings.Cut(s, ",")
+	line, err := strconv.Atoi(ls)
+	if err != nil || line < 0 {
+		return 0, 0, false
+	}
+	if !hasCount {
+		return line, 1, true
+	}
+	count, err = strconv.Atoi(cs)
+	if err != nil || count < 0 {
+		return 0, 0, false
+	}
+	return line, count, true
+}
@@ -0,0 +1,94 @@
+package diff
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/txtar"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	files, _ := filepath.Glob("testdata/*.txt")
+	for _, file := range files {
+		a, err := txtar.ParseFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, context := range []int{0, 3} {
+			u := DiffWithOptions(a.Files[0].Name, clean(a.Files[0].Data), a.Files[1].Name, clean(a.Files[1].Data), Options{Context: context})
+			var want []Unified
+			if len(u.Hunks) > 0 {
+				want = []Unified{u}
+			}
+			have, err := Parse(strings.NewReader(u.String()))
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("%s: context %d: have %+v want %+v", file, context, have, want)
+			}
+		}
+	}
+}
+
+func TestParseGitPatch(t *testing.T) {
+	a := DiffWithOptions("a.txt", []byte("a\nb\nc\n"), "a.txt", []byte("a\nB\nc"), Options{Context: 3})
+	a.OldLabel, a.NewLabel = "v1", "v2"
+	b := Diff("new.txt", nil, "new.txt", []byte("x\n"))
+	b.OldDevNull, b.NewMode = true, "100755"
+	c := Unified{OldName: "run.sh", NewName: "run.sh", OldMode: "100644", NewMode: "100755"}
+	d := Diff("gone.txt", []byte("y\n"), "gone.txt", nil)
+	d.NewDevNull, d.OldMode = true, "100644"
+	want := []Unified{a, b, c, d}
+
+	patch := "From: someone\nSubject: change\n\n---\n"
+	for _, u := range want {
+		patch += u.GitPatch()
+	}
+	patch += "-- \n2.43.0\n"
+	have, err := Parse(strings.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v\nwant %+v", have, want)
+	}
+}
+
+func TestParseDiffU(t *testing.T) {
+	// output of diff -u, without diff lines and with modification times.
+	s := "--- a.txt\t2024-01-01 10:00:00\n+++ b.txt\t2024-01-02 10:00:00\n@@ -1,2 +1,2 @@\n-a\n+A\n b\n" +
+		"--- c.txt\t2024-01-01 10:00:00\n+++ c.txt\t2024-01-02 10:00:00\n@@ -1 +1 @@\n-c\n\\ No newline at end of file\n+C\n"
+	have, err := Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 2 {
+		t.Fatalf("have %d files, want 2", len(have))
+	}
+	if have[0].OldName != "a.txt" || have[0].NewName != "b.txt" || have[0].NewLabel != "2024-01-02 10:00:00" {
+		t.Errorf("unexpected header: %+v", have[0])
+	}
+	wantLines := []HunkLine{
+		{NumberX: 1, NumberY: -1, Value: "-c\n\\ No newline at end of file"},
+		{NumberX: -1, NumberY: 1, Value: "+C"},
+	}
+	if !reflect.DeepEqual(have[1].Hunks[0].Lines, wantLines) {
+		t.Errorf("have %+v want %+v", have[1].Hunks[0].Lines, wantLines)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct{ in, err string }{
+		{"--- a\n+++ b\n@@ -1,2 +1,2 @@\n-a\n+b\n", "line 5: unexpected end of hunk"},
+		{"--- a\n+++ b\n@@ -1 +1 @@\n-a\n-b\n", "line 5: unexpected line in hunk \"-b\""},
+		{"--- a\n+++ b\n@@ -x +1 @@\n", "line 3: invalid hunk header \"@@ -x +1 @@\""},
+	} {
+		_, err := Parse(strings.NewReader(tc.in))
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%q: have error %v want %q", tc.in, err, tc.err)
+		}
+	}
+}
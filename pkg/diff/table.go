@@ -0,0 +1,144 @@
+package diff
+
+import (
+	"strconv"
+	"strings"
+)
+
+// TypeChange is the type of a [TableRow] which is in both tables, but with
+// different cells.
+const TypeChange = "change"
+
+// TableRow is a row in the diff of two tables, as returned by [DiffTable].
+type TableRow struct {
+	// Type is one of TypeEqual, TypeChange, TypeInsert or TypeDelete.
+	Type string
+	// OldNumber and NewNumber are the 1-indexed numbers of the row in the
+	// old and new table, or -1 if the row is not in the table.
+	OldNumber int
+	NewNumber int
+	// Old and New are the cells of the row in the old and new table.
+	Old []string
+	New []string
+}
+
+// OldLine returns the row number in the old table, or an empty string if the
+// row was inserted.
+func (r TableRow) OldLine() string { return lineNumber(r.OldNumber) }
+
+// NewLine returns the row number in the new table, or an empty string if the
+// row was deleted.
+func (r TableRow) NewLine() string { return lineNumber(r.NewNumber) }
+
+// Symbol returns the symbol of the row: '+' for inserted rows, '-' for
+// deleted rows, '~' for changed rows and ' ' for equal rows.
+func (r TableRow) Symbol() byte {
+	switch r.Type {
+	case TypeInsert:
+		return '+'
+	case TypeDelete:
+		return '-'
+	case TypeChange:
+		return '~'
+	}
+	return ' '
+}
+
+// TableCell is a cell of a [TableRow].
+type TableCell struct {
+	Old     string
+	New     string
+	Changed bool
+}
+
+// Cells returns the cells of the row, marking the ones which differ between
+// the old and the new table. Only the cells of changed rows can differ.
+func (r TableRow) Cells() []TableCell {
+	cells := make([]TableCell, max(len(r.Old), len(r.New)))
+	for i := range cells {
+		c := &cells[i]
+		if i < len(r.Old) {
+			c.Old = r.Old[i]
+		}
+		if i < len(r.New) {
+			c.New = r.New[i]
+		}
+		c.Changed = r.Type == TypeChange &&
+			(i >= len(r.Old) || i >= len(r.New) || c.Old != c.New)
+	}
+	return cells
+}
+
+// DiffTable computes the diff of the rows of two tables, like those parsed from
+// CSV files. Unlike [Diff], all the rows are returned, including the equal
+// ones. Deleted rows directly followed by inserted rows are paired, and
+// returned as changed rows, so that the changed cells can be shown.
+func DiffTable(old, new [][]string, algo Algorithm) []TableRow {
+	u := DiffWithOptions("old", tableLines(old), "new", tableLines(new), Options{
+		// one hunk spanning both tables.
+		Context:   max(len(old), len(new)),
+		Algorithm: algo,
+	})
+	if len(u.Hunks) == 0 {
+		rows := make([]TableRow, len(old))
+		for i, r := range old {
+			rows[i] = TableRow{Type: TypeEqual, OldNumber: i + 1, NewNumber: i + 1, Old: r, New: r}
+		}
+		return rows
+	}
+
+	var rows []TableRow
+	lines := u.Hunks[0].Lines
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		if l.Type() == TypeEqual {
+			rows = append(rows, TableRow{
+				Type:      TypeEqual,
+				OldNumber: l.NumberX,
+				NewNumber: l.NumberY,
+				Old:       old[l.NumberX-1],
+				New:       new[l.NumberY-1],
+			})
+			continue
+		}
+
+		// deletions come before insertions; pair them.
+		ins, del := countNextInsertDelete(lines[i:])
+		dels, inss := lines[i:i+del], lines[i+del:i+del+ins]
+		for j := 0; j < max(ins, del); j++ {
+			row := TableRow{Type: TypeChange, OldNumber: -1, NewNumber: -1}
+			if j < del {
+				row.OldNumber = dels[j].NumberX
+				row.Old = old[row.OldNumber-1]
+			} else {
+				row.Type = TypeInsert
+			}
+			if j < ins {
+				row.NewNumber = inss[j].NumberY
+				row.New = new[row.NewNumber-1]
+			} else {
+				row.Type = TypeDelete
+			}
+			rows = append(rows, row)
+		}
+		i += ins + del - 1
+	}
+	return rows
+}
+
+// tableLines encodes each row of t in a line, so that they can be compared by
+// [DiffWithOptions].
+func tableLines(t [][]string) []byte {
+	var b strings.Builder
+	for _, row := range t {
+		for i, cell := range row {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			// quoting ensures that the line contains no newlines.
+			b.WriteString(strconv.Quote(cell))
+		}
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
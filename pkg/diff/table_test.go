@@ -0,0 +1,72 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffTable(t *testing.T) {
+	old := [][]string{
+		{"name", "qty"},
+		{"apple", "1"},
+		{"pear", "2"},
+		{"plum", "3"},
+	}
+	new := [][]string{
+		{"name", "qty"},
+		{"apple", "1"},
+		{"pear", "5"},
+		{"kiwi", "4", "new"},
+	}
+	rows := DiffTable(old, new, Anchored)
+	want := []TableRow{
+		{Type: TypeEqual, OldNumber: 1, NewNumber: 1, Old: old[0], New: new[0]},
+		{Type: TypeEqual, OldNumber: 2, NewNumber: 2, Old: old[1], New: new[1]},
+		{Type: TypeChange, OldNumber: 3, NewNumber: 3, Old: old[2], New: new[2]},
+		{Type: TypeChange, OldNumber: 4, NewNumber: 4, Old: old[3], New: new[3]},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("have: %+v\nwant: %+v", rows, want)
+	}
+
+	cells := rows[2].Cells()
+	wantCells := []TableCell{
+		{Old: "pear", New: "pear"},
+		{Old: "2", New: "5", Changed: true},
+	}
+	if !reflect.DeepEqual(cells, wantCells) {
+		t.Errorf("cells: have %+v want %+v", cells, wantCells)
+	}
+	if cells := rows[3].Cells(); len(cells) != 3 || !cells[2].Changed {
+		t.Errorf("added column should be changed: %+v", cells)
+	}
+}
+
+func TestDiffTableInsertDelete(t *testing.T) {
+	old := [][]string{{"a"}, {"b"}, {"c"}}
+	new := [][]string{{"a"}, {"c"}, {"d"}}
+	rows := DiffTable(old, new, Anchored)
+	var types []string
+	for _, r := range rows {
+		types = append(types, r.Type)
+	}
+	want := []string{TypeEqual, TypeDelete, TypeEqual, TypeInsert}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("have %v want %v", types, want)
+	}
+	if sym := string([]byte{rows[0].Symbol(), rows[1].Symbol(), rows[3].Symbol()}); sym != " -+" {
+		t.Errorf("symbols: have %q want %q", sym, " -+")
+	}
+	if rows[1].OldNumber != 2 || rows[1].NewNumber != -1 {
+		t.Errorf("deleted row: %+v", rows[1])
+	}
+	if rows[3].OldNumber != -1 || rows[3].NewNumber != 3 {
+		t.Errorf("inserted row: %+v", rows[3])
+	}
+
+	// identical tables
+	rows = DiffTable(old, old, Anchored)
+	if len(rows) != 3 || rows[2].Type != TypeEqual || rows[2].NewNumber != 3 {
+		t.Errorf("identical: %+v", rows)
+	}
+}
@@ -0,0 +1,148 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// reGitHubCompare matches the path of the compare pages of GitHub, like
+// /{owner}/{repo}/compare/{base}...{head}. Two dots are accepted as well.
+var reGitHubCompare = regexp.MustCompile(`^/([\w.-]+)/([\w.-]+)/compare/(.+?)\.\.\.?(.+)$`)
+
+// rawGitHubURL is where the files of GitHub repositories are fetched from.
+// It is the only host contacted for compare_url, so that uploads cannot make
+// the server send requests to arbitrary (ie. internal) hosts.
+const rawGitHubURL = "https://raw.githubusercontent.com"
+
+// compareSide is a version of a file in a GitHub repository.
+type compareSide struct {
+	owner, repo, ref string
+}
+
+func (c compareSide) rawURL(path string) string {
+	return rawGitHubURL + "/" + url.PathEscape(c.owner) + "/" + url.PathEscape(c.repo) +
+		"/" + escapeSegments(c.ref) + "/" + escapeSegments(path)
+}
+
+// parseCompareURL parses the URL of a GitHub compare page, returning the two
+// versions which are compared. The head may be in a fork, as in
+// base...user:branch.
+func parseCompareURL(s string) (base, head compareSide, err error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "https" || u.Host != "github.com" {
+		return base, head, usageError("compare_url must be a github.com compare url")
+	}
+	m := reGitHubCompare.FindStringSubmatch(u.Path)
+	if m == nil {
+		return base, head, usageError("compare_url must be like https://github.com/owner/repo/compare/base...head")
+	}
+	base = compareSide{m[1], m[2], m[3]}
+	head = compareSide{m[1], m[2], m[4]}
+	if owner, ref, ok := strings.Cut(head.ref, ":"); ok {
+		head.owner, head.ref = owner, ref
+	}
+	if !validSegments(base.ref) || !validSegments(head.ref) || head.owner == "" {
+		return base, head, usageError("invalid refs in compare_url")
+	}
+	return base, head, nil
+}
+
+// escapeSegments escapes each segment of the slash-separated path p.
+func escapeSegments(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+// validSegments reports whether the slash-separated path p has no empty, .
+// or .. segments, which could change the resource being fetched.
+func validSegments(p string) bool {
+	for _, s := range strings.Split(p, "/") {
+		if s == "" || s == "." || s == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// readCompare fetches the two versions of the file at the path form value
+// in the compare_url of mf, and sets them as the red and green values of mf,
+// with the refs of the compare page. It is a no-op if there is no
+// compare_url.
+func (s *Server) readCompare(ctx context.Context, mf *multipart.Form) error {
+	compareURL := mf.Value["compare_url"]
+	if len(compareURL) == 0 {
+		return nil
+	}
+	if !s.CompareURLs {
+		return usageError("compare_url is not enabled on this server")
+	}
+	path := mf.Value["path"]
+	if len(compareURL) != 1 || len(path) != 1 || !validSegments(path[0]) || len(mf.File) > 0 {
+		return usageError("compare_url requires the path of a file, and no uploaded files")
+	}
+	base, head, err := parseCompareURL(compareURL[0])
+	if err != nil {
+		return err
+	}
+
+	red, err := s.fetchRaw(ctx, base.rawURL(path[0]))
+	if err != nil {
+		return err
+	}
+	green, err := s.fetchRaw(ctx, head.rawURL(path[0]))
+	if err != nil {
+		return err
+	}
+	name := path[0][strings.LastIndexByte(path[0], '/')+1:]
+	mf.Value["red"], mf.Value["green"] = []string{red}, []string{green}
+	mf.Value["red_name"], mf.Value["green_name"] = []string{name}, []string{name}
+	mf.Value["red_ref"], mf.Value["green_ref"] = []string{base.ref}, []string{head.ref}
+	return nil
+}
+
+// fetchRaw retrieves the file at rawURL, which is at most maxBodySize bytes.
+func (s *Server) fetchRaw(ctx context.Context, rawURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	cl := s.HTTPClient
+	if cl == nil {
+		cl = defaultHTTPClient
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", usageError(fmt.Sprintf("fetching %s: %s", rawURL, resp.Status))
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxBodySize {
+		return "", usageError(fmt.Sprintf("fetching %s: the file is larger than %d bytes", rawURL, maxBodySize))
+	}
+	return string(b), nil
+}
+
+// defaultHTTPClient is used to fetch files if Server.HTTPClient is not set.
+// Redirects are not followed, as they could lead to other hosts.
+var defaultHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thehowl/diffy/pkg/db"
+)
+
+// roundTripFunc serves the requests of an http.Client without the network.
+type roundTripFunc func(*http.Request) *http.Response
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r), nil }
+
+func TestCompareURL(t *testing.T) {
+	files := map[string]string{
+		"https://raw.githubusercontent.com/o/r/v1.0/pkg/a.go":         "a\nb\n",
+		"https://raw.githubusercontent.com/o/r/feature/x/pkg/a.go":    "a\nc\n",
+		"https://raw.githubusercontent.com/fork/r/feature/x/pkg/a.go": "a\nd\n",
+		"https://raw.githubusercontent.com/o/r/v1.0/big.txt":          strings.Repeat("a", maxBodySize+1),
+		"https://raw.githubusercontent.com/o/r/v2.0/big.txt":          "a",
+	}
+	var fetched []string
+	serv := newServer(t)
+	serv.CompareURLs = true
+	serv.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		fetched = append(fetched, r.URL.String())
+		content, ok := files[r.URL.String()]
+		if !ok {
+			return &http.Response{StatusCode: 404, Status: "404 Not Found", Body: http.NoBody}
+		}
+		return &http.Response{StatusCode: 200, Status: "200 OK", Body: io.NopCloser(strings.NewReader(content))}
+	})}
+	r := serv.Router()
+
+	post := func(compareURL, path string) *httptest.ResponseRecorder {
+		form := url.Values{"compare_url": {compareURL}, "path": {path}}
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/diff", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	wri := post("https://github.com/o/r/compare/v1.0...feature/x?expand=1", "pkg/a.go")
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+	assert.Equal(t, "diff a.go a.go\n--- a.go\tv1.0\n+++ a.go\tfeature/x\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n", wri.Body.String())
+
+	// the head may be in a fork.
+	wri = post("https://github.com/o/r/compare/v1.0..fork:feature/x", "pkg/a.go")
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+	assert.Contains(t, wri.Body.String(), "-b\n+d\n")
+
+	fetched = nil
+	for _, tc := range []struct{ compareURL, path, err string }{
+		{"https://example.com/o/r/compare/a...b", "a.go", "must be a github.com compare url"},
+		{"http://github.com/o/r/compare/a...b", "a.go", "must be a github.com compare url"},
+		{"https://github.com/o/r/pull/1", "a.go", "must be like"},
+		{"https://github.com/o/r/compare/../x...b", "a.go", "invalid refs"},
+		{"https://github.com/o/r/compare/a...b", "../../x", "requires the path"},
+		{"https://github.com/o/r/compare/a...b", "", "requires the path"},
+	} {
+		wri := post(tc.compareURL, tc.path)
+		assert.Equal(t, http.StatusBadRequest, wri.Code, tc.compareURL)
+		assert.Contains(t, wri.Body.String(), tc.err, tc.compareURL)
+	}
+	assert.Empty(t, fetched, "invalid urls must not be fetched")
+
+	wri = post("https://github.com/o/r/compare/v1.0...v2.0", "missing.go")
+	assert.Equal(t, http.StatusBadRequest, wri.Code)
+	assert.Contains(t, wri.Body.String(), "404 Not Found")
+	wri = post("https://github.com/o/r/compare/v1.0...v2.0", "big.txt")
+	assert.Equal(t, http.StatusBadRequest, wri.Code)
+	assert.Contains(t, wri.Body.String(), "larger than")
+
+	// uploads are checked before the files are fetched: cross-site posts
+	// without a token, and clients over the limits, are rejected first.
+	fetched = nil
+	upload := func(origin string) *httptest.ResponseRecorder {
+		form := url.Values{"compare_url": {"https://github.com/o/r/compare/v1.0...feature/x"}, "path": {"pkg/a.go"}}
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+	wri = upload("https://evil.example")
+	assert.Equal(t, http.StatusForbidden, wri.Code, wri.Body.String())
+	now := time.Now().UTC()
+	require.NoError(t, serv.DB.AddAmountsAndCompare(
+		"192.0.2.1",
+		db.UsageStat{Period: fmt.Sprintf("%d/%d", now.Year(), (now.YearDay()-1)/7), NumCalls: maxCallsWeek},
+		db.UploadLimits{MaxBytes: maxBytesWeek, MaxCalls: maxCallsWeek},
+	))
+	wri = upload("")
+	assert.Equal(t, http.StatusTooManyRequests, wri.Code, wri.Body.String())
+	assert.Empty(t, fetched)
+
+	// disabled by default.
+	serv.CompareURLs = false
+	wri = post("https://github.com/o/r/compare/v1.0...feature/x", "pkg/a.go")
+	assert.Equal(t, http.StatusBadRequest, wri.Code)
+	assert.Contains(t, wri.Body.String(), "not enabled")
+}
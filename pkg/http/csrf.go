@@ -0,0 +1,59 @@
+package http
+
+import (
+	"crypto/hmac"
+	cr "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// The form of the homepage is protected from cross-site request forgery by a
+// random nonce, stored in a cookie, and a token derived from it with
+// s.CSRFKey, sent in the form. Other sites cannot read either, nor compute the
+// token of a cookie they set.
+const (
+	csrfCookie = "diffy_csrf"
+	csrfField  = "csrf_token"
+)
+
+// csrfToken returns the token for the form of the homepage, setting the cookie
+// it is derived from if r does not have one yet.
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+		return s.csrfMAC(c.Value)
+	}
+	var b [16]byte
+	cr.Read(b[:])
+	nonce := hex.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    nonce,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.PublicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return s.csrfMAC(nonce)
+}
+
+func (s *Server) csrfMAC(nonce string) string {
+	mac := hmac.New(sha256.New, s.CSRFKey)
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF reports whether r, whose form must already be parsed, may upload a
+// diff. Requests from browsers, which send Origin or Sec-Fetch-Site headers,
+// must have a valid token; other clients, like curl, don't need one.
+func (s *Server) checkCSRF(r *http.Request) bool {
+	if r.Header.Get("Origin") == "" && r.Header.Get("Sec-Fetch-Site") == "" {
+		return true
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(r.FormValue(csrfField)), []byte(s.csrfMAC(c.Value)))
+}
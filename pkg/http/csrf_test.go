@@ -0,0 +1,76 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var reCSRFField = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+
+func TestCSRF(t *testing.T) {
+	r := newServer(t).Router()
+
+	// the homepage sets the cookie, and puts the token in the form.
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code)
+	cookies := wri.Result().Cookies()
+	require.Len(t, cookies, 1)
+	cookie := cookies[0]
+	assert.Equal(t, csrfCookie, cookie.Name)
+	m := reCSRFField.FindStringSubmatch(wri.Body.String())
+	require.NotNil(t, m, wri.Body.String())
+	token := m[1]
+
+	// the same cookie gets the same token.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	req.AddCookie(cookie)
+	r.ServeHTTP(wri, req)
+	assert.Empty(t, wri.Result().Cookies())
+	assert.Contains(t, wri.Body.String(), token)
+
+	post := func(token string, cookie *http.Cookie, browser bool) *httptest.ResponseRecorder {
+		fields := []string{"red", "a\n", "green", "b\n"}
+		if token != "" {
+			fields = append(fields, csrfField, token)
+		}
+		rd, header := multipartFiles(fields...)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		if browser {
+			req.Header.Set("Origin", "https://diffy")
+			req.Header.Set("Sec-Fetch-Site", "same-origin")
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	wri = post(token, cookie, true)
+	assert.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+
+	// missing or invalid tokens are rejected.
+	other := &http.Cookie{Name: csrfCookie, Value: "0123456789abcdef0123456789abcdef"}
+	for name, wri := range map[string]*httptest.ResponseRecorder{
+		"NoToken":       post("", cookie, true),
+		"NoCookie":      post(token, nil, true),
+		"InvalidToken":  post("abcdef", cookie, true),
+		"AnotherCookie": post(token, other, true),
+	} {
+		assert.Equal(t, http.StatusForbidden, wri.Code, name)
+		assert.Contains(t, wri.Body.String(), "invalid form token", name)
+	}
+
+	// clients which are not browsers, like curl, don't need it.
+	wri = post("", nil, false)
+	assert.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+}
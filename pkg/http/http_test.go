@@ -1,29 +1,45 @@
 package http
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
 	cr "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"math/rand/v2"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/klauspost/compress/gzip"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thehowl/diffy/pkg/db"
 	"github.com/thehowl/diffy/pkg/storage"
+	"github.com/thehowl/diffy/static"
 	"go.etcd.io/bbolt"
 )
 
+const firefoxUA = "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:136.0) Gecko/20100101 Firefox/136.0"
+
 func newServer(t *testing.T) *Server {
 	t.Helper()
 	bdb, err := bbolt.Open(filepath.Join(t.TempDir(), "db.bolt"), 0o644, nil)
@@ -67,7 +83,7 @@ func TestIndex(t *testing.T) {
 	{
 		// with a browser header.
 		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
-		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:136.0) Gecko/20100101 Firefox/136.0")
+		req.Header.Set("User-Agent", firefoxUA)
 		r.ServeHTTP(wri, req)
 		assert.Equal(t, 200, wri.Code)
 		assert.Contains(t, wri.Body.String(), "<b>diffy</b> is a simple")
@@ -75,6 +91,299 @@ func TestIndex(t *testing.T) {
 	}
 }
 
+func TestIndexDisabled(t *testing.T) {
+	serv := newServer(t)
+	serv.DisableHomepage = true
+	r := serv.Router()
+
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, 200, wri.Code)
+	assert.Contains(t, wri.Body.String(), "usage: curl -F")
+	assert.NotContains(t, wri.Body.String(), `rel="stylesheet"`)
+
+	serv = newServer(t)
+	serv.HomepageRedirect = "https://intranet.example.com/diffy"
+	r = serv.Router()
+
+	// browsers are redirected; other clients still get the usage.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusFound, wri.Code)
+	assert.Equal(t, "https://intranet.example.com/diffy", wri.Header().Get("Location"))
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, 200, wri.Code)
+	assert.Contains(t, wri.Body.String(), "usage: curl -F")
+}
+
+func TestIndexHead(t *testing.T) {
+	// use a real server, as the recorder does not discard the body of HEAD
+	// responses.
+	srv := httptest.NewServer(newServer(t).Router())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		ua, ct string
+	}{
+		{firefoxUA, "text/html; charset=utf-8"},
+		{"curl/8.0", ctPlain},
+		{"UptimeRobot/2.0", ctPlain},
+	} {
+		req, err := http.NewRequest("HEAD", srv.URL+"/", nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", tc.ua)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode, tc.ua)
+		assert.Equal(t, tc.ct, resp.Header.Get(ctHeader), tc.ua)
+		assert.Empty(t, body, tc.ua)
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	// use a real server, so that the bodies are sent with chunked encoding,
+	// as from a pipe (ie. git diff | curl -T -).
+	rt := newServer(t).Router()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"chunked"}, r.TransferEncoding)
+		rt.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cl := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	post := func(body io.Reader, ct string) (*http.Response, string) {
+		// hide the length of body, and send it in small pieces.
+		req, err := http.NewRequest("POST", srv.URL+"/", io.MultiReader(iotest.HalfReader(body)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", ct)
+		resp, err := cl.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(b)
+	}
+
+	small, smallType := multipartFiles("red@a.txt", "a\n", "green@a.txt", "b\n")
+	big := strings.Repeat("line\n", maxBodySize/5)
+	large, largeType := multipartFiles("red@a.txt", "a\n"+big, "green@a.txt", "b\n"+big)
+	for _, tc := range []struct {
+		name, body, ct string
+		code           int
+	}{
+		{"multipart", small.String(), smallType, http.StatusFound},
+		{"urlencoded", url.Values{"red": {"c\n"}, "green": {"d\n"}}.Encode(), "application/x-www-form-urlencoded", http.StatusFound},
+		{"multipart_too_large", large.String(), largeType, http.StatusRequestEntityTooLarge},
+		{"urlencoded_too_large", url.Values{"red": {big}, "green": {big}}.Encode(), "application/x-www-form-urlencoded", http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := post(strings.NewReader(tc.body), tc.ct)
+			assert.Equal(t, tc.code, resp.StatusCode, body)
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	serv := newServer(t)
+	serv.MaxTTL = 2 * time.Hour
+	r := serv.Router()
+
+	upload := func(red, ttl string) (*httptest.ResponseRecorder, jsonUpload) {
+		form := url.Values{"red": {red}, "green": {"green\n"}, "ttl": {ttl}}
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		r.ServeHTTP(wri, req)
+		var res jsonUpload
+		if wri.Code == http.StatusCreated || wri.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(wri.Body.Bytes(), &res))
+		}
+		return wri, res
+	}
+	get := func(id string) int {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/"+id+".diff", nil)
+		r.ServeHTTP(wri, req)
+		return wri.Code
+	}
+
+	wri, res := upload("a\n", "1h")
+	require.Equal(t, http.StatusCreated, wri.Code, wri.Body.String())
+	require.NotNil(t, res.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *res.ExpiresAt, time.Minute)
+	assert.Equal(t, http.StatusOK, get(res.ID))
+
+	// ttls are capped to MaxTTL.
+	wri, res = upload("b\n", "72h")
+	require.Equal(t, http.StatusCreated, wri.Code, wri.Body.String())
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), *res.ExpiresAt, time.Minute)
+
+	// re-uploading without a ttl makes the diff permanent.
+	wri, res = upload("b\n", "")
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+	assert.Nil(t, res.ExpiresAt)
+	// ...and a shorter ttl does not make it expire.
+	wri, res = upload("b\n", "1m")
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+	assert.Nil(t, res.ExpiresAt)
+
+	for _, ttl := range []string{"soon", "-1h", "0s"} {
+		wri, _ = upload("c\n", ttl)
+		assert.Equal(t, http.StatusBadRequest, wri.Code, ttl)
+		assert.Contains(t, wri.Body.String(), "ttl must be a positive duration", ttl)
+	}
+
+	// expired diffs are gone, until the janitor deletes them.
+	_, res = upload("d\n", "1h")
+	f, err := serv.DB.GetFile(res.ID)
+	require.NoError(t, err)
+	f.ExpiresAt = time.Now().Add(-time.Second)
+	require.NoError(t, serv.DB.PutFile(res.ID, f))
+	assert.Equal(t, http.StatusGone, get(res.ID))
+
+	// uploading it again stores it anew.
+	wri, res2 := upload("d\n", "1h")
+	require.Equal(t, http.StatusCreated, wri.Code, wri.Body.String())
+	assert.Equal(t, res.ID, res2.ID)
+	assert.True(t, res2.ExpiresAt.After(time.Now()))
+	assert.Equal(t, http.StatusOK, get(res.ID))
+}
+
+func TestConditionalUpload(t *testing.T) {
+	serv := newServer(t)
+	serv.PublicURL = "https://diffy.example.com"
+	r := serv.Router()
+
+	form := url.Values{"red": {"red\n"}, "green": {"green\n"}}.Encode()
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	link := wri.Header().Get("Location")
+	id := strings.TrimPrefix(link, serv.PublicURL+"/")
+
+	// preflight hit, regardless of the case of the id.
+	for _, accept := range []string{"", "application/json"} {
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/?check="+strings.ToUpper(id), nil)
+		req.Header.Set("Accept", accept)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusOK, wri.Code)
+		assert.Equal(t, `"`+id+`"`, wri.Header().Get("ETag"))
+		if accept == "" {
+			assert.Equal(t, link+"\n", wri.Body.String())
+		} else {
+			var res jsonUpload
+			require.NoError(t, json.Unmarshal(wri.Body.Bytes(), &res))
+			assert.Equal(t, link, res.URL)
+		}
+	}
+
+	// preflight miss.
+	for _, check := range []string{"abcdefgh", "nope"} {
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/?check="+check, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusNotFound, wri.Code, check)
+	}
+
+	// the body is not read if the diff exists.
+	body := &countingReader{r: strings.NewReader(form)}
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("If-None-Match", `"abcdefgh", "`+id+`"`)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusNotModified, wri.Code)
+	assert.Equal(t, link, wri.Header().Get("Location"))
+	assert.Zero(t, body.n)
+
+	// otherwise, the upload goes on.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("If-None-Match", `"abcdefgh"`)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusFound, wri.Code)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestExtraCSS(t *testing.T) {
+	serv := newServer(t)
+	serv.ExtraCSSURL = "/custom.css"
+	r := serv.Router()
+
+	const link = `<link rel="stylesheet" href="/custom.css" />`
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"/", true},
+		{"/example", true},
+		{"/example?standalone", false},
+		{"/abcdefgh", true},
+	} {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("User-Agent", firefoxUA)
+		r.ServeHTTP(wri, req)
+		body := wri.Body.String()
+		if tc.want {
+			assert.Contains(t, body, link, tc.path)
+			// after the default stylesheet, so that it overrides it.
+			assert.Greater(t, strings.Index(body, link), strings.Index(body, "/static/style.css"), tc.path)
+		} else {
+			assert.NotContains(t, body, link, tc.path)
+		}
+	}
+}
+
+func TestCheckExtraCSS(t *testing.T) {
+	for _, tc := range []struct {
+		url string
+		ok  bool
+	}{
+		{"", true},
+		{"/custom.css", true},
+		{"https://diffy/custom.css", true},
+		{"https://DIFFY/custom.css", true},
+		{"https://cdn.example.com/theme.css", true},
+		{"http://cdn.example.com/theme.css", false},
+		{"https://evil.example.com/theme.css", false},
+		{"//evil.example.com/theme.css", false},
+		{"///evil.example.com/theme.css", false},
+		{"/\\evil.example.com/theme.css", false},
+		{"\\\\evil.example.com/theme.css", false},
+		{"https://diffy\\@evil.example.com/theme.css", false},
+		{"custom.css", false},
+		{"javascript:alert(1)", false},
+	} {
+		serv := newServer(t)
+		serv.ExtraCSSURL = tc.url
+		serv.ExtraCSSHosts = []string{"cdn.example.com"}
+		err := serv.CheckExtraCSS()
+		if tc.ok {
+			assert.NoError(t, err, tc.url)
+		} else {
+			assert.Error(t, err, tc.url)
+		}
+	}
+}
+
 func TestUpload(t *testing.T) {
 	r := newServer(t).Router()
 
@@ -125,6 +434,33 @@ func TestUpload(t *testing.T) {
 		assert.NotEmpty(t, loc2)
 		assert.Equal(t, loc1, loc2)
 	})
+	t.Run("DedupeContentOnly", func(t *testing.T) {
+		// Check that, with DedupeContentOnly, the names of the files do not
+		// change the id.
+		t.Parallel()
+
+		upload := func(r http.Handler, red, green string) string {
+			rd, header := multipartFiles(
+				"red@"+red, "a\nb\n",
+				"green@"+green, "a\nc\n",
+			)
+			wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+			req.Header.Set("Content-Type", header)
+			r.ServeHTTP(wri, req)
+			require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+			return wri.Header().Get("Location")
+		}
+
+		r := newServer(t).Router()
+		assert.NotEqual(t, upload(r, "a.txt", "b.txt"), upload(r, "c.txt", "d.txt"))
+
+		serv := newServer(t)
+		serv.DedupeContentOnly = true
+		r = serv.Router()
+		loc := upload(r, "a.txt", "b.txt")
+		assert.Equal(t, loc, upload(r, "a.txt", "b.txt"))
+		assert.Equal(t, loc, upload(r, "c.txt", "d.txt"))
+	})
 	t.Run("FormFields", func(t *testing.T) {
 		// Check that we can perform the upload using only multipart fields
 		// rather than files; this is useful for the homepage form.
@@ -141,6 +477,51 @@ func TestUpload(t *testing.T) {
 		r.ServeHTTP(wri, req)
 		assert.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
 	})
+	t.Run("JSON", func(t *testing.T) {
+		t.Parallel()
+
+		form := url.Values{"red": {"json\n"}, "green": {"jason\n"}}
+		upload := func() *httptest.ResponseRecorder {
+			wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Accept", "application/json")
+			r.ServeHTTP(wri, req)
+			return wri
+		}
+		wri := upload()
+		require.Equal(t, http.StatusCreated, wri.Code, wri.Body.String())
+		assert.Equal(t, ctJSON, wri.Header().Get(ctHeader))
+
+		var res struct {
+			ID        string    `json:"id"`
+			URL       string    `json:"url"`
+			CreatedAt time.Time `json:"created_at"`
+		}
+		require.NoError(t, json.Unmarshal(wri.Body.Bytes(), &res))
+		assert.True(t, validID(res.ID), res.ID)
+		assert.Equal(t, "https://diffy/"+res.ID, res.URL)
+		assert.Equal(t, res.URL, wri.Header().Get("Location"))
+		assert.WithinDuration(t, time.Now(), res.CreatedAt, time.Minute)
+
+		// re-uploads return the original creation time, with 200 OK.
+		wri = upload()
+		require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+		assert.JSONEq(t, wri.Body.String(), `{"id":"`+res.ID+`","url":"`+res.URL+`","created_at":"`+res.CreatedAt.Format(time.RFC3339Nano)+`"}`)
+	})
+	t.Run("TooManyFiles", func(t *testing.T) {
+		t.Parallel()
+
+		rd, header := multipartFiles(
+			"red@hello.go", "a\n",
+			"green@hello.go", "b\n",
+			"blue@hello.go", "c\n",
+		)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusBadRequest, wri.Code)
+		assert.Contains(t, wri.Body.String(), "at most 2 files, got 3")
+	})
 	t.Run("NoContentType", func(t *testing.T) {
 		// Check for failure when the multipart form is somehow malformed (ie.
 		// missing header.)
@@ -152,8 +533,36 @@ func TestUpload(t *testing.T) {
 		)
 		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
 		r.ServeHTTP(wri, req)
+		// the body is not parsed, and the query has no files.
 		assert.Equal(t, http.StatusBadRequest, wri.Code)
-		assert.Contains(t, wri.Body.String(), "multipart/form-data")
+		assert.Contains(t, wri.Body.String(), "usage:")
+	})
+	t.Run("URLEncoded", func(t *testing.T) {
+		t.Parallel()
+
+		form := url.Values{"red": {"a\nb\n"}, "green": {"a\nc\n"}, "green_name": {"x.txt"}}
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ServeHTTP(wri, req)
+		require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", wri.Header().Get("Location")+".diff", nil)
+		r.ServeHTTP(wri, req)
+		assert.Contains(t, wri.Body.String(), "+++ x.txt\n")
+		assert.Contains(t, wri.Body.String(), "-b\n+c\n")
+
+		// in the query string, without a body.
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/?red=1%0A&green=2%0A", nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+
+		// the body size is limited.
+		form = url.Values{"red": {strings.Repeat("a\n", maxBodySize)}, "green": {"b\n"}}
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, wri.Code)
+		assert.Equal(t, fmt.Sprintf("error: uploads may be at most %d bytes\n", maxBodySize), wri.Body.String())
 	})
 	t.Run("BadFiles", func(t *testing.T) {
 		// Check for failure when the multipart form is somehow malformed (ie.
@@ -171,6 +580,79 @@ func TestUpload(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, wri.Code)
 		assert.Contains(t, wri.Body.String(), "usage: curl -F")
 	})
+	t.Run("DuplicateFiles", func(t *testing.T) {
+		t.Parallel()
+
+		rd, header := multipartFiles(
+			"red@hello.go", "a\n",
+			"red@hello.go", "b\n",
+			"green@hello.go", "c\n",
+		)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusBadRequest, wri.Code)
+		assert.Equal(t, "error: expected exactly one 'red' and one 'green' file, got 2 red, 1 green\n"+
+			"usage: curl -F red=@before.txt -F green=@after.txt https://diffy\n", wri.Body.String())
+	})
+	t.Run("MissingFile", func(t *testing.T) {
+		t.Parallel()
+
+		// only the usage is shown.
+		rd, header := multipartFiles(
+			"green@hello.go", "c\n",
+		)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusBadRequest, wri.Code)
+		assert.Equal(t, "usage: curl -F red=@before.txt -F green=@after.txt https://diffy\n", wri.Body.String())
+	})
+	t.Run("TooManyLines", func(t *testing.T) {
+		// Check that a small file with many lines is rejected.
+		t.Parallel()
+
+		serv := newServer(t)
+		serv.MaxLines = 1000
+		r := serv.Router()
+		rd, header := multipartFiles(
+			"red@hello.txt", "a\nb\n",
+			"green@hello.txt", strings.Repeat("\n", 1001),
+		)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, wri.Code, wri.Body.String())
+		assert.Contains(t, wri.Body.String(), "at most 1000 lines")
+
+		// exactly at the limit is ok.
+		rd, header = multipartFiles(
+			"red@hello.txt", "a\nb\n",
+			"green@hello.txt", strings.Repeat("\n", 1000),
+		)
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+
+		// a final line without a newline counts, even at the limit.
+		rd, header = multipartFiles(
+			"red@hello.txt", "a\nb\n",
+			"green@hello.txt", strings.Repeat("x\n", 999)+"x",
+		)
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+		rd, header = multipartFiles(
+			"red@hello.txt", "a\nb\n",
+			"green@hello.txt", strings.Repeat("x\n", 1000)+"x",
+		)
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, wri.Code, wri.Body.String())
+	})
 	t.Run("SpamFiles", func(t *testing.T) {
 		// Test rate limiter, uploading >100 junk files.
 		t.Parallel()
@@ -221,39 +703,1810 @@ func TestUpload(t *testing.T) {
 	})
 }
 
-func randBytes(r *rand.Rand, buf []byte) {
-	for i := 0; i < len(buf); i += 8 {
-		var dstLe [8]byte
-		binary.BigEndian.PutUint64(dstLe[:], r.Uint64())
-		var dst [16]byte
-		hex.Encode(dst[:], dstLe[:])
-		copy(buf[i:], dst[:])
+func TestDiffFormat(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	isHTML := func(t *testing.T, body string) {
+		t.Helper()
+		assert.Contains(t, body, "<!doctype html>")
+	}
+	isRaw := func(t *testing.T, body string) {
+		t.Helper()
+		assert.True(t, strings.HasPrefix(body, "diff main.go server.go\n"), body)
+	}
+	isJSON := func(t *testing.T, body string) {
+		t.Helper()
+		assert.True(t, strings.HasPrefix(body, `{"old_name":"main.go","new_name":"server.go","hunks":[`), body)
+	}
+	tt := []struct {
+		name          string
+		path          string
+		headers       map[string]string
+		defaultFormat string
+		check         func(t *testing.T, body string)
+	}{
+		{"default", "/example", nil, "", isRaw},
+		{"default_html", "/example", nil, "html", isHTML},
+		{"ua_browser", "/example", map[string]string{"User-Agent": firefoxUA}, "", isHTML},
+		{"ua_curl", "/example", map[string]string{"User-Agent": "curl/8.5.0"}, "html", isRaw},
+		{"accept_json", "/example", map[string]string{"Accept": "application/json", "User-Agent": firefoxUA}, "", isJSON},
+		{"accept_html", "/example", map[string]string{"Accept": "text/html,*/*;q=0.8", "User-Agent": "curl/8.5.0"}, "", isHTML},
+		{"accept_any", "/example", map[string]string{"Accept": "*/*", "User-Agent": firefoxUA}, "", isHTML},
+		{"ext_diff", "/example.diff", map[string]string{"User-Agent": firefoxUA}, "", isRaw},
+		{"ext_json", "/example.json", nil, "", isJSON},
+		{"ext_html", "/example.html", map[string]string{"User-Agent": "curl/8.5.0"}, "", isHTML},
+		{"ext_html_query", "/example.html?split=1&w=b&c=5", map[string]string{"User-Agent": "curl/8.5.0"}, "", isHTML},
+		{"query", "/example?format=json", map[string]string{"Accept": "text/html"}, "", isJSON},
+		{"query_ext", "/example.diff?format=html", nil, "", isHTML},
+		{"query_invalid", "/example?format=xml", nil, "", isRaw},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			serv.DefaultFormat = tc.defaultFormat
+			wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			r.ServeHTTP(wri, req)
+			assert.Equal(t, http.StatusOK, wri.Code)
+			tc.check(t, wri.Body.String())
+		})
 	}
 }
 
-func multipartFiles(filesContents ...string) (*bytes.Buffer, string) {
-	if len(filesContents)%2 != 0 {
-		panic("multipartFiles expect even number of arguments")
+func TestStandalone(t *testing.T) {
+	r := newServer(t).Router()
+
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/example.html?standalone=1&split=1", nil)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code)
+	body := wri.Body.String()
+	assert.NotContains(t, body, "static/")
+	css, err := static.FS.ReadFile("style.css")
+	require.NoError(t, err)
+	assert.Contains(t, body, "<style>"+string(css)+"</style>")
+	assert.Contains(t, body, "diff-split-columns")
+	// the relative links to the files would not work once saved.
+	assert.NotContains(t, body, `href="/example/red"`)
+	assert.NotContains(t, body, `href="/example/green"`)
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/example.html", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), `href="/static/style.css"`)
+	assert.Contains(t, wri.Body.String(), `href="/example/red"`)
+}
+
+func TestDiffTitle(t *testing.T) {
+	r := newServer(t).Router()
+
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/example", nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+	assert.Contains(t, wri.Body.String(), "<title>main.go → server.go · diffy</title>")
+	assert.Contains(t, wri.Body.String(), `<h2 class="diff-title">main.go → server.go</h2>`)
+}
+
+func TestContentLength(t *testing.T) {
+	r := newServer(t).Router()
+
+	for _, path := range []string{"/example.diff", "/example/red", "/example/green"} {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusOK, wri.Code, path)
+		assert.Equal(t, strconv.Itoa(wri.Body.Len()), wri.Header().Get("Content-Length"), path)
 	}
-	buf := new(bytes.Buffer)
-	w := multipart.NewWriter(buf)
-	for i := 0; i < len(filesContents); i += 2 {
-		fieldName, cont := filesContents[i], filesContents[i+1]
-		pos := strings.IndexByte(fieldName, '@')
-		if pos >= 0 {
-			fieldName, fileName := fieldName[:pos], fieldName[pos+1:]
-			w, err := w.CreateFormFile(fieldName, fileName)
-			if err != nil {
-				panic(err)
+}
+
+func TestFileRange(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		"red@hello.txt", "0123456789\n",
+		"green@hello.txt", "abcdefghij\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/green", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusPartialContent, wri.Code)
+	assert.Equal(t, "cdef", wri.Body.String())
+	assert.Equal(t, "4", wri.Header().Get("Content-Length"))
+	assert.NotEmpty(t, wri.Header().Get("Last-Modified"))
+}
+
+func TestRateLimit(t *testing.T) {
+	upload := func(r http.Handler, i int) int {
+		rd, header := multipartFiles(
+			"red@a.txt", "a\n",
+			"green@a.txt", strconv.Itoa(i)+"\n",
+		)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		return wri.Code
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		t.Parallel()
+		r := newServer(t).Router()
+		for i := 0; i < maxCallsWeek; i++ {
+			require.Equal(t, http.StatusFound, upload(r, i))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, upload(r, maxCallsWeek))
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+		serv := newServer(t)
+		serv.DisableRateLimit = true
+		r := serv.Router()
+		for i := 0; i <= maxCallsWeek; i++ {
+			require.Equal(t, http.StatusFound, upload(r, i))
+		}
+
+		// no usage statistics should have been written.
+		err := serv.DB.DB.View(func(tx *bbolt.Tx) error {
+			if bk := tx.Bucket([]byte("stats")); bk != nil {
+				assert.Zero(t, bk.Stats().KeyN)
 			}
-			if _, err := w.Write([]byte(cont)); err != nil {
-				panic(err)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
+
+func TestArchiveCodec(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	for _, tc := range []struct {
+		codec string
+		magic []byte
+	}{
+		{"", magicGzip},
+		{codecGzip, magicGzip},
+		{codecZstd, magicZstd},
+	} {
+		t.Run(tc.codec, func(t *testing.T) {
+			serv.ArchiveCodec = tc.codec
+			rd, header := multipartFiles(
+				"red@hello.txt", "hello\n"+tc.codec+"\n",
+				"green@hello.txt", "world\n"+tc.codec+"\n",
+			)
+			wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+			req.Header.Set("Content-Type", header)
+			r.ServeHTTP(wri, req)
+			require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+			loc := wri.Header().Get("Location")
+
+			// check the stored format.
+			data, err := serv.Storage.Get(context.Background(), path.Base(loc))
+			require.NoError(t, err)
+			assert.True(t, bytes.HasPrefix(data, tc.magic))
+
+			wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc, nil)
+			r.ServeHTTP(wri, req)
+			assert.Equal(t, http.StatusOK, wri.Code)
+			assert.Contains(t, wri.Body.String(), "-hello\n+world\n")
+		})
+	}
+
+	// unknown codecs are not silently replaced by gzip.
+	_, _, err := archiveCompressor(io.Discard, "brotli")
+	assert.ErrorContains(t, err, `unknown archive codec "brotli"`)
+}
+
+func TestArchiveDeterministic(t *testing.T) {
+	// Archiving the same inputs must always yield the same bytes, so that
+	// identical uploads get the same id.
+	mf := &multipart.Form{Value: map[string][]string{
+		"red":       {"a\nb\n"},
+		"green":     {"a\nc\n"},
+		"red_name":  {"a.txt"},
+		"green_ref": {"main"},
+	}}
+	for _, codec := range []string{codecGzip, codecZstd} {
+		t.Run(codec, func(t *testing.T) {
+			arc1, err := archiveFromFormValues(mf, 0, codec)
+			require.NoError(t, err)
+			arc2, err := archiveFromFormValues(mf, 0, codec)
+			require.NoError(t, err)
+			assert.Equal(t, arc1, arc2)
+			assert.Equal(t, sha256.Sum256(arc1), sha256.Sum256(arc2))
+		})
+	}
+
+	// check the headers.
+	arc, err := archiveFromFormValues(mf, 0, codecGzip)
+	require.NoError(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(arc))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), gz.Header.ModTime.Unix())
+	assert.Equal(t, byte(gzipUnknownOS), gz.Header.OS)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), hdr.ModTime.Unix(), hdr.Name)
+	}
+}
+
+func TestArchiveOrder(t *testing.T) {
+	type entry struct{ name, side string }
+	archive := func(entries ...entry) []byte {
+		var buf bytes.Buffer
+		cw, release, err := archiveCompressor(&buf, codecGzip)
+		require.NoError(t, err)
+		defer release()
+		tw := tar.NewWriter(cw)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Size: int64(len(e.name)), Mode: defaultMode}
+			if e.side != "" {
+				hdr.PAXRecords = map[string]string{paxSide: e.side}
 			}
-		} else {
-			w.WriteField(fieldName, cont)
+			require.NoError(t, tw.WriteHeader(hdr))
+			_, err := tw.Write([]byte(e.name))
+			require.NoError(t, err)
 		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, cw.Close())
+		return buf.Bytes()
+	}
+	names := func(files []DiffFile) []string {
+		return []string{files[0].Name, files[1].Name}
 	}
-	w.Close()
 
-	return buf, w.FormDataContentType()
+	// the recorded sides take precedence over the order of the entries.
+	files, err := readArchive(archive(entry{"new", "green"}, entry{"old", "red"}), 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old", "new"}, names(files))
+
+	// legacy archives, without sides.
+	files, err = readArchive(archive(entry{"old", ""}, entry{"new", ""}), 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old", "new"}, names(files))
+
+	for _, entries := range [][]entry{
+		{{"a", "red"}, {"b", "red"}},
+		{{"a", "red"}, {"b", ""}},
+		{{"a", "blue"}, {"b", "green"}},
+	} {
+		_, err = readArchive(archive(entries...), 0)
+		assert.Error(t, err, "%v", entries)
+	}
+
+	// uploads record their sides.
+	mf := &multipart.Form{Value: map[string][]string{"red": {"a\n"}, "green": {"b\n"}}}
+	arc, err := archiveFromFormValues(mf, 0, codecZstd)
+	require.NoError(t, err)
+	files, err = readArchive(arc, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"red", "green"}, names(files))
+	assert.Equal(t, "a\n", files[0].Content)
+}
+
+func TestArchiveMaxFiles(t *testing.T) {
+	var buf bytes.Buffer
+	cw, release, err := archiveCompressor(&buf, codecGzip)
+	require.NoError(t, err)
+	defer release()
+	tw := tar.NewWriter(cw)
+	for i := range 10000 {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: strconv.Itoa(i), Mode: defaultMode}))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, cw.Close())
+
+	_, err = readArchive(buf.Bytes(), 0)
+	assert.ErrorContains(t, err, "more than 2 files")
+
+	// only one metadata entry may follow the files.
+	buf.Reset()
+	cw, release, err = archiveCompressor(&buf, codecGzip)
+	require.NoError(t, err)
+	defer release()
+	tw = tar.NewWriter(cw)
+	for _, name := range []string{"red", "green", metaName, metaName} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Size: 2, Mode: defaultMode}))
+		_, err := tw.Write([]byte("{}"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, cw.Close())
+	_, err = readArchive(buf.Bytes(), 0)
+	assert.ErrorContains(t, err, "more than one metadata entry")
+
+	// archives with a single file are invalid uploads.
+	buf.Reset()
+	cw, release, err = archiveCompressor(&buf, codecGzip)
+	require.NoError(t, err)
+	defer release()
+	tw = tar.NewWriter(cw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "red", Mode: defaultMode}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, cw.Close())
+	_, _, err = newServer(t).service().create(context.Background(), buf.Bytes(), time.Time{}, nil)
+	assert.ErrorIs(t, err, errUsage)
+}
+
+// stallReader returns (0, nil) on its first read, then reads from r.
+type stallReader struct {
+	r       io.Reader
+	stalled bool
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if !s.stalled {
+		s.stalled = true
+		return 0, nil
+	}
+	return s.r.Read(p)
+}
+
+func TestLimitedReader(t *testing.T) {
+	lr := &limitedReader{r: strings.NewReader("abcdef"), n: 3}
+	_, err := io.ReadAll(lr)
+	assert.ErrorIs(t, err, errArchiveTooLarge)
+
+	lr = &limitedReader{r: strings.NewReader("abc"), n: 3}
+	b, err := io.ReadAll(lr)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+
+	// a reader returning no data once does not make the limit ignored.
+	lr = &limitedReader{r: strings.NewReader("def"), n: 0}
+	lr.r = &stallReader{r: lr.r}
+	n, err := lr.Read(make([]byte, 16))
+	assert.Zero(t, n)
+	assert.Equal(t, io.EOF, err)
+	n, err = lr.Read(make([]byte, 16))
+	assert.Zero(t, n)
+	assert.ErrorIs(t, err, errArchiveTooLarge)
+}
+
+func TestLineLimitWriter(t *testing.T) {
+	for _, tc := range []struct {
+		writes []string
+		err    bool
+	}{
+		{[]string{"a\nb\n"}, false},
+		{[]string{"a\nb"}, false},
+		{[]string{"a\nb\nc"}, true},
+		{[]string{"a\n", "b"}, false},
+		{[]string{"a\nb", "c\n"}, false},
+		{[]string{"a\nb", "\nc"}, true},
+		{[]string{"a\nb\n", ""}, false},
+	} {
+		lw := &lineLimitWriter{w: io.Discard, max: 2}
+		var err error
+		for _, w := range tc.writes {
+			if _, err = lw.Write([]byte(w)); err != nil {
+				break
+			}
+		}
+		if tc.err {
+			assert.ErrorIs(t, err, errTooManyLines, tc.writes)
+		} else {
+			assert.NoError(t, err, tc.writes)
+		}
+	}
+}
+
+func TestArchiveMaxSize(t *testing.T) {
+	for _, codec := range []string{codecGzip, codecZstd} {
+		// 8M of zeros compress to a few kilobytes.
+		var buf bytes.Buffer
+		cw, release, err := archiveCompressor(&buf, codec)
+		require.NoError(t, err, codec)
+		tw := tar.NewWriter(cw)
+		big := make([]byte, 8<<20)
+		for _, name := range []string{"red", "green"} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(big)), Mode: defaultMode}))
+			_, err := tw.Write(big)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, cw.Close())
+		release()
+		assert.Less(t, buf.Len(), 1<<20, codec)
+
+		_, err = readArchive(buf.Bytes(), 1<<20)
+		assert.ErrorIs(t, err, errArchiveTooLarge, codec)
+		// the limit is on the whole archive, not on each file.
+		_, err = readArchive(buf.Bytes(), 12<<20)
+		assert.ErrorIs(t, err, errArchiveTooLarge, codec)
+
+		files, err := readArchive(buf.Bytes(), 17<<20)
+		require.NoError(t, err, codec)
+		assert.Len(t, files[1].Content, 8<<20, codec)
+	}
+}
+
+func TestArchiveConcurrent(t *testing.T) {
+	// Create many archives in parallel, some of which fail halfway through,
+	// to check that the pooled compressors are not shared or left pointing
+	// to the buffers of other requests. Run with -race.
+	const n = 64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		codec := codecGzip
+		if i%2 == 1 {
+			codec = codecZstd
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			red := strings.Repeat(fmt.Sprintf("red %d\n", i), i+1)
+			green := strings.Repeat(fmt.Sprintf("green %d\n", i), i+1)
+			mf := &multipart.Form{Value: map[string][]string{
+				"red":   {red},
+				"green": {green},
+			}}
+			if i%4 == 3 {
+				// exceed the line limit, leaving the compressor unclosed.
+				_, err := archiveFromFormValues(mf, i, codec)
+				assert.ErrorIs(t, err, errTooManyLines)
+				return
+			}
+			arc, err := archiveFromFormValues(mf, 0, codec)
+			if !assert.NoError(t, err) {
+				return
+			}
+			files, err := readArchive(arc, 0)
+			if assert.NoError(t, err) && assert.Len(t, files, 2) {
+				assert.Equal(t, red, files[0].Content)
+				assert.Equal(t, green, files[1].Content)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGitPatch(t *testing.T) {
+	r := newServer(t).Router()
+
+	red, green := "a\nb\nc\n", "a\nc\nd"
+	rd, header := multipartFiles(
+		"red@hello.txt", red,
+		"green@hello.txt", green,
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+".patch", nil)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code)
+	patch := wri.Body.String()
+	assert.True(t, strings.HasPrefix(patch, "diff --git a/hello.txt b/hello.txt\n--- a/hello.txt\n+++ b/hello.txt\n@@"), patch)
+
+	// validate the patch using git, if available.
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hello.txt"), []byte(red), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "x.patch"), []byte(patch), 0o644))
+	cmd := exec.Command(gitBin, "apply", "x.patch")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	applied, err := os.ReadFile(filepath.Join(dir, "hello.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, green, string(applied))
+}
+
+func TestAlgorithm(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nc\nc\nc\nb\n",
+		"green@a.txt", "b\na\nb\nc\na\nb\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/stat", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), `"total_added":5,"total_deleted":4`)
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/stat?algo=myers", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), `"total_added":3,"total_deleted":2`)
+}
+
+func TestFullContext(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+		"green@a.txt", "one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+".diff", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, 2, strings.Count(wri.Body.String(), "@@ -"))
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+".diff?c=full", nil)
+	r.ServeHTTP(wri, req)
+	body := wri.Body.String()
+	assert.Equal(t, 1, strings.Count(body, "@@ -"))
+	assert.Contains(t, body, "@@ -1,10 +1,10 @@\n")
+	assert.Contains(t, body, " 5\n")
+}
+
+func TestRefs(t *testing.T) {
+	r := newServer(t).Router()
+
+	upload := func(t *testing.T, fields ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		rd, header := multipartFiles(append([]string{
+			"red@main.go", "a\nb\n",
+			"green@main.go", "a\nc\n",
+		}, fields...)...)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	wri := upload(t)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	plain := wri.Header().Get("Location")
+
+	wri = upload(t, "red_ref", "abc123", "green_ref", "def456")
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+	// the refs are part of the archive, so the id differs.
+	assert.NotEqual(t, plain, loc)
+
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", loc, nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+	body := wri.Body.String()
+	assert.Contains(t, body, "<title>main.go (abc123) → main.go (def456) · diffy</title>")
+	assert.Contains(t, body, `<span class="ref">abc123</span>`)
+	assert.Contains(t, body, `<span class="ref">def456</span>`)
+
+	// the refs are shown in the headers of the raw diff and of the patch.
+	for _, ext := range []string{".diff", ".patch"} {
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+ext, nil)
+		r.ServeHTTP(wri, req)
+		assert.Contains(t, wri.Body.String(), "main.go\tabc123\n", ext)
+		assert.Contains(t, wri.Body.String(), "main.go\tdef456\n", ext)
+	}
+
+	// red_label and green_label are the same as the refs.
+	wri = upload(t, "red_label", "abc123", "green_label", "def456")
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	assert.Equal(t, loc, wri.Header().Get("Location"))
+
+	// the metadata is not part of the files.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/green", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, "a\nc\n", wri.Body.String())
+
+	wri = upload(t, "red_ref", "abc\n123")
+	assert.Equal(t, http.StatusBadRequest, wri.Code, wri.Body.String())
+	wri = upload(t, "green_label", "abc\t123")
+	assert.Equal(t, http.StatusBadRequest, wri.Code, wri.Body.String())
+}
+
+func TestModes(t *testing.T) {
+	r := newServer(t).Router()
+
+	upload := func(t *testing.T, fields ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		rd, header := multipartFiles(append([]string{
+			"red@run.sh", "echo hi\n",
+			"green@run.sh", "echo hi\n",
+		}, fields...)...)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	// only the mode changed.
+	wri := upload(t, "red_mode", "644", "green_mode", "100755")
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", loc+".patch", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, "diff --git a/run.sh b/run.sh\nold mode 100644\nnew mode 100755\n", wri.Body.String())
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+".html", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), "mode changed 100644 → 100755")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+".json", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), `"old_mode":"100644","new_mode":"100755"`)
+
+	wri = upload(t, "red_mode", "755", "green_mode", "755")
+	assert.Equal(t, http.StatusBadRequest, wri.Code, wri.Body.String())
+	wri = upload(t, "red_mode", "777")
+	assert.Equal(t, http.StatusBadRequest, wri.Code, wri.Body.String())
+}
+
+func TestDevNull(t *testing.T) {
+	r := newServer(t).Router()
+
+	upload := func(t *testing.T, fields ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		rd, header := multipartFiles(fields...)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+	get := func(t *testing.T, path string) string {
+		t.Helper()
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+		return wri.Body.String()
+	}
+
+	// new file, omitting red.
+	wri := upload(t, "red_devnull", "1", "green@new.txt", "a\nb\n")
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+	assert.Equal(t, "diff --git a/new.txt b/new.txt\nnew file mode 100644\n"+
+		"--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,2 @@\n+a\n+b\n", get(t, loc+".patch"))
+	assert.Contains(t, get(t, loc+".html"), "<i>new file</i>")
+	assert.Contains(t, get(t, loc+".json"), `"new_file":true`)
+
+	// deleted file, with an empty green file, using the text form.
+	wri = upload(t, "red", "x\n", "red_name", "old.sh", "red_mode", "755", "green", "", "green_devnull", "true")
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc = wri.Header().Get("Location")
+	assert.Equal(t, "diff --git a/old.sh b/old.sh\ndeleted file mode 100755\n"+
+		"--- a/old.sh\n+++ /dev/null\n@@ -1 +0,0 @@\n-x\n", get(t, loc+".patch"))
+	assert.Contains(t, get(t, loc+".diff"), "+++ /dev/null\n")
+
+	// invalid uses.
+	for _, fields := range [][]string{
+		{"red_devnull", "1", "green_devnull", "1", "green@a", "x"},
+		{"red_devnull", "1", "red@a", "x", "green@a", "y"},
+		{"red_devnull", "maybe", "green@a", "x"},
+		{"green@a", "x"},
+	} {
+		wri = upload(t, fields...)
+		assert.Equal(t, http.StatusBadRequest, wri.Code, "%v: %s", fields, wri.Body.String())
+	}
+}
+
+func TestStat(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nb  c\n d\ne\n",
+		"green@b.txt", "a\nb c\nd\nf\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+	f, err := serv.DB.GetFile(path.Base(loc))
+	require.NoError(t, err)
+
+	tt := []struct {
+		query string
+		want  string
+	}{
+		{"", `{"files":[{"old":"a.txt","new":"b.txt","added":3,"deleted":3}],"total_added":3,"total_deleted":3,"size":%d}`},
+		{"?w=b", `{"files":[{"old":"a.txt","new":"b.txt","added":2,"deleted":2}],"total_added":2,"total_deleted":2,"size":%d}`},
+		{"?w=w", `{"files":[{"old":"a.txt","new":"b.txt","added":1,"deleted":1}],"total_added":1,"total_deleted":1,"size":%d}`},
+		{"?w=show", `{"files":[{"old":"a.txt","new":"b.txt","added":1,"deleted":1}],"total_added":1,"total_deleted":1,"size":%d}`},
+	}
+	for _, tc := range tt {
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/stat"+tc.query, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusOK, wri.Code)
+		assert.Equal(t, "application/json", wri.Header().Get("Content-Type"))
+		assert.JSONEq(t, fmt.Sprintf(tc.want, f.Size), wri.Body.String(), tc.query)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nb  c\n d\ne\nf\ng\nh\ni\nj\n",
+		"green@b.txt", "a\nb c\nd\nE\nf\ng\nh\nj\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	tt := []struct {
+		query string
+		want  string
+	}{
+		{"", `{"files":[{"old":"a.txt","new":"b.txt","ranges":[{"start":2,"end":5},{"start":8,"end":8}]}]}`},
+		{"?w=b", `{"files":[{"old":"a.txt","new":"b.txt","ranges":[{"start":3,"end":5},{"start":8,"end":8}]}]}`},
+		{"?w=w", `{"files":[{"old":"a.txt","new":"b.txt","ranges":[{"start":4,"end":5},{"start":8,"end":8}]}]}`},
+	}
+	for _, tc := range tt {
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/ranges.json"+tc.query, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusOK, wri.Code)
+		assert.Equal(t, "application/json", wri.Header().Get("Content-Type"))
+		assert.JSONEq(t, tc.want, wri.Body.String(), tc.query)
+	}
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/abcdefgh/ranges.json", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusNotFound, wri.Code)
+}
+
+func TestShowWhitespace(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nb  c\nd\ne\nf\ng\nh\ni\nj\nk\n",
+		"green@b.txt", "a\nb c\nd\ne\nf\ng\nh\ni\nj\nK\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	get := func(path string) string {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		require.Equal(t, http.StatusOK, wri.Code, path)
+		return wri.Body.String()
+	}
+
+	// with -w, the whitespace change is too far from the other change to be
+	// shown; with ?w=show, it is shown as an equal line, marked.
+	assert.NotContains(t, get(loc+".diff?w=w"), "b  c")
+	assert.Equal(t, "diff a.txt b.txt\n--- a.txt\n+++ b.txt\n"+
+		"@@ -1,5 +1,5 @@\n a\n b  c\n d\n e\n f\n"+
+		"@@ -7,4 +7,4 @@\n h\n i\n j\n-k\n+K\n",
+		get(loc+".diff?w=show"))
+
+	body := get(loc + ".json?w=show")
+	assert.Contains(t, body, `{"type":"equal","old":2,"new":2,"content":"b  c","normalized":true,"new_content":"b c"}`)
+	assert.Equal(t, 1, strings.Count(body, `"normalized"`))
+
+	body = get(loc + ".html?w=show")
+	assert.Equal(t, 2, strings.Count(body, "line-normalized"))
+	assert.Contains(t, body, "marking whitespace changes")
+
+	// the split view shows the line of each file on its side.
+	body = get(loc + ".html?w=show&split=1")
+	assert.Equal(t, 4, strings.Count(body, "line-normalized"))
+	assert.Contains(t, body, ">b  c</div>")
+	assert.Contains(t, body, ">b c</div>")
+
+	// with -w, the lines in the context of other changes are not marked.
+	body = get(loc + ".html?w=w&c=10")
+	assert.Contains(t, body, ">b  c</div>")
+	assert.NotContains(t, body, "line-normalized")
+}
+
+func TestRaw(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	// not valid UTF-8, so that it would be altered in a JSON string.
+	red := "a\r\n\xff\n"
+	rd, header := multipartFiles(
+		"red@a.txt", red,
+		"green@b.txt", "b",
+		"green_ref", "v2",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+	id := path.Base(loc)
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/raw", nil)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code)
+	assert.Equal(t, "application/json", wri.Header().Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(wri.Body.Len()), wri.Header().Get("Content-Length"))
+	lastModified := wri.Header().Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+	var res jsonRaw
+	require.NoError(t, json.Unmarshal(wri.Body.Bytes(), &res))
+	assert.Equal(t, id, res.ID)
+	require.NotNil(t, res.CreatedAt)
+	assert.Equal(t, []jsonRawFile{
+		{Name: "a.txt", Content: []byte(red)},
+		{Name: "b.txt", Content: []byte("b"), Ref: "v2"},
+	}, res.Files)
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/raw", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusNotModified, wri.Code)
+
+	// the id is returned in its canonical form, in the case of the links.
+	for _, idCase := range []string{"lower", "upper"} {
+		serv.IDCase = idCase
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/"+strings.ToUpper(id)+"/raw", nil)
+		r.ServeHTTP(wri, req)
+		require.Equal(t, http.StatusOK, wri.Code)
+		require.NoError(t, json.Unmarshal(wri.Body.Bytes(), &res))
+		assert.Equal(t, serv.publicID(id), res.ID, idCase)
+	}
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/example/raw", nil)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code)
+	assert.NotContains(t, wri.Body.String(), "created_at")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/abcdefgh/raw", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusNotFound, wri.Code)
+}
+
+func TestJSONMode(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		"red@a.json", `{"b": 1, "a": [1, 2], "c": "<x>"}`,
+		"green@a.json", "{\n\t\"a\": [1, 2],\n\t\"c\": \"<x>\",\n\t\"b\": 2\n}\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"?mode=json", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+	assert.Contains(t, wri.Body.String(), "-  \"b\": 1,\n+  \"b\": 2,\n")
+	assert.Contains(t, wri.Body.String(), "   \"c\": \"<x>\"\n")
+	assert.NotContains(t, wri.Body.String(), "\"a\"")
+}
+
+func TestInterdiffMode(t *testing.T) {
+	r := newServer(t).Router()
+
+	// the second version of the patch moves the first hunk, changes one of
+	// its lines, and adds a hunk.
+	rd, header := multipartFiles(
+		"red@v1.patch", "From: a\n\nfirst version\n---\n"+
+			"diff --git a/a.go b/a.go\nindex 1111111..2222222 100644\n--- a/a.go\n+++ b/a.go\n"+
+			"@@ -10,3 +10,3 @@ func a() {\n x := 1\n-y := 2\n+y := 3\n z := 4\n",
+		"green@v2.patch", "From: a\n\nsecond version\n---\n"+
+			"diff --git a/a.go b/a.go\nindex 3333333..4444444 100644\n--- a/a.go\n+++ b/a.go\n"+
+			"@@ -12,3 +12,3 @@ func a() {\n x := 1\n-y := 2\n+y := 5\n z := 4\n"+
+			"@@ -30,2 +30,3 @@ func b() {\n v := 1\n+w := 2\n u := 3\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	get := func(p string) string {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", p, nil)
+		r.ServeHTTP(wri, req)
+		return wri.Body.String()
+	}
+	body := get(loc + ".diff?mode=interdiff&c=0")
+	assert.Contains(t, body, "-+y := 3\n++y := 5\n")
+	assert.Contains(t, body, "+@@ a.go a.go @@\n+ v := 1\n++w := 2\n+ u := 3\n")
+	assert.NotContains(t, body, "-@@ ")
+	assert.NotContains(t, body, "index")
+	assert.NotContains(t, body, "version")
+
+	// without the mode, the hunk headers and the index lines differ too.
+	body = get(loc + ".diff?c=0")
+	assert.Contains(t, body, "-@@ -10,3 +10,3 @@ func a() {\n+@@ -12,3 +12,3 @@ func a() {\n")
+	assert.Contains(t, body, "-index 1111111..2222222 100644\n")
+
+	// files which are not patches are compared as text.
+	rd, header = multipartFiles("red@a.txt", "@@ a\n", "green@b.txt", "@@ b\n")
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	body = get(wri.Header().Get("Location") + ".diff?mode=interdiff")
+	assert.Contains(t, body, "-@@ a\n+@@ b\n")
+}
+
+func TestCSVMode(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		"red@a.csv", "name,qty\napple,1\n\"pear, green\",2\n",
+		"green@a.csv", "name,qty\napple,1\n\"pear, green\",5\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"?mode=csv&format=html", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+	body := wri.Body.String()
+	assert.Contains(t, body, `class="diff-table"`)
+	assert.Contains(t, body, "<td>pear, green</td>")
+	assert.Contains(t, body, `<td class="cell-changed"><del>2</del> <ins>5</ins></td>`)
+	assert.Contains(t, body, `<td class="symbol">~</td>`)
+
+	// with another delimiter, the quotes do not parse: fall back to the
+	// line diff.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"?mode=csv&delim=%3B&format=html", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+	body = wri.Body.String()
+	assert.NotContains(t, body, `class="diff-table"`)
+	assert.Contains(t, body, "diff-unified")
+}
+
+func TestCSVDelim(t *testing.T) {
+	for _, tc := range []struct {
+		param, name string
+		want        rune
+	}{
+		{"", "a.csv", ','},
+		{"", "a.TSV", '\t'},
+		{"tab", "a.csv", '\t'},
+		{";", "a.tsv", ';'},
+		{"ab", "a.csv", ','},
+	} {
+		assert.Equal(t, tc.want, csvDelim(tc.param, tc.name), "%q %q", tc.param, tc.name)
+	}
+}
+
+func TestMaxColumns(t *testing.T) {
+	serv := newServer(t)
+	serv.MaxColumns = 10
+	r := serv.Router()
+
+	long := strings.Repeat("x", 30)
+	rd, header := multipartFiles(
+		"red@a.txt", "a\n",
+		"green@a.txt", long+"\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	get := func(path string) string {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		return wri.Body.String()
+	}
+	assert.Contains(t, get(loc+".html"), long[:10]+`<span class="line-rest" hidden>`+long[10:]+"</span>")
+	assert.Contains(t, get(loc+".html?maxcol=20"), long[:20]+`<span class="line-rest" hidden>`)
+	assert.NotContains(t, get(loc+".html?maxcol=0"), "line-rest")
+	// only the html output is truncated.
+	assert.Contains(t, get(loc+".diff"), "+"+long+"\n")
+}
+
+func TestUnicodeNFC(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		// precomposed (NFC) vs combining accent (NFD).
+		"red@a.txt", "caf\u00e9\nx\n",
+		"green@a.txt", "cafe\u0301\ny\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc, nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), "-caf\u00e9\n")
+
+	// composed with whitespace normalization.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"?unicode=nfc&w=w", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), "@@ -1,2 +1,2 @@\n caf\u00e9\n-x\n+y\n")
+}
+
+func TestPostDiff(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	post := func(accept string) *httptest.ResponseRecorder {
+		rd, header := multipartFiles(
+			"red@a.txt", "a\nb\n",
+			"green@a.txt", "a\nc\n",
+		)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/diff", rd)
+		req.Header.Set("Content-Type", header)
+		req.Header.Set("Accept", accept)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	wri := post("")
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+	assert.Equal(t, "diff a.txt a.txt\n--- a.txt\n+++ a.txt\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n", wri.Body.String())
+
+	wri = post("application/json")
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+	assert.Equal(t, ctJSON, wri.Header().Get(ctHeader))
+	assert.Contains(t, wri.Body.String(), `"old_name":"a.txt"`)
+
+	// nothing is stored.
+	err := serv.DB.ListFiles(func(name string, f db.File) error {
+		t.Errorf("unexpected file %q", name)
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Run("Throttle", func(t *testing.T) {
+		var th throttle
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			assert.True(t, th.allow("a", 3, time.Minute, now))
+		}
+		assert.False(t, th.allow("a", 3, time.Minute, now.Add(time.Second)))
+		assert.True(t, th.allow("b", 3, time.Minute, now.Add(time.Second)))
+		assert.True(t, th.allow("a", 3, time.Minute, now.Add(time.Minute)))
+	})
+}
+
+func TestJSONSplitPaddings(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nb\nc\nd\n",
+		"green@a.txt", "x\nc\ny\nz\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/diff", rd)
+	req.Header.Set("Content-Type", header)
+	req.Header.Set("Accept", "application/json")
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code, wri.Body.String())
+
+	var res jsonDiff
+	require.NoError(t, json.Unmarshal(wri.Body.Bytes(), &res))
+	require.Len(t, res.Hunks, 1)
+	// -a -b +x, c, -d +y +z: the green side is one row short after the
+	// first change, and the red side after the second.
+	assert.Equal(t, jsonPaddings{
+		Red:   map[int]int{5: 1},
+		Green: map[int]int{1: 1},
+	}, res.Hunks[0].SplitPaddings)
+	assert.Contains(t, wri.Body.String(), `"split_paddings":{"red":{"5":1},"green":{"1":1}}`)
+}
+
+func TestHealth(t *testing.T) {
+	serv := newServer(t)
+	var out bytes.Buffer
+	serv.Output = &out
+	dir := filepath.Join(t.TempDir(), "storage")
+	st, err := storage.NewFSStorage(dir)
+	require.NoError(t, err)
+	serv.Storage = st
+	r := serv.Router()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+	// health checks are not logged.
+	assert.Empty(t, out.String())
+
+	require.NoError(t, os.RemoveAll(dir))
+	wri := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, wri.Code)
+	assert.Contains(t, wri.Body.String(), "storage: ")
+
+	require.NoError(t, serv.DB.DB.Close())
+	wri = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, wri.Code)
+	assert.Contains(t, wri.Body.String(), "db: ")
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+}
+
+func TestNotFound(t *testing.T) {
+	r := newServer(t).Router()
+
+	for _, path := range []string{"/abcdefgh", "/abcdefgh/red", "/abcdefgh/green"} {
+		// plain text, for non-browsers.
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusNotFound, wri.Code, path)
+		assert.Equal(t, "not found\n", wri.Body.String(), path)
+
+		// html page, for browsers.
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", firefoxUA)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusNotFound, wri.Code, path)
+		assert.Contains(t, wri.Body.String(), "this diff does not exist", path)
+	}
+
+	// an explicit raw format gets the plain text, even from browsers.
+	for _, path := range []string{"/abcdefgh.diff", "/abcdefgh.patch", "/abcdefgh?format=raw"} {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", firefoxUA)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusNotFound, wri.Code, path)
+		assert.Equal(t, "not found\n", wri.Body.String(), path)
+	}
+}
+
+func TestExample(t *testing.T) {
+	get := func(r http.Handler, path string) *httptest.ResponseRecorder {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", firefoxUA)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	serv := newServer(t)
+	serv.ExampleAliases = []string{"demo"}
+	r := serv.Router()
+	assert.Equal(t, http.StatusOK, get(r, "/example").Code)
+	assert.Equal(t, http.StatusOK, get(r, "/demo.diff").Code)
+	assert.Equal(t, http.StatusNotFound, get(r, "/sample").Code)
+	assert.Contains(t, get(r, "/").Body.String(), `href="/example"`)
+
+	serv = newServer(t)
+	serv.DisableExample = true
+	serv.ExampleAliases = []string{"demo"}
+	r = serv.Router()
+	assert.Equal(t, http.StatusNotFound, get(r, "/example").Code)
+	assert.Equal(t, http.StatusNotFound, get(r, "/example/red").Code)
+	assert.Equal(t, http.StatusNotFound, get(r, "/demo").Code)
+	assert.NotContains(t, get(r, "/").Body.String(), `href="/example"`)
+}
+
+func TestInvalidID(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	// store diffs with invalid ids directly: they should not be served, as
+	// the database should not even be queried.
+	for _, id := range []string{"abc", "ABCDEFGH", "abcdefgi", "abcdefghj", "abcdefg-"} {
+		require.NoError(t, serv.DB.PutFile(id, db.File{CreatedAt: time.Now(), Sum: "abcdef"}))
+		for _, path := range []string{"/" + id, "/" + id + "/red", "/" + id + "/stat"} {
+			wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+			r.ServeHTTP(wri, req)
+			assert.Equal(t, http.StatusNotFound, wri.Code, path)
+		}
+	}
+
+	// valid ids, which do not exist.
+	for _, id := range []string{"abcdefgh", "0123zxyv"} {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/"+id, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusNotFound, wri.Code, id)
+	}
+}
+
+func TestReservedIDs(t *testing.T) {
+	serv := newServer(t)
+	serv.ReservedIDs = []string{"admin"}
+	r := serv.Router()
+
+	for _, path := range []string{"/favicon.ico", "/robots.txt", "/metrics", "/admin", "/ADMIN/red", "/static"} {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusNotFound, wri.Code, path)
+	}
+
+	// reserved ids, and ids of uploaded diffs, cannot be example aliases.
+	for _, alias := range []string{"healthz", "Static", "admin", "example", "abcdefgh", "ABCDEFGH"} {
+		serv.ExampleAliases = []string{"demo", alias}
+		assert.Error(t, serv.CheckExampleAliases(), alias)
+	}
+	serv.ExampleAliases = []string{"demo", "sample"}
+	assert.NoError(t, serv.CheckExampleAliases())
+}
+
+func TestIdentical(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	// uploads of identical files are rejected.
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nb\n",
+		"green@b.txt", "a\nb\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusBadRequest, wri.Code)
+	assert.Equal(t, "error: the files are identical\n", wri.Body.String())
+
+	// diffs of identical files, stored before they were rejected.
+	arc, err := archiveFromFormValues(&multipart.Form{Value: map[string][]string{
+		"red":   {"a\nb\n"},
+		"green": {"a\nb\n"},
+	}}, 0, codecGzip)
+	require.NoError(t, err)
+	const id = "abcdefgh"
+	require.NoError(t, serv.Storage.Put(context.Background(), id, arc))
+	require.NoError(t, serv.DB.PutFile(id, db.File{CreatedAt: time.Now(), Sum: "abcdef"}))
+
+	for _, tc := range []struct {
+		path, ua, want string
+	}{
+		{"/" + id, firefoxUA, "<i>files are identical</i>"},
+		{"/" + id + "?split=1", firefoxUA, "<i>files are identical</i>"},
+		{"/" + id + "?lang=it", firefoxUA, "<i>i file sono identici</i>"},
+		{"/" + id + "?split=1&lang=it", firefoxUA, "<i>i file sono identici</i>"},
+		{"/" + id, "curl/8.5.0", "files are identical\n"},
+		{"/" + id + ".diff", "curl/8.5.0", ""},
+		{"/" + id + ".patch", "curl/8.5.0", ""},
+	} {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("User-Agent", tc.ua)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusOK, wri.Code, tc.path)
+		if tc.want == "" {
+			assert.Empty(t, wri.Body.String(), tc.path)
+		} else {
+			assert.Contains(t, wri.Body.String(), tc.want, tc.path)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nb\n",
+		"green@a.txt", "a\nc\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	id := path.Base(wri.Header().Get("Location"))
+
+	arc, err := serv.Storage.Get(context.Background(), id)
+	require.NoError(t, err)
+	f, err := serv.DB.GetFile(id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(arc)), f.Size)
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/"+id+"/stat", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), fmt.Sprintf(`"size":%d`, len(arc)))
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/"+id, nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), "uploaded <time")
+	assert.Contains(t, wri.Body.String(), fmt.Sprintf(" · %d B", len(arc)))
+
+	// records without a size are updated when viewed.
+	f.Size = 0
+	require.NoError(t, serv.DB.PutFile(id, f))
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/"+id, nil)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusOK, wri.Code)
+	f, err = serv.DB.GetFile(id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(arc)), f.Size)
+}
+
+func TestOrphanedRecord(t *testing.T) {
+	// A file which exists in the DB, but not in the storage.
+	serv := newServer(t)
+	r := serv.Router()
+	require.NoError(t, serv.DB.PutFile("abcdefgh", db.File{
+		CreatedAt: time.Now(),
+		Sum:       "abcdef",
+	}))
+
+	for _, path := range []string{"/abcdefgh", "/abcdefgh/red"} {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusGone, wri.Code, path)
+		assert.Contains(t, wri.Body.String(), "content unavailable", path)
+	}
+}
+
+func BenchmarkArchiveGzipLevel(b *testing.B) {
+	// build a tar of (somewhat) realistic source code.
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for i, f := range exampleFiles {
+		content := strings.Repeat(f.Content, 20)
+		require.NoError(b, tarWriteMultipart(tw, i, f.Name, defaultMode, int64(len(content)), strings.NewReader(content), 0))
+	}
+	require.NoError(b, tw.Close())
+
+	levels := []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression}
+	for _, level := range levels {
+		b.Run(strconv.Itoa(level), func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				gz, err := gzip.NewWriterLevel(&buf, level)
+				require.NoError(b, err)
+				gz.Write(tarBuf.Bytes())
+				require.NoError(b, gz.Close())
+				size = buf.Len()
+			}
+			b.ReportMetric(float64(size), "stored-bytes")
+		})
+	}
+}
+
+func randBytes(r *rand.Rand, buf []byte) {
+	for i := 0; i < len(buf); i += 8 {
+		var dstLe [8]byte
+		binary.BigEndian.PutUint64(dstLe[:], r.Uint64())
+		var dst [16]byte
+		hex.Encode(dst[:], dstLe[:])
+		copy(buf[i:], dst[:])
+	}
+}
+
+func multipartFiles(filesContents ...string) (*bytes.Buffer, string) {
+	if len(filesContents)%2 != 0 {
+		panic("multipartFiles expect even number of arguments")
+	}
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+	for i := 0; i < len(filesContents); i += 2 {
+		fieldName, cont := filesContents[i], filesContents[i+1]
+		pos := strings.IndexByte(fieldName, '@')
+		if pos >= 0 {
+			fieldName, fileName := fieldName[:pos], fieldName[pos+1:]
+			w, err := w.CreateFormFile(fieldName, fileName)
+			if err != nil {
+				panic(err)
+			}
+			if _, err := w.Write([]byte(cont)); err != nil {
+				panic(err)
+			}
+		} else {
+			w.WriteField(fieldName, cont)
+		}
+	}
+	w.Close()
+
+	return buf, w.FormDataContentType()
+}
+
+func TestLanguage(t *testing.T) {
+	r := newServer(t).Router()
+	get := func(path, ua, acceptLanguage string) *httptest.ResponseRecorder {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", ua)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+
+	wri := get("/notexist", "curl/8.0", "it-IT,it;q=0.9,en;q=0.8")
+	assert.Equal(t, http.StatusNotFound, wri.Code)
+	assert.Equal(t, "non trovato\n", wri.Body.String())
+	assert.Contains(t, wri.Header().Values("Vary"), "Accept-Language")
+
+	// unknown languages fall back to english; ?lang= takes precedence.
+	assert.Equal(t, "not found\n", get("/notexist", "curl/8.0", "de").Body.String())
+	assert.Equal(t, "not found\n", get("/notexist?lang=en", "curl/8.0", "it").Body.String())
+	assert.Equal(t, "non trovato\n", get("/notexist?lang=it", "curl/8.0", "").Body.String())
+
+	body := get("/notexist", firefoxUA, "it").Body.String()
+	assert.Contains(t, body, `<html lang="it">`)
+	assert.Contains(t, body, "questo diff non esiste.")
+	body = get("/", firefoxUA, "it").Body.String()
+	assert.Contains(t, body, "uno stupidissimo strumento per i diff")
+	assert.Contains(t, get("/", "curl/8.0", "it").Body.String(), "uso: curl")
+	assert.Contains(t, get("/", firefoxUA, "").Body.String(), "a dead stupid diff tool")
+}
+
+func TestIDCase(t *testing.T) {
+	serv := newServer(t)
+	serv.IDCase = "upper"
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\n",
+		"green@a.txt", "b\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	id := path.Base(wri.Header().Get("Location"))
+	require.Equal(t, strings.ToUpper(id), id)
+
+	// the record is stored in lowercase.
+	has, err := serv.DB.HasFile(strings.ToLower(id))
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	for _, id := range []string{id, strings.ToLower(id), strings.ToLower(id[:4]) + id[4:]} {
+		for _, p := range []string{"/" + id, "/" + id + ".diff", "/" + id + "/red", "/" + id + "/stat"} {
+			wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", p, nil)
+			r.ServeHTTP(wri, req)
+			assert.Equal(t, http.StatusOK, wri.Code, p)
+		}
+	}
+}
+
+func TestNormalizeID(t *testing.T) {
+	for _, tc := range []struct {
+		id, want string
+		valid    bool
+	}{
+		{"04106105", "04106105", true},
+		{"O41O61O5", "04106105", true},
+		{"0410610", "0410610", true},
+		{"c7lvj0G", "c71vj0g", true},
+		// other lengths, and other unused trailing bits.
+		{"04106105z", "04106105z", false},
+		{"041061050", "041061050", false},
+		{"0410611", "0410611", false},
+		{"0410617", "0410617", false},
+		{"04106-105", "04106-105", false},
+		{"example", "example", false},
+	} {
+		have := normalizeID(tc.id)
+		assert.Equal(t, tc.want, have, tc.id)
+		assert.Equal(t, tc.valid, validID(have), tc.id)
+	}
+	for n := 1; n <= 30; n++ {
+		assert.Equal(t, slices.Contains([]int{7, 8, 10, 12, 13, 15, 16, 18, 20, 21, 23, 24, 26}, n), validIDLength(n), n)
+	}
+}
+
+func TestDiffTimeout(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\n",
+		"green@a.txt", "b\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	// the timeout is exceeded before the diff can be computed.
+	serv.DiffTimeout = time.Nanosecond
+	for _, p := range []string{loc, loc + ".html", loc + "/stat"} {
+		wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", p, nil)
+		r.ServeHTTP(wri, req)
+		assert.Equal(t, http.StatusServiceUnavailable, wri.Code, p)
+		assert.Contains(t, wri.Body.String(), "too long", p)
+	}
+	// the stored files can still be retrieved.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"/red", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+
+	serv.DiffTimeout = time.Minute
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+".diff", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+}
+
+func TestPalette(t *testing.T) {
+	r := newServer(t).Router()
+	get := func(path string) string {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(wri, req)
+		return wri.Body.String()
+	}
+	assert.Contains(t, get("/example.html?palette=cb"), `<html data-palette="cb">`)
+	assert.Contains(t, get("/example.html"), "<html>")
+	assert.Contains(t, get("/example.html?palette=invalid"), "<html>")
+}
+
+func TestLastModified(t *testing.T) {
+	serv := newServer(t)
+	r := serv.Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\n",
+		"green@a.txt", "b\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	f, err := serv.DB.GetFile(path.Base(loc))
+	require.NoError(t, err)
+	created := f.CreatedAt.UTC()
+
+	get := func(p string, ims time.Time) *httptest.ResponseRecorder {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", p, nil)
+		if !ims.IsZero() {
+			req.Header.Set("If-Modified-Since", ims.Format(http.TimeFormat))
+		}
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+	// the format of the diff without an extension depends on the client.
+	vary := func(p string) []string {
+		if p == loc {
+			return []string{"Accept", "User-Agent", "Accept-Language"}
+		}
+		return []string{"Accept", "Accept-Language"}
+	}
+	for _, p := range []string{loc, loc + ".html", loc + ".json", loc + "/stat", loc + "/red"} {
+		wri := get(p, time.Time{})
+		assert.Equal(t, http.StatusOK, wri.Code, p)
+		assert.Equal(t, created.Format(http.TimeFormat), wri.Header().Get("Last-Modified"), p)
+		if p != loc+"/red" {
+			assert.Equal(t, vary(p), wri.Header().Values("Vary"), p)
+		}
+
+		assert.Equal(t, http.StatusOK, get(p, created.Add(-time.Hour)).Code, p)
+		wri = get(p, created.Add(time.Second))
+		assert.Equal(t, http.StatusNotModified, wri.Code, p)
+		assert.Empty(t, wri.Body.String(), p)
+		if p != loc+"/red" {
+			assert.Equal(t, vary(p), wri.Header().Values("Vary"), p)
+		}
+		assert.Equal(t, http.StatusNotModified, get(p, created).Code, p)
+	}
+
+	// the example has no creation time.
+	wri = get("/example", time.Time{})
+	assert.Equal(t, http.StatusOK, wri.Code)
+	assert.Empty(t, wri.Header().Get("Last-Modified"))
+}
+
+func TestMaxConcurrentUploads(t *testing.T) {
+	const n = 2
+	serv := newServer(t)
+	serv.MaxConcurrentUploads = n
+	r := serv.Router()
+
+	// start n uploads, which block until the last byte of their body is
+	// written.
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		rd, header := multipartFiles(
+			"red@a.txt", "a\n",
+			"green@a.txt", strconv.Itoa(i)+"\n",
+		)
+		body := rd.Bytes()
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write(body[:len(body)-1])
+			<-release
+			pw.Write(body[len(body)-1:])
+			pw.Close()
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", pr)
+			req.Header.Set("Content-Type", header)
+			r.ServeHTTP(wri, req)
+			codes[i] = wri.Code
+		}()
+	}
+	require.Eventually(t, func() bool { return len(serv.uploads) == n }, 5*time.Second, time.Millisecond)
+
+	upload := func(p string) *httptest.ResponseRecorder {
+		rd, header := multipartFiles(
+			"red@a.txt", "a\n",
+			"green@a.txt", "b\n",
+		)
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", p, rd)
+		req.Header.Set("Content-Type", header)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+	for _, p := range []string{"/", "/diff"} {
+		wri := upload(p)
+		assert.Equal(t, http.StatusServiceUnavailable, wri.Code, p)
+		assert.Equal(t, "5", wri.Header().Get("Retry-After"), p)
+	}
+
+	// once the uploads are done, new ones are accepted.
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusFound, http.StatusFound}, codes)
+	assert.Equal(t, http.StatusFound, upload("/").Code)
+}
+
+func TestDebugAnchors(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "x\na\ny\nb\n",
+		"green@a.txt", "a\nz\nb\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"?debug=anchors", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+	assert.Equal(t, "2\t1\ta\n4\t3\tb\n", wri.Body.String())
+}
+
+func TestNumbered(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles(
+		"red@a.txt", "a\nb\n",
+		"green@a.txt", "a\nc\n",
+	)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	get := func(p string) string {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", p, nil)
+		r.ServeHTTP(wri, req)
+		return wri.Body.String()
+	}
+	assert.Equal(t, "diff a.txt a.txt\n--- a.txt\n+++ a.txt\n@@ -1,2 +1,2 @@\n1 1  a\n2   -b\n  2 +c\n",
+		get(loc+".diff?numbered"))
+	// the other formats are unchanged.
+	assert.Equal(t, "diff a.txt a.txt\n--- a.txt\n+++ a.txt\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n", get(loc+".diff"))
+	assert.NotContains(t, get(loc+".patch?numbered"), "1 1")
+}
+
+func TestBlockContext(t *testing.T) {
+	r := newServer(t).Router()
+
+	const (
+		old = "a\n\nb1\nb2\nb3\nb4\nb5\nb6\n\nc\n"
+		new = "a\n\nb1\nb2\nb3\nb4\nB5\nb6\n\nc\n"
+	)
+	rd, header := multipartFiles("red@a.txt", old, "green@a.txt", new)
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	get := func(p string) string {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", p, nil)
+		r.ServeHTTP(wri, req)
+		return wri.Body.String()
+	}
+	// the whole block of b, and only it, is shown.
+	assert.Equal(t, "diff a.txt a.txt\n--- a.txt\n+++ a.txt\n@@ -3,6 +3,6 @@\n b1\n b2\n b3\n b4\n-b5\n+B5\n b6\n",
+		get(loc+".diff?c=block"))
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+"?c=block", nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), "context: blocks")
+	assert.Contains(t, wri.Body.String(), "<b>block</b>")
+
+	// POST /diff supports it as well.
+	rd, header = multipartFiles("red@a.txt", old, "green@a.txt", new)
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/diff?c=block", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), "@@ -3,6 +3,6 @@\n")
+}
+
+func TestControlCharacters(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles("red@a.txt", "\ufeffa\n", "green@a.txt", "a\x1b[0m\n")
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	// shown on the diff page...
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc, nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), `<span class="ctrl" title="U+FEFF">BOM</span>a`)
+	assert.Contains(t, wri.Body.String(), `a<span class="ctrl" title="U+001B">␛</span>[0m`)
+
+	// ...while the raw diff is byte-exact.
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", loc+".diff", nil)
+	r.ServeHTTP(wri, req)
+	assert.Contains(t, wri.Body.String(), "-\ufeffa\n+a\x1b[0m\n")
+}
+
+func TestContextValidation(t *testing.T) {
+	r := newServer(t).Router()
+
+	rd, header := multipartFiles("red@a.txt", "a\nb\nc\nd\ne\n", "green@a.txt", "a\nb\nC\nd\ne\n")
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	loc := wri.Header().Get("Location")
+
+	get := func(p, accept string) *httptest.ResponseRecorder {
+		wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", p, nil)
+		req.Header.Set("Accept", accept)
+		r.ServeHTTP(wri, req)
+		return wri
+	}
+	for _, tc := range []struct{ c, err string }{
+		{"abc", `invalid context "abc"`},
+		{"99999", "invalid context 99999: must be between 0 and 1000"},
+		{"-1", "invalid context -1"},
+	} {
+		// API clients get an error...
+		wri := get(loc+"?c="+tc.c, "application/json")
+		assert.Equal(t, http.StatusBadRequest, wri.Code, tc.c)
+		assert.Contains(t, wri.Body.String(), "error: "+tc.err, tc.c)
+		wri = get(loc+".json?c="+tc.c, "")
+		assert.Equal(t, http.StatusBadRequest, wri.Code, tc.c)
+		wri = get(loc+"/stat?c="+tc.c, "")
+		assert.Equal(t, http.StatusBadRequest, wri.Code, tc.c)
+		wri = get(loc+"/ranges.json?c="+tc.c, "")
+		assert.Equal(t, http.StatusBadRequest, wri.Code, tc.c)
+
+		// ...while browsers get the default or the clamped context.
+		wri = get(loc+"?c="+tc.c, "text/html")
+		assert.Equal(t, http.StatusOK, wri.Code, tc.c)
+		assert.Contains(t, wri.Body.String(), `class="diff`, tc.c)
+	}
+	assert.Equal(t, http.StatusOK, get(loc+"?c=10", "application/json").Code)
+	assert.Equal(t, http.StatusOK, get(loc+"?c=full", "application/json").Code)
+
+	// POST /diff validates it as well.
+	rd, header = multipartFiles("red@a.txt", "a\n", "green@a.txt", "b\n")
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/diff?c=abc", rd)
+	req.Header.Set("Content-Type", header)
+	req.Header.Set("Accept", "application/json")
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusBadRequest, wri.Code)
 }
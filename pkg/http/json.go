@@ -0,0 +1,177 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thehowl/diffy/pkg/diff"
+)
+
+const ctJSON = "application/json"
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, v any) error {
+	return writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus is like writeJSON, responding with the given status code.
+func writeJSONStatus(w http.ResponseWriter, code int, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	w.Header().Set(ctHeader, ctJSON)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	return err
+}
+
+// jsonUpload is the JSON response to an upload.
+type jsonUpload struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is omitted for diffs which do not expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// jsonRaw is the JSON response of /{id}/raw: the uploaded files, so that
+// clients can compute the diff themselves.
+type jsonRaw struct {
+	ID string `json:"id"`
+	// CreatedAt is omitted for the example.
+	CreatedAt *time.Time    `json:"created_at,omitempty"`
+	Files     []jsonRawFile `json:"files"`
+}
+
+type jsonRawFile struct {
+	Name string `json:"name"`
+	// Content is encoded in base64, as the files may not be valid UTF-8.
+	Content []byte `json:"content"`
+	Ref     string `json:"ref,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	DevNull bool   `json:"dev_null,omitempty"`
+}
+
+// jsonDiff is the JSON representation of a [diff.Unified].
+type jsonDiff struct {
+	OldName string `json:"old_name"`
+	NewName string `json:"new_name"`
+	OldMode string `json:"old_mode,omitempty"`
+	NewMode string `json:"new_mode,omitempty"`
+	// NewFile and DeletedFile are set if the old or the new file is
+	// /dev/null.
+	NewFile     bool       `json:"new_file,omitempty"`
+	DeletedFile bool       `json:"deleted_file,omitempty"`
+	Hunks       []jsonHunk `json:"hunks"`
+}
+
+type jsonHunk struct {
+	LineOld  int        `json:"line_old"`
+	CountOld int        `json:"count_old"`
+	LineNew  int        `json:"line_new"`
+	CountNew int        `json:"count_new"`
+	Lines    []jsonLine `json:"lines"`
+	// SplitPaddings are the empty rows to add to align the two sides of
+	// the split view; see jsonPaddings.
+	SplitPaddings jsonPaddings `json:"split_paddings"`
+}
+
+// jsonPaddings is the JSON representation of [diff.Hunk.SplitViewPaddings].
+// Each entry maps the index of a line in the hunk to the number of empty rows
+// to add after it, on the red (old) or green (new) side of the split view,
+// where inserted or deleted lines are only shown on one side.
+type jsonPaddings struct {
+	Red   map[int]int `json:"red"`
+	Green map[int]int `json:"green"`
+}
+
+type jsonLine struct {
+	Type string `json:"type"`
+	// Line numbers in the old and new file; omitted if the line is not
+	// present in the given file.
+	Old     int    `json:"old,omitempty"`
+	New     int    `json:"new,omitempty"`
+	Content string `json:"content"`
+	// Normalized is set, with ?w=show, on equal lines which only compare
+	// equal once normalized; see [diff.HunkLine.Normalized]. Content is then
+	// the line of the old file, and NewContent the one of the new file.
+	Normalized bool   `json:"normalized,omitempty"`
+	NewContent string `json:"new_content,omitempty"`
+}
+
+func newJSONDiff(u diff.Unified) jsonDiff {
+	jd := jsonDiff{
+		OldName:     u.OldName,
+		NewName:     u.NewName,
+		OldMode:     u.OldMode,
+		NewMode:     u.NewMode,
+		NewFile:     u.OldDevNull,
+		DeletedFile: u.NewDevNull,
+		Hunks:       make([]jsonHunk, 0, len(u.Hunks)),
+	}
+	for _, h := range u.Hunks {
+		jh := jsonHunk{
+			LineOld:  h.LineOld,
+			CountOld: h.CountOld,
+			LineNew:  h.LineNew,
+			CountNew: h.CountNew,
+			Lines:    make([]jsonLine, 0, len(h.Lines)),
+			// the maps are never nil, so they are always objects.
+			SplitPaddings: jsonPaddings(h.SplitViewPaddings()),
+		}
+		for _, l := range h.Lines {
+			jl := jsonLine{
+				Type:       l.Type(),
+				Old:        max(l.NumberX, 0),
+				New:        max(l.NumberY, 0),
+				Content:    l.Content(),
+				Normalized: l.Normalized,
+			}
+			if l.Normalized {
+				jl.NewContent = l.NewContent()
+			}
+			jh.Lines = append(jh.Lines, jl)
+		}
+		jd.Hunks = append(jd.Hunks, jh)
+	}
+	return jd
+}
+
+// jsonStat is the response of the /{id}/stat endpoint.
+type jsonStat struct {
+	Files        []jsonFileStat `json:"files"`
+	TotalAdded   int            `json:"total_added"`
+	TotalDeleted int            `json:"total_deleted"`
+	// Size of the stored archive, in bytes.
+	Size uint64 `json:"size,omitempty"`
+}
+
+type jsonFileStat struct {
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	Added   int    `json:"added"`
+	Deleted int    `json:"deleted"`
+}
+
+// jsonRanges is the response of the /{id}/ranges.json endpoint.
+type jsonRanges struct {
+	Files []jsonFileRanges `json:"files"`
+}
+
+type jsonFileRanges struct {
+	Old    string      `json:"old"`
+	New    string      `json:"new"`
+	Ranges []jsonRange `json:"ranges"`
+}
+
+// jsonRange is a [diff.Range]: the lines from start to end excluded of the
+// new file. If they are equal, lines were deleted before start.
+type jsonRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
@@ -0,0 +1,85 @@
+package http
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thehowl/diffy/pkg/i18n"
+)
+
+// maxDiffsMinute is the maximum number of calls to POST /diff for each IP, per
+// minute. As nothing is stored, this is much lighter than the upload limits.
+const maxDiffsMinute = 60
+
+// postDiff computes the diff of the uploaded files, and writes it in the
+// response, without storing it.
+func (s *Server) postDiff(w http.ResponseWriter, r *http.Request) error {
+	if !s.DisableRateLimit && !s.diffThrottle.allow(r.RemoteAddr, maxDiffsMinute, time.Minute, time.Now()) {
+		lang := s.lang(w, r)
+		w.Header().Set(ctHeader, ctPlain)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(i18n.T(lang, "limit exceeded; retry in a minute") + "\n"))
+		return nil
+	}
+
+	arc, err := s.readUpload(w, r)
+	if arc == nil || err != nil {
+		return err
+	}
+	files, err := readArchive(arc, s.MaxArchiveSize)
+	if err != nil {
+		return err
+	}
+
+	qry := r.URL.Query()
+	format := qry.Get("format")
+	if format == "" {
+		format = s.clientFormat(w, r)
+	}
+	dq := parseDiffQuery(qry, files)
+	if err := dq.check(format); err != nil {
+		return err
+	}
+	unif, err := s.diffQuery(r.Context(), files, dq)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case formatJSON:
+		return writeJSON(w, newJSONDiff(unif))
+	case formatPatch:
+		writePlain(w, []byte(unif.GitPatch()))
+	default:
+		// there is no page to show the diff without storing it.
+		writePlain(w, []byte(unif.String()))
+	}
+	return nil
+}
+
+// throttle limits the number of calls of each client in fixed windows of
+// time. The zero value is ready to use.
+type throttle struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// allow counts a call by name at the time now, and reports whether name made
+// at most max calls in the current window.
+func (t *throttle) allow(name string, max int, window time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts == nil || now.Sub(t.start) >= window {
+		// start a new window, discarding the old counts.
+		t.start = now
+		t.counts = make(map[string]int)
+	}
+	if t.counts[name] >= max {
+		return false
+	}
+	t.counts[name]++
+	return true
+}
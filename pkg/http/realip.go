@@ -0,0 +1,72 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// realIP is a middleware which sets r.RemoteAddr to the IP address of the
+// client, stripping the port.
+//
+// Forwarding headers (X-Real-IP, X-Forwarded-For) are only considered if the
+// direct peer is one of s.TrustedProxies; otherwise, clients could spoof their
+// address to evade the rate limiter.
+func (s *Server) realIP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.RemoteAddr
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if s.isTrustedProxy(host) {
+			host = s.forwardedIP(r.Header, host)
+		}
+		r.RemoteAddr = host
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, pfx := range s.TrustedProxies {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedIP returns the client IP address as specified in the forwarding
+// headers, or def if they are not present or invalid.
+func (s *Server) forwardedIP(hdr http.Header, def string) string {
+	if xrip := strings.TrimSpace(hdr.Get("X-Real-IP")); xrip != "" {
+		if _, err := netip.ParseAddr(xrip); err == nil {
+			return xrip
+		}
+		return def
+	}
+
+	// X-Forwarded-For is a list of addresses, where each proxy appends the
+	// address of its peer. Walk it backwards, skipping our trusted proxies:
+	// the first untrusted address is the client.
+	var xff []string
+	for _, v := range hdr.Values("X-Forwarded-For") {
+		xff = append(xff, strings.Split(v, ",")...)
+	}
+	for i := len(xff) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(xff[i])
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return def
+		}
+		if !s.isTrustedProxy(ip) {
+			return ip
+		}
+		def = ip
+	}
+	return def
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}
+	tt := []struct {
+		name       string
+		trusted    []netip.Prefix
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"no_headers", nil, "171.81.83.116:1234", nil, "171.81.83.116"},
+		{"untrusted_xff", nil, "171.81.83.116:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "171.81.83.116"},
+		{"untrusted_xrip", nil, "171.81.83.116:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "171.81.83.116"},
+		{"untrusted_peer", trusted, "171.81.83.116:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "171.81.83.116"},
+		{"trusted_xff", trusted, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"trusted_xrip", trusted, "[::1]:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		// the client may prepend spoofed addresses; only the ones appended by
+		// trusted proxies should be considered.
+		{"trusted_xff_spoofed", trusted, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"trusted_xff_invalid", trusted, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "hello"}, "10.0.0.1"},
+		{"trusted_no_headers", trusted, "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{TrustedProxies: tc.trusted}
+			var got string
+			h := s.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -1,17 +1,25 @@
 package http
 
 import (
+	"context"
+	cr "crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/i18n"
 	"github.com/thehowl/diffy/pkg/storage"
 	"github.com/thehowl/diffy/static"
 	"github.com/thehowl/diffy/templates"
@@ -22,31 +30,171 @@ type Server struct {
 	Storage   storage.Storage
 	DB        *db.DB
 	Output    io.Writer
+	// TrustedProxies are the networks of the reverse proxies whose forwarding
+	// headers (X-Real-IP, X-Forwarded-For) are trusted to determine the
+	// client IP. If empty, the headers are ignored.
+	TrustedProxies []netip.Prefix
+	// MaxLines is the maximum number of lines of each uploaded file.
+	// If 0, there is no limit.
+	MaxLines int
+	// DefaultFormat is the format used to respond to clients which cannot be
+	// identified as either browsers or command line tools.
+	// It can be "html" or "plain" (the default).
+	DefaultFormat string
+	// ArchiveCodec is the compression used for newly stored archives:
+	// "gzip" (the default) or "zstd". Both are always supported for reading.
+	ArchiveCodec string
+	// Usage stores the usage statistics used to enforce the upload limits.
+	// If nil, they are stored in DB.
+	Usage db.UsageStore
+	// DisableRateLimit disables the weekly per-IP upload limits. When set,
+	// no usage statistics are recorded.
+	DisableRateLimit bool
+	// DedupeContentOnly determines the id of uploads only from the contents
+	// of the files, so that uploading the same contents with different names
+	// (or refs) returns the existing diff. By default, the whole archive is
+	// used.
+	DedupeContentOnly bool
+	// DisableExample disables the example diff, so that /example returns
+	// 404, and it is not linked from the index.
+	DisableExample bool
+	// ExampleAliases are additional ids serving the example diff, unless it
+	// is disabled.
+	ExampleAliases []string
+	// ReservedIDs are ids which are never served as diffs, nor accepted as
+	// example aliases, in addition to the names of the routes; see
+	// [Server.CheckExampleAliases].
+	ReservedIDs []string
+	// CompareURLs enables the compare_url upload field, with which the two
+	// versions of a file are fetched from a GitHub compare page.
+	CompareURLs bool
+	// HTTPClient is used to fetch the files of compare_url. If nil, a client
+	// with a timeout of 10 seconds, which does not follow redirects, is used.
+	HTTPClient *http.Client
+	// CSRFKey is the secret used to protect the form of the homepage from
+	// cross-site request forgery. If empty, a random key is generated by
+	// Router; instances behind the same domain must share it.
+	CSRFKey []byte
+	// MaxArchiveSize is the maximum size of the archives of the diffs once
+	// decompressed, in bytes. Larger archives, which could exhaust the
+	// memory, are not read. If 0, there is no limit.
+	MaxArchiveSize int64
+	// MaxTTL caps the ttl which can be set on upload, after which the diffs
+	// expire. If 0, ttls are not capped.
+	MaxTTL time.Duration
+	// VerifyWrites makes uploads read back the stored archives, failing if
+	// they differ from the written ones, so that corrupted diffs are not
+	// served later.
+	VerifyWrites bool
+	// MaxColumns is the default number of characters after which the lines
+	// of the HTML diff are truncated, unless set with ?maxcol=. If 0, lines
+	// are not truncated by default.
+	MaxColumns int
+	// IDCase is the case of the ids in the links returned on upload:
+	// "lower" (the default) or "upper". Ids are looked up regardless of
+	// their case.
+	IDCase string
+	// IDBytes is the number of bytes of the hash of the diffs used for their
+	// ids, from MinIDBytes to MaxIDBytes. Longer ids make collisions between
+	// different diffs less likely. If 0, DefaultIDBytes is used.
+	IDBytes int
+	// DiffTimeout is the maximum time spent computing each diff, shorter
+	// than the timeout of the whole request so that there is time left to
+	// respond. If 0, there is no limit.
+	DiffTimeout time.Duration
+	// MaxConcurrentUploads is the maximum number of uploads (to POST / and
+	// POST /diff) processed at the same time; the ones exceeding it are
+	// rejected with 503. If 0, there is no limit.
+	MaxConcurrentUploads int
+	// DisableHomepage makes GET / always return the usage, even to browsers,
+	// for instances only used through the API.
+	DisableHomepage bool
+	// HomepageRedirect, if set, is the URL to which browsers visiting the
+	// homepage are redirected, instead of showing it. Other clients still get
+	// the usage.
+	HomepageRedirect string
+	// ExtraCSSURL, if set, is the URL of a stylesheet added to the pages
+	// after the default one, to change their colors or fonts. It must be a
+	// path, or be on the origin of PublicURL or on one of ExtraCSSHosts; see
+	// [Server.CheckExtraCSS].
+	ExtraCSSURL string
+	// ExtraCSSHosts are the hosts, other than the one of PublicURL, from which
+	// ExtraCSSURL may be loaded over https.
+	ExtraCSSHosts []string
+
+	diffThrottle throttle
+	// uploads is the semaphore limiting the concurrent uploads.
+	uploads chan struct{}
 }
 
 func (s *Server) Router() chi.Router {
 	if s.Output == nil {
 		s.Output = os.Stdout
 	}
+	if s.MaxConcurrentUploads > 0 {
+		s.uploads = make(chan struct{}, s.MaxConcurrentUploads)
+	}
+	if len(s.CSRFKey) == 0 {
+		s.CSRFKey = make([]byte, 32)
+		cr.Read(s.CSRFKey)
+	}
 	rt := chi.NewRouter()
-	rt.Use(
-		middleware.RealIP,
-		middleware.RequestLogger(&middleware.DefaultLogFormatter{
-			Logger: log.New(s.Output, "", log.LstdFlags),
-		}),
-		middleware.Recoverer,
-		middleware.Timeout(time.Second*60),
-	)
-	rt.Get("/", s.index)
-	rt.Post("/", s.e(s.upload))
-	fs := http.FileServer(http.FS(static.FS))
-	rt.Get("/static/*", http.StripPrefix("/static/", fs).ServeHTTP)
-	rt.Get("/{id}", s.e(s.serveDiff))
-	rt.Get("/{id}/red", s.serveFile(0))
-	rt.Get("/{id}/green", s.serveFile(1))
+	// health checks are not logged, as they are frequent and uninteresting.
+	rt.Get("/healthz", s.healthz)
+	rt.Get("/readyz", s.readyz)
+	rt.Group(func(rt chi.Router) {
+		rt.Use(
+			s.realIP,
+			middleware.RequestLogger(&middleware.DefaultLogFormatter{
+				Logger: log.New(s.Output, "", log.LstdFlags),
+			}),
+			middleware.Recoverer,
+			middleware.Timeout(time.Second*60),
+		)
+		rt.Get("/", s.index)
+		// uptime monitors check the homepage with HEAD; net/http discards
+		// the body, keeping the headers of GET.
+		rt.Head("/", s.index)
+		rt.With(s.limitUploads).Post("/", s.e(s.upload))
+		rt.With(s.limitUploads).Post("/diff", s.e(s.postDiff))
+		fs := http.FileServer(http.FS(static.FS))
+		rt.Get("/static/*", http.StripPrefix("/static/", gzipStatic(static.FS, fs)).ServeHTTP)
+		rt.Get("/{id}", s.e(s.serveDiff))
+		rt.Get("/{id}/red", s.serveFile(0))
+		rt.Get("/{id}/green", s.serveFile(1))
+		rt.Get("/{id}/stat", s.e(s.serveStat))
+		rt.Get("/{id}/ranges.json", s.e(s.serveRanges))
+		rt.Get("/{id}/raw", s.e(s.serveRaw))
+	})
 	return rt
 }
 
+// healthz responds with 200 as long as the server is serving requests.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(ctHeader, ctPlain)
+	w.Write([]byte("ok\n"))
+}
+
+// readyz responds with 200 if the database and the storage are available,
+// and 503 otherwise.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	w.Header().Set(ctHeader, ctPlain)
+	if err := s.DB.Ping(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("db: " + err.Error() + "\n"))
+		return
+	}
+	if err := storage.Ping(ctx, s.Storage); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("storage: " + err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
 const (
 	ctHeader = "Content-Type"
 	ctPlain  = "text/plain; charset=utf-8"
@@ -54,44 +202,188 @@ const (
 
 var (
 	reBrowser = regexp.MustCompile("(?i)(?:chrome|firefox|safari|gecko)/")
+	reCLI     = regexp.MustCompile("(?i)^(?:curl|wget|httpie|xh)/")
 	errUsage  = errors.New("")
+	errGone   = errors.New("content unavailable")
+	// errDiffTimeout is returned when the diff takes longer than
+	// Server.DiffTimeout to compute.
+	errDiffTimeout = errors.New("diff timed out")
 )
 
-func (s *Server) usageString() []byte {
-	return []byte("usage: curl -F red=@before.txt -F green=@after.txt " + s.PublicURL + "\n")
+// usageError is an errUsage explaining what is wrong with the request. The
+// explanation is shown before the usage.
+type usageError string
+
+func (e usageError) Error() string        { return string(e) }
+func (e usageError) Is(target error) bool { return target == errUsage }
+
+func (s *Server) usageString(lang string) []byte {
+	return []byte(i18n.T(lang, "usage: curl -F red=@before.txt -F green=@after.txt %s", s.PublicURL) + "\n")
 }
 
-func isBrowser(r *http.Request) bool {
-	ua := r.UserAgent()
-	return reBrowser.MatchString(ua)
+// lang returns the language of the response to r, chosen by ?lang= or by the
+// Accept-Language header. It must be called before writing the header.
+func (s *Server) lang(w http.ResponseWriter, r *http.Request) string {
+	addVary(w, "Accept-Language")
+	return i18n.Match(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+}
+
+// addVary adds the given request headers to the Vary header of the response,
+// unless they are already in it.
+func addVary(w http.ResponseWriter, headers ...string) {
+	var vary []string
+	for _, v := range w.Header().Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			vary = append(vary, strings.TrimSpace(h))
+		}
+	}
+	for _, h := range headers {
+		if !slices.ContainsFunc(vary, func(v string) bool { return strings.EqualFold(v, h) }) {
+			w.Header().Add("Vary", h)
+			vary = append(vary, h)
+		}
+	}
+}
+
+// Response formats.
+const (
+	formatHTML  = "html"
+	formatRaw   = "raw"
+	formatJSON  = "json"
+	formatPatch = "patch"
+)
+
+// clientFormat determines the format to respond with, depending on the
+// client. The Accept header is considered first, then the User-Agent;
+// if neither is decisive, s.DefaultFormat is used. As the response then
+// depends on both, they are added to its Vary header, so clientFormat must be
+// called before writing the header.
+func (s *Server) clientFormat(w http.ResponseWriter, r *http.Request) string {
+	addVary(w, "Accept", "User-Agent")
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, _ := strings.Cut(accept, ";")
+		switch strings.TrimSpace(mt) {
+		case "text/html":
+			return formatHTML
+		case "application/json":
+			return formatJSON
+		case "text/plain":
+			return formatRaw
+		}
+	}
+	switch ua := r.UserAgent(); {
+	case reBrowser.MatchString(ua):
+		return formatHTML
+	case reCLI.MatchString(ua):
+		return formatRaw
+	}
+	if s.DefaultFormat == "html" {
+		return formatHTML
+	}
+	return formatRaw
 }
 
 func (s *Server) index(w http.ResponseWriter, r *http.Request) {
-	if !isBrowser(r) {
+	if r.URL.Query().Has("check") {
+		s.e(s.check)(w, r)
+		return
+	}
+	lang := s.lang(w, r)
+	if s.DisableHomepage || s.clientFormat(w, r) != formatHTML {
 		w.Header().Set(ctHeader, ctPlain)
-		w.Write(s.usageString())
+		w.Write(s.usageString(lang))
+		return
+	}
+	if s.HomepageRedirect != "" {
+		http.Redirect(w, r, s.HomepageRedirect, http.StatusFound)
 		return
 	}
 	templates.Templates.ExecuteTemplate(
 		w,
 		"index.tmpl",
-		struct{ PublicURL string }{s.PublicURL},
+		struct {
+			PublicURL string
+			Example   bool
+			Lang      string
+			CSRFToken string
+			ExtraCSS  string
+		}{s.PublicURL, !s.DisableExample, lang, s.csrfToken(w, r), s.ExtraCSSURL},
 	)
 }
 
+// notFound writes a 404 response, rendering an HTML page if html is set.
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request, html bool) {
+	lang := s.lang(w, r)
+	if !html {
+		w.Header().Set(ctHeader, ctPlain)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(i18n.T(lang, "not found") + "\n"))
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+	templates.Templates.ExecuteTemplate(w, "404.tmpl", struct{ Lang, ExtraCSS string }{lang, s.ExtraCSSURL})
+}
+
+// CheckExtraCSS returns an error if s.ExtraCSSURL is set, but is neither a
+// path nor a URL on the origin of s.PublicURL or on one of s.ExtraCSSHosts,
+// so that pages cannot load stylesheets from arbitrary sites.
+func (s *Server) CheckExtraCSS() error {
+	if s.ExtraCSSURL == "" {
+		return nil
+	}
+	if strings.Contains(s.ExtraCSSURL, `\`) {
+		// browsers read backslashes as slashes: /\host is //host.
+		return fmt.Errorf("extra css url %q must not contain backslashes", s.ExtraCSSURL)
+	}
+	u, err := url.Parse(s.ExtraCSSURL)
+	if err != nil {
+		return fmt.Errorf("extra css url: %w", err)
+	}
+	if u.Scheme == "" && u.Host == "" &&
+		strings.HasPrefix(s.ExtraCSSURL, "/") && !strings.HasPrefix(s.ExtraCSSURL, "//") {
+		return nil
+	}
+	if pu, err := url.Parse(s.PublicURL); err == nil && u.Scheme == pu.Scheme && strings.EqualFold(u.Host, pu.Host) {
+		return nil
+	}
+	if u.Scheme == "https" && slices.ContainsFunc(s.ExtraCSSHosts, func(h string) bool {
+		return strings.EqualFold(h, u.Host)
+	}) {
+		return nil
+	}
+	return fmt.Errorf("extra css url %q must be a path, or be on the origin of the public url or on an allowed host", s.ExtraCSSURL)
+}
+
 func (s *Server) e(fn func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := fn(w, r)
 		if err != nil {
+			lang := s.lang(w, r)
 			if errors.Is(err, errUsage) {
 				w.WriteHeader(400)
-				w.Write(s.usageString())
+				var ue usageError
+				if errors.As(err, &ue) {
+					w.Write([]byte(i18n.T(lang, "error: %s", ue) + "\n"))
+				}
+				w.Write(s.usageString(lang))
+				return
+			}
+			if errors.Is(err, errGone) {
+				w.Header().Set(ctHeader, ctPlain)
+				w.WriteHeader(http.StatusGone)
+				w.Write([]byte(i18n.T(lang, "410 content unavailable") + "\n"))
+				return
+			}
+			if errors.Is(err, errDiffTimeout) {
+				w.Header().Set(ctHeader, ctPlain)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(i18n.T(lang, "503 the diff took too long to compute; try a different algorithm (?algo=)") + "\n"))
 				return
 			}
 			log.Printf("request error: %v", err)
 			// TODO: support error reporting (glitchtip)
 			w.WriteHeader(500)
-			w.Write([]byte("500 internal server error\n"))
+			w.Write([]byte(i18n.T(lang, "500 internal server error") + "\n"))
 		}
 	}
 }
@@ -5,109 +5,522 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/klauspost/compress/zstd"
+	"github.com/thehowl/cford32"
+	"github.com/thehowl/diffy/pkg/db"
 	"github.com/thehowl/diffy/pkg/diff"
 	"github.com/thehowl/diffy/templates"
+	"golang.org/x/text/unicode/norm"
 )
 
 func (s *Server) serveDiff(w http.ResponseWriter, r *http.Request) error {
-	// parse filename
+	// parse filename, and determine the format. In order of precedence:
+	// ?format, the extension, and then the client's Accept and User-Agent.
 	id := chi.URLParam(r, "id")
-	wantRaw := false
-	if strings.HasSuffix(id, ".diff") {
+	qry := r.URL.Query()
+	format := ""
+	switch {
+	case strings.HasSuffix(id, ".diff"):
 		id = id[:len(id)-len(".diff")]
-		wantRaw = true
-	} else if !isBrowser(r) {
-		wantRaw = true
+		format = formatRaw
+	case strings.HasSuffix(id, ".json"):
+		id = id[:len(id)-len(".json")]
+		format = formatJSON
+	case strings.HasSuffix(id, ".patch"):
+		id = id[:len(id)-len(".patch")]
+		format = formatPatch
+	case strings.HasSuffix(id, ".html"):
+		id = id[:len(id)-len(".html")]
+		format = formatHTML
+	}
+	switch f := qry.Get("format"); f {
+	case formatHTML, formatRaw, formatJSON, formatPatch:
+		format = f
+	}
+	// negotiated is set if the format was not explicitly requested.
+	negotiated := format == ""
+	if negotiated {
+		format = s.clientFormat(w, r)
 	}
 
-	files, err := s.getFiles(r.Context(), id)
+	files, dbFile, err := s.getFiles(r.Context(), id)
 	if err != nil {
 		return err
 	}
 	if len(files) == 0 {
-		w.Write([]byte("not found"))
-		w.WriteHeader(404)
+		s.notFound(w, r, format == formatHTML)
+		return nil
+	}
+	if notModified(w, r, dbFile.CreatedAt) {
 		return nil
 	}
 
-	qry := r.URL.Query()
-	opts := diff.Options{Context: 3}
-	space := qry.Get("w")
-	switch space {
-	case "w": // --ignore-all-space
-		opts.Normal = ignoreAllSpace
-	case "b": // --ignore-space-change
-		opts.Normal = ignoreSpaceChange
-	default:
-		space = ""
+	dq := parseDiffQuery(qry, files)
+	if err := dq.check(format); err != nil {
+		return err
 	}
-	opts.Context, err = strconv.Atoi(qry.Get("c"))
-	if err != nil {
-		opts.Context = 3
-	} else {
-		opts.Context = max(0, min(1000, opts.Context))
+	opts := dq.Options
+	if qry.Get("debug") == "anchors" {
+		return s.serveAnchors(w, r, files, opts)
 	}
 
-	unif := diff.DiffWithOptions(
-		files[0].Name, []byte(files[0].Content),
-		files[1].Name, []byte(files[1].Content),
-		opts,
-	)
+	unif, err := s.diffQuery(r.Context(), files, dq)
+	if err != nil {
+		return err
+	}
 
-	if wantRaw {
-		w.Header().Set(ctHeader, ctPlain)
-		w.Write([]byte(unif.String()))
+	switch format {
+	case formatRaw:
+		if len(unif.Hunks) == 0 && negotiated {
+			// like git, an explicitly requested raw diff is empty; but tell
+			// people using curl what is going on.
+			writePlain(w, []byte("files are identical\n"))
+			return nil
+		}
+		if qry.Has("numbered") {
+			writePlain(w, []byte(unif.NumberedString()))
+			return nil
+		}
+		writePlain(w, []byte(unif.String()))
+		return nil
+	case formatJSON:
+		return writeJSON(w, newJSONDiff(unif))
+	case formatPatch:
+		writePlain(w, []byte(unif.GitPatch()))
 		return nil
 	}
+	maxCol := s.MaxColumns
+	if n, err := strconv.Atoi(qry.Get("maxcol")); err == nil && n >= 0 {
+		maxCol = n
+	}
+	palette := qry.Get("palette")
+	if palette != "cb" {
+		palette = ""
+	}
+	var table []diff.TableRow
+	if dq.Mode == "csv" {
+		table = csvTable(files, dq.Delim, opts.Algorithm)
+	}
 	return templates.Templates.ExecuteTemplate(w, "file.tmpl", &templates.FileTemplateData{
-		ID:      id,
-		Diff:    unif,
-		Space:   space,
-		Context: opts.Context,
-		Split:   qry.Has("split"),
-		Query:   r.URL.Query(),
+		ID:       id,
+		Diff:     unif,
+		OldLines: oldLines(files, opts),
+		NewLines: newLines(files, opts),
+		Table:    table,
+		Space:    dq.Space,
+		Mode:     dq.Mode,
+		Unicode:  dq.Unicode,
+		Algo:     dq.Algo,
+		Context:  opts.Context,
+		Full:     dq.Full,
+		Block:    dq.Block,
+		OldRef:   files[0].Ref,
+		NewRef:   files[1].Ref,
+		Split:    qry.Has("split"),
+
+		CreatedAt:  dbFile.CreatedAt,
+		Size:       dbFile.Size,
+		Standalone: qry.Has("standalone"),
+		MaxColumns: maxCol,
+		Font:       qry.Get("font"),
+		Palette:    palette,
+		Query:      r.URL.Query(),
+		ExtraCSS:   s.ExtraCSSURL,
+		Lang:       s.lang(w, r),
 	})
 }
 
-func (s *Server) getFiles(ctx context.Context, id string) ([]diffFile, error) {
-	if id == "example" {
-		return exampleFiles, nil
+// serveStat serves the number of added and deleted lines in the diff, as JSON.
+func (s *Server) serveStat(w http.ResponseWriter, r *http.Request) error {
+	id := chi.URLParam(r, "id")
+	files, dbFile, err := s.getFiles(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		s.notFound(w, r, false)
+		return nil
+	}
+	if notModified(w, r, dbFile.CreatedAt) {
+		return nil
+	}
+
+	dq := parseDiffQuery(r.URL.Query(), files)
+	if err := dq.check(formatJSON); err != nil {
+		return err
 	}
+	unif, err := s.diffFiles(r.Context(), files, dq.Options)
+	if err != nil {
+		return err
+	}
+	st := unif.Stats()
+	return writeJSON(w, jsonStat{
+		Files: []jsonFileStat{{
+			Old:     unif.OldName,
+			New:     unif.NewName,
+			Added:   st.Added,
+			Deleted: st.Deleted,
+		}},
+		TotalAdded:   st.Added,
+		TotalDeleted: st.Deleted,
+		Size:         dbFile.Size,
+	})
+}
 
-	// determine whether file exists
-	f, err := s.DB.GetFile(id)
+// serveRanges returns the ranges of lines of the new file which were changed,
+// so that editors can highlight them in the file.
+func (s *Server) serveRanges(w http.ResponseWriter, r *http.Request) error {
+	id := chi.URLParam(r, "id")
+	files, dbFile, err := s.getFiles(r.Context(), id)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if f.IsZero() {
-		return nil, nil
+	if len(files) == 0 {
+		s.notFound(w, r, false)
+		return nil
+	}
+	if notModified(w, r, dbFile.CreatedAt) {
+		return nil
 	}
 
-	// get from storage
-	data, err := s.Storage.Get(ctx, id)
+	dq := parseDiffQuery(r.URL.Query(), files)
+	if err := dq.check(formatJSON); err != nil {
+		return err
+	}
+	unif, err := s.diffFiles(r.Context(), files, dq.Options)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	ranges := []jsonRange{}
+	for _, rg := range unif.ChangedRanges() {
+		ranges = append(ranges, jsonRange{Start: rg.Start, End: rg.End})
+	}
+	return writeJSON(w, jsonRanges{
+		Files: []jsonFileRanges{{
+			Old:    unif.OldName,
+			New:    unif.NewName,
+			Ranges: ranges,
+		}},
+	})
+}
 
-	// decode
-	files, err := tgzReadFiles(data)
+// diffFiles computes the diff of the first two files, including their
+// metadata. The computation is stopped when ctx is done, or after
+// s.DiffTimeout, in which case errDiffTimeout is returned.
+func (s *Server) diffFiles(ctx context.Context, files []DiffFile, opts diff.Options) (diff.Unified, error) {
+	if s.DiffTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, s.DiffTimeout, errDiffTimeout)
+		defer cancel()
+	}
+	unif, err := diff.DiffContext(
+		ctx,
+		files[0].Name, []byte(files[0].Content),
+		files[1].Name, []byte(files[1].Content),
+		opts,
+	)
 	if err != nil {
-		return nil, err
+		return unif, context.Cause(ctx)
 	}
-	if len(files) != 2 {
-		return nil, fmt.Errorf("expected 2 files got %d", len(files))
+	unif.OldMode, unif.NewMode = files[0].Mode, files[1].Mode
+	unif.OldDevNull, unif.NewDevNull = files[0].DevNull, files[1].DevNull
+	unif.OldLabel, unif.NewLabel = files[0].Ref, files[1].Ref
+	return unif, nil
+}
+
+// maxContext is the maximum number of lines of context which can be requested
+// with c.
+const maxContext = 1000
+
+// blockMaxContext is the maximum number of lines of context added before and
+// after each hunk with c=block.
+const blockMaxContext = 50
+
+// diffQuery is like diffFiles, using the settings of dq.
+func (s *Server) diffQuery(ctx context.Context, files []DiffFile, dq diffQuery) (diff.Unified, error) {
+	unif, err := s.diffFiles(ctx, files, dq.Options)
+	if err != nil || !dq.Block {
+		return unif, err
 	}
+	return diff.ExpandBlocks(unif, oldLines(files, dq.Options), blockMaxContext), nil
+}
 
-	return files, nil
+// oldLines returns the lines of the old file, as shown in the diff.
+func oldLines(files []DiffFile, opts diff.Options) []string {
+	return fileLines(files[0], opts)
+}
+
+// newLines returns the lines of the new file, as shown in the diff.
+func newLines(files []DiffFile, opts diff.Options) []string {
+	return fileLines(files[1], opts)
+}
+
+func fileLines(f DiffFile, opts diff.Options) []string {
+	b := []byte(f.Content)
+	if opts.PreProcess != nil {
+		b = opts.PreProcess(b)
+	}
+	return diff.SplitLines(b)
+}
+
+// serveAnchors serves the pairs of lines matched by the diff algorithm, to
+// debug unexpected diffs (?debug=anchors); see [diff.Options.DebugAnchors].
+func (s *Server) serveAnchors(w http.ResponseWriter, r *http.Request, files []DiffFile, opts diff.Options) error {
+	var anchors []diff.Anchor
+	opts.DebugAnchors = func(a []diff.Anchor) { anchors = a }
+	if _, err := s.diffFiles(r.Context(), files, opts); err != nil {
+		return err
+	}
+
+	old := []byte(files[0].Content)
+	if opts.PreProcess != nil {
+		old = opts.PreProcess(old)
+	}
+	lines := diff.SplitLines(old)
+	var b strings.Builder
+	for _, a := range anchors {
+		fmt.Fprintf(&b, "%d\t%d\t%s\n", a.Old, a.New, lines[a.Old-1])
+	}
+	writePlain(w, []byte(b.String()))
+	return nil
+}
+
+// diffQuery contains the diff settings parsed from the query string.
+type diffQuery struct {
+	Space   string // w query parameter
+	Unicode string // unicode query parameter
+	Mode    string // mode query parameter
+	Algo    string // algo query parameter
+	Delim   rune   // delim query parameter, for mode=csv
+	Full    bool   // c=full: show the whole file in a single hunk
+	Block   bool   // c=block: expand the context to the blocks around changes
+	Options diff.Options
+	// ContextErr is set if c is invalid; the default context is then used.
+	// It is only returned to API clients; see [diffQuery.check].
+	ContextErr error
+}
+
+// check returns dq.ContextErr if the diff is requested in the given format
+// by an API client, which should know about its mistakes; browsers are more
+// lenient.
+func (dq diffQuery) check(format string) error {
+	if format == formatJSON {
+		return dq.ContextErr
+	}
+	return nil
+}
+
+// parseDiffQuery parses the diff settings from qry. Invalid values are
+// ignored.
+func parseDiffQuery(qry url.Values, files []DiffFile) diffQuery {
+	dq := diffQuery{Options: diff.Options{Context: 3}}
+	opts := &dq.Options
+
+	dq.Space = qry.Get("w")
+	switch dq.Space {
+	case "w": // --ignore-all-space
+		opts.Normal = ignoreAllSpace
+	case "b": // --ignore-space-change
+		opts.Normal = ignoreSpaceChange
+	case "show":
+		// like -w, but the lines with whitespace changes are shown,
+		// marked; see diff.HunkLine.Normalized.
+		opts.Normal = ignoreAllSpace
+		opts.ShowNormalized = true
+	default:
+		dq.Space = ""
+	}
+	dq.Unicode = qry.Get("unicode")
+	switch dq.Unicode {
+	case "nfc":
+		opts.Normal = composeNormal(opts.Normal, norm.NFC.String)
+	default:
+		dq.Unicode = ""
+	}
+	dq.Mode = qry.Get("mode")
+	switch dq.Mode {
+	case "json":
+		// only canonicalize if both files are valid JSON; otherwise
+		// fall back to a text diff.
+		if json.Valid([]byte(files[0].Content)) && json.Valid([]byte(files[1].Content)) {
+			opts.PreProcess = canonicalJSON
+		}
+	case "csv":
+		// the files are parsed when rendering the table; see csvTable.
+		dq.Delim = csvDelim(qry.Get("delim"), files[0].Name)
+	case "interdiff":
+		// like json, only if both files are patches.
+		_, ok0 := parsePatch([]byte(files[0].Content))
+		_, ok1 := parsePatch([]byte(files[1].Content))
+		if ok0 && ok1 {
+			opts.PreProcess = canonicalPatch
+		}
+	default:
+		dq.Mode = ""
+	}
+	dq.Algo = qry.Get("algo")
+	switch dq.Algo {
+	case "myers":
+		opts.Algorithm = diff.Myers
+	default:
+		dq.Algo = ""
+	}
+	if qry.Get("c") == "full" {
+		// Using the number of lines of the longest file as context
+		// ensures that all unchanged lines are part of the same hunk.
+		dq.Full = true
+		opts.Context = 0
+		for _, f := range files[:2] {
+			b := []byte(f.Content)
+			if opts.PreProcess != nil {
+				b = opts.PreProcess(b)
+			}
+			opts.Context = max(opts.Context, len(diff.SplitLines(b)))
+		}
+		return dq
+	}
+	if qry.Get("c") == "block" {
+		// the context is added by diff.ExpandBlocks; see diffQuery.
+		dq.Block = true
+		opts.Context = 0
+		return dq
+	}
+	if qry.Get("c") == "" {
+		return dq
+	}
+	c, err := strconv.Atoi(qry.Get("c"))
+	switch {
+	case err != nil:
+		dq.ContextErr = usageError(fmt.Sprintf("invalid context %q: must be a number, full or block", qry.Get("c")))
+	case c < 0 || c > maxContext:
+		dq.ContextErr = usageError(fmt.Sprintf("invalid context %d: must be between 0 and %d", c, maxContext))
+		opts.Context = max(0, min(maxContext, c))
+	default:
+		opts.Context = c
+	}
+	return dq
+}
+
+// getFiles retrieves the files of the diff with the given id, together with
+// its database record. If the diff does not exist, files is empty.
+func (s *Server) getFiles(ctx context.Context, id string) ([]DiffFile, db.File, error) {
+	if s.isExample(id) {
+		return exampleFiles, db.File{}, nil
+	}
+	if s.isReserved(id) {
+		return nil, db.File{}, nil
+	}
+	return s.service().get(ctx, id)
+}
+
+// normalizeID returns the id in the form it is stored, so that ids can be
+// looked up regardless of their case. As in Crockford's base32, i and l are
+// read as 1, and o as 0. Invalid ids are returned unchanged.
+func normalizeID(id string) string {
+	if norm, ok := parseID(id); ok {
+		return norm
+	}
+	return id
+}
+
+// parseID returns the normalized form of id, and whether it is valid. Ids
+// which decode to valid ones but are not their encoding, like those of other
+// lengths or with other unused trailing bits, are invalid, so that each diff
+// has a single id.
+func parseID(id string) (string, bool) {
+	if !validIDLength(len(id)) {
+		return "", false
+	}
+	b, err := cford32.DecodeString(id)
+	if err != nil {
+		return "", false
+	}
+	norm := cford32.EncodeToStringLower(b)
+	return norm, norm == strings.Map(canonicalIDRune, id)
+}
+
+// canonicalIDRune maps r to the character it stands for in the ids.
+func canonicalIDRune(r rune) rune {
+	switch r = unicode.ToLower(r); r {
+	case 'i', 'l':
+		return '1'
+	case 'o':
+		return '0'
+	}
+	return r
+}
+
+// validIDLength reports whether n is the length of the ids of MinIDBytes to
+// MaxIDBytes bytes.
+func validIDLength(n int) bool {
+	for b := MinIDBytes; b <= MaxIDBytes; b++ {
+		if (b*8+4)/5 == n {
+			return true
+		}
+	}
+	return false
+}
+
+// validID reports whether id, as returned by normalizeID, can be the id of
+// an uploaded diff: MinIDBytes to MaxIDBytes bytes (5 by default), encoded
+// in lowercase Crockford base32. Ids of any of these lengths are served, so
+// that the ones generated before changing Server.IDBytes keep working.
+func validID(id string) bool {
+	norm, ok := parseID(id)
+	return ok && norm == id
+}
+
+// isExample reports whether id is the id of the example diff, or one of its
+// aliases.
+func (s *Server) isExample(id string) bool {
+	if s.DisableExample {
+		return false
+	}
+	return id == "example" || slices.Contains(s.ExampleAliases, id)
+}
+
+// reservedIDs are the ids which would collide with the routes of the server,
+// or of the files commonly requested by clients and crawlers.
+var reservedIDs = []string{
+	"example", "diff", "static", "healthz", "readyz", "metrics",
+	"favicon.ico", "robots.txt",
+}
+
+// isReserved reports whether id is one of reservedIDs or s.ReservedIDs,
+// regardless of its case.
+func (s *Server) isReserved(id string) bool {
+	eq := func(r string) bool { return strings.EqualFold(r, id) }
+	return slices.ContainsFunc(reservedIDs, eq) || slices.ContainsFunc(s.ReservedIDs, eq)
+}
+
+// CheckExampleAliases returns an error if any of s.ExampleAliases is reserved,
+// or has the form of the ids of uploaded diffs, which it would shadow.
+func (s *Server) CheckExampleAliases() error {
+	for _, alias := range s.ExampleAliases {
+		switch {
+		case s.isReserved(alias):
+			return fmt.Errorf("example alias %q is a reserved id", alias)
+		case validID(normalizeID(alias)):
+			return fmt.Errorf("example alias %q would shadow an uploaded diff", alias)
+		}
+	}
+	return nil
 }
 
 func ignoreAllSpace(s string) string {
@@ -132,11 +545,121 @@ func ignoreSpaceChange(s string) string {
 	return joined
 }
 
+// composeNormal returns a function applying the normalizers a, then b.
+// a may be nil.
+func composeNormal(a, b func(string) string) func(string) string {
+	if a == nil {
+		return b
+	}
+	return func(s string) string {
+		return b(a(s))
+	}
+}
+
 func isSpaceNotNewline(r rune) bool {
 	return unicode.IsSpace(r) && r != '\n'
 }
 
-var exampleFiles = []diffFile{
+// parsePatch parses the patch in b, returning false if it is not a valid
+// patch of at least one file.
+func parsePatch(b []byte) ([]diff.Unified, bool) {
+	files, err := diff.Parse(bytes.NewReader(b))
+	return files, err == nil && len(files) > 0
+}
+
+// canonicalPatch re-formats the patch in b for ?mode=interdiff, so that two
+// versions of a patch are compared hunk by hunk. Each hunk is written after
+// a line with the names of its files, without its line numbers, so that
+// moving a hunk is not a change, and a hunk added or removed in the new
+// version is shown whole. The lines outside of the hunks, like the index
+// lines and the commit message, are dropped.
+// If b is not a valid patch, it is returned as-is.
+func canonicalPatch(b []byte) []byte {
+	files, ok := parsePatch(b)
+	if !ok {
+		return b
+	}
+	var buf bytes.Buffer
+	for _, f := range files {
+		oldName, newName := f.OldName, f.NewName
+		if f.OldDevNull {
+			oldName = "/dev/null"
+		}
+		if f.NewDevNull {
+			newName = "/dev/null"
+		}
+		if f.ModeChanged() {
+			fmt.Fprintf(&buf, "mode %s %s: %s %s\n", oldName, newName, f.OldMode, f.NewMode)
+		}
+		for _, h := range f.Hunks {
+			fmt.Fprintf(&buf, "@@ %s %s @@\n", oldName, newName)
+			for _, l := range h.Lines {
+				buf.WriteString(l.Value)
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// canonicalJSON re-formats the JSON document in b, sorting the keys of objects
+// and indenting consistently, so that diffs only show semantic changes.
+// If b is not valid JSON, it is returned as-is.
+func canonicalJSON(b []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return b
+	}
+
+	// encoding/json marshals map keys in sorted order.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return b
+	}
+	return buf.Bytes()
+}
+
+// csvDelim returns the CSV delimiter given in the delim query parameter, which
+// may also be "tab". By default, it is a tab for .tsv files and a comma
+// otherwise.
+func csvDelim(param, fileName string) rune {
+	switch {
+	case param == "tab":
+		return '\t'
+	case utf8.RuneCountInString(param) == 1:
+		r, _ := utf8.DecodeRuneInString(param)
+		return r
+	case strings.HasSuffix(strings.ToLower(fileName), ".tsv"):
+		return '\t'
+	}
+	return ','
+}
+
+// csvTable parses both files as CSV, and returns the diff of their rows.
+// If either file is not valid CSV, it returns nil, so that the line diff is
+// shown instead.
+func csvTable(files []DiffFile, delim rune, algo diff.Algorithm) []diff.TableRow {
+	var tables [2][][]string
+	for i, f := range files[:2] {
+		rd := csv.NewReader(strings.NewReader(f.Content))
+		rd.Comma = delim
+		// rows may have different numbers of fields.
+		rd.FieldsPerRecord = -1
+		recs, err := rd.ReadAll()
+		if err != nil {
+			return nil
+		}
+		tables[i] = recs
+	}
+	return diff.DiffTable(tables[0], tables[1], algo)
+}
+
+var exampleFiles = []DiffFile{
 	{
 		Name: "main.go",
 		Content: `package main
@@ -180,19 +703,127 @@ func main() {
 	},
 }
 
-type diffFile struct {
+// DiffFile is one of the two files of a diff.
+type DiffFile struct {
 	Name    string
 	Content string
+	// Ref is an optional label of the file's revision, like a commit hash
+	// or branch name.
+	Ref string
+	// Mode is the git mode of the file, like "100755", if it was given at
+	// upload.
+	Mode string
+	// DevNull marks the file as nonexistent, so that the diff adds or
+	// deletes the other file as a whole. Its content is empty.
+	DevNull bool
 }
 
-func tgzReadFiles(data []byte) ([]diffFile, error) {
-	gzrd, err := gzip.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return nil, err
+// metaName is the name of the archive entry containing the diffMeta, stored
+// after the files of the diff.
+const metaName = ".diffy.json"
+
+// diffMeta is the optional metadata of an uploaded diff.
+type diffMeta struct {
+	RedRef       string `json:"red_ref,omitempty"`
+	GreenRef     string `json:"green_ref,omitempty"`
+	RedDevNull   bool   `json:"red_devnull,omitempty"`
+	GreenDevNull bool   `json:"green_devnull,omitempty"`
+}
+
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// zstdDecoderPool contains decoders which stream the archives, rather
+	// than decoding them in memory at once, so that their size can be
+	// limited while reading them.
+	zstdDecoderPool = sync.Pool{
+		New: func() any {
+			dec, err := zstd.NewReader(nil,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecodeBuffersBelow(0))
+			if err != nil {
+				panic(err)
+			}
+			return dec
+		},
+	}
+)
+
+// errArchiveTooLarge is returned by readArchive if the archive is larger
+// than the limit once decompressed.
+var errArchiveTooLarge = errors.New("archive is too large once decompressed")
+
+// limitedReader is like [io.LimitedReader], but returns errArchiveTooLarge
+// if the underlying reader has more than n bytes, instead of io.EOF.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// check whether there is more to read, without ever reading
+		// past the limit into p.
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		switch {
+		case n > 0:
+			return 0, errArchiveTooLarge
+		case err != nil:
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// readArchive reads the files in the given compressed tar archive. The
+// compression algorithm (gzip or zstd) is determined from its magic bytes.
+// The refs stored in the archive's metadata, if any, are set on the files.
+// The files are returned in the order of sides, as recorded in the entries.
+// If maxSize > 0 and the archive is larger than maxSize bytes once
+// decompressed, errArchiveTooLarge is returned. Archives with more than
+// maxArchiveFiles files, not counting the metadata, or with more than one
+// metadata entry are rejected.
+func readArchive(data []byte, maxSize int64) ([]DiffFile, error) {
+	var dec io.Reader
+	switch {
+	case bytes.HasPrefix(data, magicGzip):
+		gzrd, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gzrd.Close()
+		dec = gzrd
+	case bytes.HasPrefix(data, magicZstd):
+		zrd := zstdDecoderPool.Get().(*zstd.Decoder)
+		if err := zrd.Reset(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		defer func() {
+			zrd.Reset(nil)
+			zstdDecoderPool.Put(zrd)
+		}()
+		dec = zrd
+	default:
+		return nil, errors.New("unknown archive format")
+	}
+	if maxSize > 0 {
+		dec = &limitedReader{r: dec, n: maxSize}
 	}
 
-	var files []diffFile
-	rd := tar.NewReader(gzrd)
+	var (
+		files    []DiffFile
+		fileSide []int // index in sides, or -1 if not recorded
+		meta     *diffMeta
+	)
+	rd := tar.NewReader(dec)
 	for {
 		f, err := rd.Next()
 		if err != nil {
@@ -202,17 +833,56 @@ func tgzReadFiles(data []byte) ([]diffFile, error) {
 			return nil, err
 		}
 
+		isMeta := len(files) >= 2 && f.Name == metaName
+		switch {
+		case isMeta && meta != nil:
+			return nil, errors.New("archive has more than one metadata entry")
+		case !isMeta && len(files) == maxArchiveFiles:
+			// stop before reading the others, which could be many.
+			return nil, fmt.Errorf("archive has more than %d files", maxArchiveFiles)
+		}
 		data, err := io.ReadAll(rd)
 		if err != nil {
 			return nil, err
 		}
-		files = append(files, diffFile{Name: f.Name, Content: string(data)})
+		if isMeta {
+			meta = new(diffMeta)
+			if err := json.Unmarshal(data, meta); err != nil {
+				return nil, fmt.Errorf("decoding metadata: %w", err)
+			}
+			continue
+		}
+		df := DiffFile{Name: f.Name, Content: string(data)}
+		if f.Mode != defaultMode {
+			df.Mode = strconv.FormatInt(f.Mode, 8)
+		}
+		side := -1
+		if v, ok := f.PAXRecords[paxSide]; ok {
+			side = slices.Index(sides[:], v)
+			if side < 0 {
+				return nil, fmt.Errorf("entry %q has unknown side %q", f.Name, v)
+			}
+		}
+		files = append(files, df)
+		fileSide = append(fileSide, side)
 	}
 
-	if err := gzrd.Close(); err != nil {
-		return nil, err
+	if len(files) == 2 {
+		switch [2]int{fileSide[0], fileSide[1]} {
+		case [2]int{-1, -1}:
+			// created before the sides were recorded; use the order of
+			// the entries.
+		case [2]int{0, 1}:
+		case [2]int{1, 0}:
+			files[0], files[1] = files[1], files[0]
+		default:
+			return nil, fmt.Errorf("invalid sides of the archive entries: %v", fileSide)
+		}
+	}
+	if meta != nil {
+		files[0].Ref, files[1].Ref = meta.RedRef, meta.GreenRef
+		files[0].DevNull, files[1].DevNull = meta.RedDevNull, meta.GreenDevNull
 	}
-
 	return files, nil
 }
 
@@ -226,19 +896,83 @@ func (s *Server) _serveFile(w http.ResponseWriter, r *http.Request, idx int) err
 	// parse filename
 	id := chi.URLParam(r, "id")
 
-	files, err := s.getFiles(r.Context(), id)
+	files, dbFile, err := s.getFiles(r.Context(), id)
 	if err != nil {
 		return err
 	}
 	if len(files) == 0 {
-		w.WriteHeader(404)
-		w.Write([]byte("not found"))
+		s.notFound(w, r, s.clientFormat(w, r) == formatHTML)
 		return nil
 	}
 
+	// ServeContent handles Range and If-Modified-Since, and sets the
+	// Content-Length.
 	fn := files[idx]
 	w.Header().Set(ctHeader, ctPlain)
 	w.Header().Set("Content-Disposition", "inline; filename="+strconv.Quote(fn.Name))
-	w.Write([]byte(fn.Content))
+	http.ServeContent(w, r, fn.Name, dbFile.CreatedAt, strings.NewReader(fn.Content))
 	return nil
 }
+
+// serveRaw serves the two files of the diff, with their metadata, as JSON, so
+// that clients can get the exact uploaded files with one request.
+func (s *Server) serveRaw(w http.ResponseWriter, r *http.Request) error {
+	id := chi.URLParam(r, "id")
+	files, dbFile, err := s.getFiles(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		s.notFound(w, r, false)
+		return nil
+	}
+	if notModified(w, r, dbFile.CreatedAt) {
+		return nil
+	}
+
+	res := jsonRaw{ID: s.publicID(normalizeID(id)), Files: make([]jsonRawFile, len(files))}
+	if !dbFile.CreatedAt.IsZero() {
+		createdAt := dbFile.CreatedAt.UTC()
+		res.CreatedAt = &createdAt
+	}
+	for i, f := range files {
+		res.Files[i] = jsonRawFile{
+			Name:    f.Name,
+			Content: []byte(f.Content),
+			Ref:     f.Ref,
+			Mode:    f.Mode,
+			DevNull: f.DevNull,
+		}
+	}
+	return writeJSON(w, res)
+}
+
+// notModified sets the Last-Modified header of the response to modTime, the
+// creation time of a diff, and reports whether the client's copy is up to date
+// according to If-Modified-Since, in which case a 304 response is written.
+// As diffs are immutable, their responses only change with the format and the
+// language, so Accept and Accept-Language are added to the Vary header, and
+// caches do not serve a response to clients asking for another one.
+// If modTime is zero, as for the example, only the Vary header is set.
+func notModified(w http.ResponseWriter, r *http.Request, modTime time.Time) bool {
+	addVary(w, "Accept", "Accept-Language")
+	if modTime.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	// the header has a precision of one second.
+	if err != nil || modTime.Truncate(time.Second).After(ims) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writePlain writes b as the plain text body of the response, setting the
+// Content-Length.
+func writePlain(w http.ResponseWriter, b []byte) {
+	w.Header().Set(ctHeader, ctPlain)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,249 @@
+package http
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"time"
+
+	"github.com/thehowl/cford32"
+	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/storage"
+	"go.uber.org/multierr"
+)
+
+// Service creates and retrieves diffs, without going through HTTP. It is used
+// by the handlers of [Server], and can be used to embed diffy in other
+// programs.
+type Service struct {
+	DB      *db.DB
+	Storage storage.Storage
+	// MaxLines is the maximum number of lines of each file. If 0, there is
+	// no limit.
+	MaxLines int
+	// ArchiveCodec is the compression used for newly stored archives:
+	// "gzip" (the default) or "zstd".
+	ArchiveCodec string
+	// DedupeContentOnly determines the id of diffs only from the contents
+	// of the files; see [Server].
+	DedupeContentOnly bool
+	// MaxArchiveSize is the maximum size of the stored archives once
+	// decompressed, in bytes; see [Server]. If 0, there is no limit.
+	MaxArchiveSize int64
+	// IDBytes is the number of bytes of the hash used for the ids of the
+	// diffs; see [Server]. If 0, DefaultIDBytes is used.
+	IDBytes int
+	// VerifyWrites makes Create read back each stored archive, and delete it
+	// and fail if it differs from the written one; see [storage.Verify].
+	VerifyWrites bool
+}
+
+// service returns the [Service] using the settings of s.
+func (s *Server) service() *Service {
+	return &Service{
+		DB:                s.DB,
+		Storage:           s.Storage,
+		MaxLines:          s.MaxLines,
+		ArchiveCodec:      s.ArchiveCodec,
+		DedupeContentOnly: s.DedupeContentOnly,
+		MaxArchiveSize:    s.MaxArchiveSize,
+		VerifyWrites:      s.VerifyWrites,
+		IDBytes:           s.IDBytes,
+	}
+}
+
+// The range and default of the number of bytes of the hash of a diff used for
+// its id. 5 bytes are encoded in 8 characters.
+const (
+	MinIDBytes     = 4
+	MaxIDBytes     = 16
+	DefaultIDBytes = 5
+)
+
+// maxArchiveFiles is the maximum number of files of an upload or an archive:
+// diffs are always of two files, and only the metadata can follow them.
+const maxArchiveFiles = 2
+
+// NamedContent is a file to create a diff with [Service.Create].
+type NamedContent struct {
+	// Name is the name of the file. If empty, "red" or "green" is used.
+	Name    string
+	Content string
+}
+
+// ErrIdentical is returned by [Service.Create] if the files are identical, as
+// there is nothing to show.
+var ErrIdentical = errors.New("the files are identical")
+
+// Create stores the diff of red and green, and returns its id. Creating the
+// same diff again returns the same id. If either file has more than
+// sv.MaxLines lines, an error is returned.
+func (sv *Service) Create(ctx context.Context, red, green NamedContent) (string, error) {
+	// Build the same archive, and thus the same id, as an upload of the
+	// files as form values.
+	arc, err := archiveFromFormValues(&multipart.Form{Value: map[string][]string{
+		"red":        {red.Content},
+		"red_name":   {red.Name},
+		"green":      {green.Content},
+		"green_name": {green.Name},
+	}}, sv.MaxLines, sv.ArchiveCodec)
+	if err != nil {
+		return "", err
+	}
+	id, _, err := sv.create(ctx, arc, time.Time{}, nil)
+	return id, err
+}
+
+// create stores the diff in the given archive, returning its id and whether
+// it was stored by this call, rather than by a previous upload. If expiresAt
+// is not zero, the diff expires at that time, unless it already exists
+// without expiring or expiring later.
+// If the diff is new, beforeStore is called, if set, with the size of the
+// archive; if it returns an error, the diff is not stored and the error is
+// returned together with the id.
+func (sv *Service) create(ctx context.Context, arc []byte, expiresAt time.Time, beforeStore func(size int) error) (string, bool, error) {
+	files, err := readArchive(arc, sv.MaxArchiveSize)
+	if err != nil {
+		return "", false, err
+	}
+	if len(files) != 2 {
+		return "", false, usageError(fmt.Sprintf("expected 2 files, got %d", len(files)))
+	}
+	if files[0].Content == files[1].Content && files[0].Mode == files[1].Mode &&
+		files[0].DevNull == files[1].DevNull {
+		return "", false, ErrIdentical
+	}
+
+	// Determine name of object.
+	shaHash := sha256.Sum256(arc)
+	if sv.DedupeContentOnly {
+		shaHash = contentHash(files)
+	}
+	// Use the first bytes (40 bits by default) to generate human readable ID.
+	id := cford32.EncodeToStringLower(shaHash[:cmp.Or(sv.IDBytes, DefaultIDBytes)])
+
+	// Is this a reupload?
+	existing, err := sv.DB.GetFile(id)
+	if err != nil {
+		return id, false, err
+	}
+	// expired diffs which have not been deleted yet are stored again.
+	if !existing.IsZero() && !existing.Expired(time.Now()) {
+		if existing.ExpiresAt.IsZero() || (!expiresAt.IsZero() && !expiresAt.After(existing.ExpiresAt)) {
+			return id, false, nil
+		}
+		// the diff must now last longer.
+		existing.ExpiresAt = expiresAt
+		return id, false, sv.DB.PutFile(id, existing)
+	}
+
+	if beforeStore != nil {
+		if err := beforeStore(len(arc)); err != nil {
+			return id, false, err
+		}
+	}
+
+	// not a reupload, save to permanent storage & db.
+	err = sv.Storage.Put(ctx, id, arc)
+	if err != nil {
+		return id, false, err
+	}
+	if sv.VerifyWrites {
+		if err := storage.Verify(ctx, sv.Storage, id, arc); err != nil {
+			// don't leave a corrupted object behind.
+			return id, false, multierr.Combine(
+				fmt.Errorf("verifying %q: %w", id, err),
+				sv.Storage.Del(context.Background(), id),
+			)
+		}
+	}
+
+	// save file in database as well.
+	err = sv.DB.PutFile(id, db.File{
+		CreatedAt: time.Now(),
+		Sum:       hex.EncodeToString(shaHash[:]),
+		Size:      uint64(len(arc)),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		// background -> attempt to delete even if request is canceled
+		return id, false, multierr.Combine(
+			err,
+			sv.Storage.Del(context.Background(), id),
+		)
+	}
+	return id, true, nil
+}
+
+// Get retrieves the files of the diff with the given id, regardless of its
+// case. If the diff does not exist, no files are returned.
+func (sv *Service) Get(ctx context.Context, id string) ([]DiffFile, error) {
+	files, _, err := sv.get(ctx, id)
+	return files, err
+}
+
+// get is like Get, also returning the database record of the diff.
+func (sv *Service) get(ctx context.Context, id string) ([]DiffFile, db.File, error) {
+	id = normalizeID(id)
+	if !validID(id) {
+		// avoid hitting the db for ids which cannot exist.
+		return nil, db.File{}, nil
+	}
+
+	// determine whether file exists
+	f, err := sv.DB.GetFile(id)
+	if err != nil {
+		return nil, f, err
+	}
+	if f.IsZero() {
+		return nil, f, nil
+	}
+	if f.Expired(time.Now()) {
+		// until the janitor deletes it.
+		return nil, f, errGone
+	}
+
+	// get from storage
+	data, err := sv.Storage.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			// the db has a record, but the storage doesn't have the object:
+			// this is an inconsistency which should be looked into.
+			log.Printf("warning: %q exists in db but not in storage (orphaned record?)", id)
+			return nil, f, errGone
+		}
+		return nil, f, err
+	}
+
+	if f.Size == 0 {
+		// record created before sizes were stored; add it now, unless it
+		// has been deleted or stored again since reading it.
+		f.Size = uint64(len(data))
+		_, err := sv.DB.UpdateFile(id, func(cur *db.File) bool {
+			if cur.Size != 0 {
+				return false
+			}
+			cur.Size = f.Size
+			return true
+		})
+		if err != nil {
+			log.Printf("error updating size of %q: %v", id, err)
+		}
+	}
+
+	// decode
+	files, err := readArchive(data, sv.MaxArchiveSize)
+	if err != nil {
+		return nil, f, err
+	}
+	if len(files) != 2 {
+		return nil, f, fmt.Errorf("expected 2 files got %d", len(files))
+	}
+
+	return files, f, nil
+}
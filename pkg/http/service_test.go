@@ -0,0 +1,126 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thehowl/diffy/pkg/storage"
+)
+
+func TestService(t *testing.T) {
+	serv := newServer(t)
+	sv := serv.service()
+	ctx := context.Background()
+
+	id, err := sv.Create(ctx, NamedContent{"a.txt", "a\nb\n"}, NamedContent{"a.txt", "a\nc\n"})
+	require.NoError(t, err)
+	assert.True(t, validID(id), id)
+
+	// the same diff has the same id.
+	id2, err := sv.Create(ctx, NamedContent{"a.txt", "a\nb\n"}, NamedContent{"a.txt", "a\nc\n"})
+	require.NoError(t, err)
+	assert.Equal(t, id, id2)
+
+	for _, id := range []string{id, strings.ToUpper(id)} {
+		files, err := sv.Get(ctx, id)
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+		assert.Equal(t, DiffFile{Name: "a.txt", Content: "a\nb\n"}, files[0])
+		assert.Equal(t, DiffFile{Name: "a.txt", Content: "a\nc\n"}, files[1])
+	}
+
+	files, err := sv.Get(ctx, "abcdefgh")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	_, err = sv.Create(ctx, NamedContent{Content: "a\n"}, NamedContent{Content: "a\n"})
+	assert.ErrorIs(t, err, ErrIdentical)
+
+	sv.MaxLines = 1
+	_, err = sv.Create(ctx, NamedContent{Content: "a\nb\n"}, NamedContent{Content: "a\n"})
+	assert.ErrorIs(t, err, errTooManyLines)
+
+	// the diff is served like an uploaded one; uploading the same form values
+	// returns the same id.
+	r := serv.Router()
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/"+id+".diff", nil)
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, http.StatusOK, wri.Code)
+	assert.Contains(t, wri.Body.String(), "-b\n+c\n")
+
+	rd, header := multipartFiles("red_name", "a.txt", "red", "a\nb\n", "green_name", "a.txt", "green", "a\nc\n")
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("POST", "/", rd)
+	req.Header.Set("Content-Type", header)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, http.StatusFound, wri.Code, wri.Body.String())
+	assert.Equal(t, id, path.Base(wri.Header().Get("Location")))
+}
+
+func TestServiceIDBytes(t *testing.T) {
+	serv := newServer(t)
+	sv := serv.service()
+	ctx := context.Background()
+
+	id5, err := sv.Create(ctx, NamedContent{Content: "a\n"}, NamedContent{Content: "b\n"})
+	require.NoError(t, err)
+	assert.Len(t, id5, 8)
+
+	for n, length := range map[int]int{4: 7, 8: 13, 16: 26} {
+		sv.IDBytes = n
+		id, err := sv.Create(ctx, NamedContent{Content: "a\n"}, NamedContent{Content: strconv.Itoa(n) + "\n"})
+		require.NoError(t, err)
+		assert.Len(t, id, length, n)
+		assert.True(t, validID(id), n)
+		files, err := sv.Get(ctx, strings.ToUpper(id))
+		require.NoError(t, err, n)
+		assert.Len(t, files, 2, n)
+	}
+
+	// ids generated with another length are still served.
+	files, err := sv.Get(ctx, id5)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+// truncatingStorage stores only the first half of the objects, like a storage
+// failing silently in the middle of a write.
+type truncatingStorage struct {
+	storage.Storage
+}
+
+func (t truncatingStorage) Put(ctx context.Context, id string, data []byte) error {
+	return t.Storage.Put(ctx, id, data[:len(data)/2])
+}
+
+func TestServiceVerifyWrites(t *testing.T) {
+	serv := newServer(t)
+	serv.Storage = truncatingStorage{serv.Storage}
+	serv.VerifyWrites = true
+	sv := serv.service()
+	ctx := context.Background()
+
+	id, err := sv.Create(ctx, NamedContent{"a.txt", "a\nb\n"}, NamedContent{"a.txt", "a\nc\n"})
+	assert.ErrorIs(t, err, storage.ErrMismatch)
+
+	// neither the object nor the record are left behind.
+	_, err = serv.Storage.Get(ctx, id)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	has, err := serv.DB.HasFile(id)
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	// without verification, the corrupted diff is only noticed when reading
+	// it.
+	sv.VerifyWrites = false
+	_, err = sv.Create(ctx, NamedContent{"a.txt", "a\nb\n"}, NamedContent{"a.txt", "a\nc\n"})
+	require.NoError(t, err)
+	_, err = sv.Get(ctx, id)
+	assert.Error(t, err)
+}
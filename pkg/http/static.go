@@ -0,0 +1,73 @@
+package http
+
+import (
+	"bytes"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// gzipStatic serves the files of fsys using next, unless the client accepts
+// gzip: then, it serves a gzip-compressed version of the file. The files are
+// compressed once, when gzipStatic is called, rather than on each request.
+func gzipStatic(fsys fs.FS, next http.Handler) http.Handler {
+	compressed := make(map[string][]byte)
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil
+		}
+		var buf bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		gz.Write(b)
+		gz.Close()
+		// only worth it if it is actually smaller.
+		if buf.Len() < len(b) {
+			compressed[name] = buf.Bytes()
+		}
+		return nil
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addVary(w, "Accept-Encoding")
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		b, ok := compressed[name]
+		if !ok || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+			w.Header().Set(ctHeader, ct)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		// embedded files have no modification time.
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+	})
+}
+
+// acceptsGzip reports whether the given Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		enc, params, _ := strings.Cut(part, ";")
+		enc = strings.TrimSpace(enc)
+		if enc != "gzip" && enc != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thehowl/diffy/static"
+)
+
+func TestStaticGzip(t *testing.T) {
+	r := newServer(t).Router()
+	want, err := static.FS.ReadFile("style.css")
+	require.NoError(t, err)
+
+	wri, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/static/style.css", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	r.ServeHTTP(wri, req)
+	require.Equal(t, 200, wri.Code)
+	assert.Equal(t, "gzip", wri.Header().Get("Content-Encoding"))
+	assert.Equal(t, []string{"Accept-Encoding"}, wri.Header().Values("Vary"))
+	assert.Contains(t, wri.Header().Get("Content-Type"), "text/css")
+	gz, err := gzip.NewReader(wri.Body)
+	require.NoError(t, err)
+	have, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(have))
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/static/style.css", nil)
+	r.ServeHTTP(wri, req)
+	require.Equal(t, 200, wri.Code)
+	assert.Empty(t, wri.Header().Get("Content-Encoding"))
+	assert.Equal(t, []string{"Accept-Encoding"}, wri.Header().Values("Vary"))
+	assert.Equal(t, string(want), wri.Body.String())
+
+	wri, req = httptest.NewRecorder(), httptest.NewRequest("GET", "/static/nope.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(wri, req)
+	assert.Equal(t, 404, wri.Code)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"gzip;q=0":          false,
+		"br":                false,
+		"*":                 true,
+		"identity, *;q=0.5": true,
+	} {
+		assert.Equal(t, want, acceptsGzip(header), header)
+	}
+}
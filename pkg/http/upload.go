@@ -3,22 +3,24 @@ package http
 import (
 	"archive/tar"
 	"bytes"
-	"context"
 	"crypto/sha256"
-	"encoding/hex"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/klauspost/compress/gzip"
-	"github.com/thehowl/cford32"
+	"github.com/klauspost/compress/zstd"
 	"github.com/thehowl/diffy/pkg/db"
-	"go.uber.org/multierr"
+	"github.com/thehowl/diffy/pkg/i18n"
 )
 
 const (
@@ -29,197 +31,758 @@ const (
 	maxCallsWeek = 100           // max upload calls per week.
 )
 
-func (s *Server) upload(w http.ResponseWriter, r *http.Request) error {
-	// Read multipart form.
+// limitUploads limits the number of uploads processed at the same time to
+// s.MaxConcurrentUploads, as each of them can take several megabytes of
+// memory. Uploads exceeding it are rejected with 503.
+func (s *Server) limitUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.uploads == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case s.uploads <- struct{}{}:
+			defer func() { <-s.uploads }()
+			next.ServeHTTP(w, r)
+		default:
+			lang := s.lang(w, r)
+			w.Header().Set(ctHeader, ctPlain)
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(i18n.T(lang, "too many uploads in progress; retry in a few seconds") + "\n"))
+		}
+	})
+}
+
+// parseUpload parses the form of the upload r, whose body is limited to
+// maxBodySize. For tiny diffs, the files can also be sent as values of an
+// urlencoded form, or in the query string. If the body is invalid,
+// parseUpload writes the error response and returns nil. The caller must
+// remove the temporary files of r.MultipartForm.
+func (s *Server) parseUpload(w http.ResponseWriter, r *http.Request) *multipart.Form {
 	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
-	err := r.ParseMultipartForm(maxMultipartMemory)
+	var (
+		mf  *multipart.Form
+		err error
+	)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		err = r.ParseMultipartForm(maxMultipartMemory)
+		mf = r.MultipartForm
+	} else {
+		// r.Form contains both the query and the urlencoded body.
+		err = r.ParseForm()
+		mf = &multipart.Form{Value: r.Form}
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		// bodies of unknown length, like those sent with chunked encoding
+		// from a pipe, are only found to be too large while reading them.
+		lang := s.lang(w, r)
+		w.Header().Set(ctHeader, ctPlain)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(i18n.T(lang, "error: uploads may be at most %d bytes", tooLarge.Limit) + "\n"))
+		return nil
+	}
 	if err != nil {
+		lang := s.lang(w, r)
 		w.WriteHeader(400)
-		w.Write([]byte("error: " + err.Error() + "\n"))
-		w.Write(s.usageString())
+		w.Write([]byte(i18n.T(lang, "error: %s", err) + "\n"))
+		w.Write(s.usageString(lang))
 		return nil
 	}
-	defer r.MultipartForm.RemoveAll()
+	return mf
+}
 
-	var arc []byte
-	if len(r.MultipartForm.File) > 0 {
-		arc, err = archiveFromFormFiles(r.MultipartForm)
+// archiveUpload returns the files of the upload mf as an archive, fetching
+// them first if it has a compare_url. If the files have too many lines,
+// archiveUpload writes the error response and returns a nil archive.
+func (s *Server) archiveUpload(w http.ResponseWriter, r *http.Request, mf *multipart.Form) ([]byte, error) {
+	if err := s.readCompare(r.Context(), mf); err != nil {
+		return nil, err
+	}
+	var (
+		arc []byte
+		err error
+	)
+	if len(mf.File) > 0 {
+		arc, err = archiveFromFormFiles(mf, s.MaxLines, s.ArchiveCodec)
 	} else {
-		arc, err = archiveFromFormValues(r.MultipartForm)
+		arc, err = archiveFromFormValues(mf, s.MaxLines, s.ArchiveCodec)
 	}
 	if err != nil {
-		return err
+		if errors.Is(err, errTooManyLines) {
+			lang := s.lang(w, r)
+			w.Header().Set(ctHeader, ctPlain)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(i18n.T(lang, "error: files may have at most %d lines", s.MaxLines) + "\n"))
+			return nil, nil
+		}
+		return nil, err
 	}
+	return arc, nil
+}
 
-	// Buffer created and filled; let's store it.
-	// Determine name of object.
-	shaHash := sha256.Sum256(arc)
-	// Use first 5 bytes (40 bits) to generate human readable ID.
-	id := cford32.EncodeToStringLower(shaHash[:5])
-	link := s.PublicURL + "/" + id
-	output := func() {
-		w.Header().Set(ctHeader, ctPlain)
-		w.Header().Set("Location", link)
-		w.WriteHeader(http.StatusFound)
-		w.Write([]byte(link + "\n"))
+// readUpload parses the upload r and returns its files as an archive; see
+// parseUpload and archiveUpload. If the upload is invalid, readUpload writes
+// the error response and returns a nil archive.
+func (s *Server) readUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	mf := s.parseUpload(w, r)
+	if mf == nil {
+		return nil, nil
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
 	}
+	return s.archiveUpload(w, r, mf)
+}
 
-	// Is this a reupload?
-	has, err := s.DB.HasFile(id)
-	if err != nil {
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) error {
+	if done, err := s.uploadNotModified(w, r); done || err != nil {
 		return err
 	}
-	if has {
-		output()
+	// the form is checked before doing any work for it, like fetching the
+	// files of a compare_url.
+	mf := s.parseUpload(w, r)
+	if mf == nil {
+		return nil
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if !s.checkCSRF(r) {
+		lang := s.lang(w, r)
+		w.Header().Set(ctHeader, ctPlain)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(i18n.T(lang, "invalid form token; reload the page and submit again") + "\n"))
 		return nil
 	}
 
 	now := time.Now().UTC()
-	weekNum := (now.YearDay() - 1) / 7
-	err = s.DB.AddAmountsAndCompare(
-		r.RemoteAddr,
-		db.UsageStat{
-			Period:   fmt.Sprintf("%d/%d", now.Year(), weekNum),
-			NumBytes: uint64(len(arc)),
-			NumCalls: 1,
-		},
-		db.UploadLimits{
-			MaxBytes: maxBytesWeek,
-			MaxCalls: maxCallsWeek,
-		},
-	)
+	expiresAt, err := s.expiry(r.FormValue("ttl"), now)
 	if err != nil {
+		return err
+	}
+	weekNum := (now.YearDay() - 1) / 7
+	period := fmt.Sprintf("%d/%d", now.Year(), weekNum)
+	var checkUsage func(size int) error
+	if !s.DisableRateLimit {
+		var usage db.UsageStore = s.DB
+		if s.Usage != nil {
+			usage = s.Usage
+		}
+		// the usage is only added once the size of the archive is known,
+		// but clients which cannot upload anything more are rejected now:
+		// adding nothing fails if the stats are at the limits.
+		err := usage.AddAmountsAndCompare(
+			r.RemoteAddr,
+			db.UsageStat{Period: period},
+			db.UploadLimits{
+				MaxBytes: maxBytesWeek - 1,
+				MaxCalls: maxCallsWeek - 1,
+			},
+		)
 		if errors.Is(err, db.ErrLimitsExceeded) {
-			w.Header().Set(ctHeader, ctPlain)
-			w.WriteHeader(http.StatusTooManyRequests)
-			resetTime := time.Date(now.Year(), time.January, ((weekNum+1)*7)+1, 0, 0, 0, 0, time.UTC)
-			w.Write([]byte(fmt.Sprintf(
-				"limit exceeded; will reset on %s (in %s)\n",
-				resetTime.Format(time.RFC3339),
-				resetTime.Sub(now),
-			)))
+			s.limitExceeded(w, r, now, weekNum)
+			return nil
+		}
+		checkUsage = func(size int) error {
+			err := usage.AddAmountsAndCompare(
+				r.RemoteAddr,
+				db.UsageStat{
+					Period:   period,
+					NumBytes: uint64(size),
+					NumCalls: 1,
+				},
+				db.UploadLimits{
+					MaxBytes: maxBytesWeek,
+					MaxCalls: maxCallsWeek,
+				},
+			)
+			if errors.Is(err, db.ErrLimitsExceeded) {
+				return err
+			}
+			// other errors of the usage store do not prevent uploads.
 			return nil
 		}
 	}
 
-	// not a reupload, save to permanent storage & db.
-	err = s.Storage.Put(r.Context(), id, arc)
-	if err != nil {
+	arc, err := s.archiveUpload(w, r, mf)
+	if arc == nil || err != nil {
+		return err
+	}
+	id, created, err := s.service().create(r.Context(), arc, expiresAt, checkUsage)
+	switch {
+	case errors.Is(err, ErrIdentical):
+		// there is nothing to show for identical files; reject them.
+		lang := s.lang(w, r)
+		w.Header().Set(ctHeader, ctPlain)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(i18n.T(lang, "error: the files are identical") + "\n"))
+		return nil
+	case errors.Is(err, db.ErrLimitsExceeded):
+		s.limitExceeded(w, r, now, weekNum)
+		return nil
+	case err != nil:
 		return err
 	}
 
-	// save file in database as well.
-	err = s.DB.PutFile(id, db.File{
-		CreatedAt: time.Now(),
-		Sum:       hex.EncodeToString(shaHash[:]),
-	})
-	if err != nil {
-		// background -> attempt to delete even if request is canceled
-		return multierr.Combine(
-			err,
-			s.Storage.Del(context.Background(), id),
-		)
+	if s.clientFormat(w, r) == formatJSON {
+		// API clients get the details in the body, rather than a redirect
+		// which they would follow to the diff. Re-uploads did not create
+		// anything.
+		f, err := s.DB.GetFile(id)
+		if err != nil {
+			return err
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Location", s.link(id))
+		return writeJSONStatus(w, status, s.jsonUpload(id, f))
+	}
+	link := s.link(id)
+	w.Header().Set(ctHeader, ctPlain)
+	w.Header().Set("Location", link)
+	w.WriteHeader(http.StatusFound)
+	w.Write([]byte(link + "\n"))
+	return nil
+}
+
+// limitExceeded writes the response to uploads exceeding the weekly limits,
+// which reset at the end of the week weekNum of the year of now.
+func (s *Server) limitExceeded(w http.ResponseWriter, r *http.Request, now time.Time, weekNum int) {
+	lang := s.lang(w, r)
+	w.Header().Set(ctHeader, ctPlain)
+	w.WriteHeader(http.StatusTooManyRequests)
+	resetTime := time.Date(now.Year(), time.January, ((weekNum+1)*7)+1, 0, 0, 0, 0, time.UTC)
+	w.Write([]byte(i18n.T(
+		lang, "limit exceeded; will reset on %s (in %s)",
+		resetTime.Format(time.RFC3339),
+		resetTime.Sub(now),
+	) + "\n"))
+}
+
+// publicID returns id in s.IDCase.
+func (s *Server) publicID(id string) string {
+	if s.IDCase == "upper" {
+		return strings.ToUpper(id)
+	}
+	return id
+}
+
+// link returns the link to the diff with the given id.
+func (s *Server) link(id string) string {
+	return s.PublicURL + "/" + s.publicID(id)
+}
+
+// jsonUpload returns the JSON response describing the diff id, with record f.
+func (s *Server) jsonUpload(id string, f db.File) jsonUpload {
+	res := jsonUpload{
+		ID:        s.publicID(id),
+		URL:       s.link(id),
+		CreatedAt: f.CreatedAt.UTC(),
 	}
+	if !f.ExpiresAt.IsZero() {
+		expiresAt := f.ExpiresAt.UTC()
+		res.ExpiresAt = &expiresAt
+	}
+	return res
+}
 
-	output()
+// stored returns the normalized id and the record of the diff with the given
+// id, if it is stored and has not expired; otherwise, the record is zero.
+func (s *Server) stored(id string) (string, db.File, error) {
+	id = normalizeID(id)
+	if !validID(id) {
+		return id, db.File{}, nil
+	}
+	f, err := s.DB.GetFile(id)
+	if err != nil || f.Expired(time.Now()) {
+		return id, db.File{}, err
+	}
+	return id, f, nil
+}
+
+// uploadNotModified handles uploads with an If-None-Match header, listing the
+// ids of diffs the client may have uploaded before: if one of them is
+// stored, it responds 304 with its link in the Location header, without
+// reading the body. It returns false if the upload must go on.
+func (s *Server) uploadNotModified(w http.ResponseWriter, r *http.Request) (bool, error) {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+		if tag == "" {
+			continue
+		}
+		id, f, err := s.stored(tag)
+		if err != nil {
+			return false, err
+		}
+		if !f.IsZero() {
+			w.Header().Set("ETag", `"`+id+`"`)
+			w.Header().Set("Location", s.link(id))
+			w.WriteHeader(http.StatusNotModified)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// check handles GET /?check={id}, which lets clients find out whether a diff
+// they uploaded before is still stored, to avoid uploading it again. It
+// responds with its link, or 404.
+func (s *Server) check(w http.ResponseWriter, r *http.Request) error {
+	id, f, err := s.stored(r.URL.Query().Get("check"))
+	if err != nil {
+		return err
+	}
+	if f.IsZero() {
+		s.notFound(w, r, false)
+		return nil
+	}
+	w.Header().Set("ETag", `"`+id+`"`)
+	if s.clientFormat(w, r) == formatJSON {
+		return writeJSONStatus(w, http.StatusOK, s.jsonUpload(id, f))
+	}
+	w.Header().Set(ctHeader, ctPlain)
+	w.Write([]byte(s.link(id) + "\n"))
 	return nil
 }
 
-var gzipWriterPool = sync.Pool{
-	New: func() any {
-		return &gzip.Writer{}
-	},
+// expiry returns the expiry time of a diff uploaded at now with the given ttl
+// form value, like "24h", capped to s.MaxTTL. It is zero if ttl is empty.
+func (s *Server) expiry(ttl string, now time.Time) (time.Time, error) {
+	if ttl == "" {
+		return time.Time{}, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return time.Time{}, usageError("ttl must be a positive duration, like 24h")
+	}
+	if s.MaxTTL > 0 {
+		d = min(d, s.MaxTTL)
+	}
+	return now.Add(d), nil
+}
+
+// contentHash returns a hash of the contents of files, ignoring their names
+// and any other metadata.
+func contentHash(files []DiffFile) [sha256.Size]byte {
+	h := sha256.New()
+	for _, f := range files {
+		// prefix each file with its length, so that moving bytes from one
+		// file to the other changes the hash.
+		var ln [8]byte
+		binary.BigEndian.PutUint64(ln[:], uint64(len(f.Content)))
+		h.Write(ln[:])
+		h.Write([]byte(f.Content))
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Supported codecs for the compression of the stored archives.
+const (
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+)
+
+// archiveGzipLevel is the compression level of the stored archives.
+// Uploads are small and stored permanently, so trading CPU for a better ratio
+// is worth it; see BenchmarkArchiveGzipLevel.
+const archiveGzipLevel = gzip.BestCompression
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() any {
+			gz, err := gzip.NewWriterLevel(nil, archiveGzipLevel)
+			if err != nil {
+				panic(err)
+			}
+			return gz
+		},
+	}
+	zstdEncoderPool = sync.Pool{
+		New: func() any {
+			enc, err := zstd.NewWriter(nil,
+				zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+				zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				panic(err)
+			}
+			return enc
+		},
+	}
+)
+
+// gzipUnknownOS is the value of the OS field of the gzip header for an
+// unknown operating system (RFC 1952).
+const gzipUnknownOS = 255
+
+// archiveModTime is the modification time of the files in the archives.
+// The archives must be deterministic, as their ids are derived from their
+// contents; hence, the actual time of upload is not used.
+var archiveModTime = time.Unix(0, 0)
+
+// archiveCompressor returns a writer compressing to dst using the given codec,
+// or an error if the codec is unknown. The returned release function must be called once the writer is no longer
+// used; the writer must not be used afterwards.
+//
+// The writers are reset when they are taken from the pool, and again when
+// they are returned to it, so that pooled writers never hold a reference to
+// dst, even if they were not closed because of an error.
+func archiveCompressor(dst io.Writer, codec string) (wc io.WriteCloser, release func(), err error) {
+	switch codec {
+	case codecZstd:
+		enc := zstdEncoderPool.Get().(*zstd.Encoder)
+		enc.Reset(dst)
+		return enc, func() {
+			enc.Reset(io.Discard)
+			zstdEncoderPool.Put(enc)
+		}, nil
+	case codecGzip, "":
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		gz.Reset(dst)
+		// The zero ModTime is not written as 0 in the header, but as the
+		// truncated unix timestamp of year 1; set it explicitly.
+		gz.Header = gzip.Header{ModTime: archiveModTime, OS: gzipUnknownOS}
+		return gz, func() {
+			gz.Reset(io.Discard)
+			gzipWriterPool.Put(gz)
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown archive codec %q", codec)
+	}
 }
 
-func archiveFromFormFiles(mf *multipart.Form) ([]byte, error) {
+var errTooManyLines = errors.New("too many lines")
+
+func archiveFromFormFiles(mf *multipart.Form, maxLines int, codec string) ([]byte, error) {
+	devNull, err := formDevNull(mf)
+	if err != nil {
+		return nil, err
+	}
 	// Get red/green files, and ensure they've been POST'ed correctly.
-	redS, greenS := mf.File["red"], mf.File["green"]
-	if len(redS) != 1 || len(greenS) != 1 {
-		return nil, errUsage
+	// A file marked as /dev/null may be omitted.
+	if len(mf.File["red"]) > 1 || len(mf.File["green"]) > 1 {
+		return nil, usageError(fmt.Sprintf(
+			"expected exactly one 'red' and one 'green' file, got %d red, %d green",
+			len(mf.File["red"]), len(mf.File["green"])))
+	}
+	// the files of other fields are not archived, but still count.
+	nfiles := 0
+	for _, fhs := range mf.File {
+		nfiles += len(fhs)
+	}
+	if nfiles > maxArchiveFiles {
+		return nil, usageError(fmt.Sprintf("uploads may have at most %d files, got %d", maxArchiveFiles, nfiles))
+	}
+	var files [2]*multipart.FileHeader
+	for i, key := range [...]string{"red", "green"} {
+		switch fhs := mf.File[key]; {
+		case len(fhs) == 1:
+			if devNull[i] && fhs[0].Size > 0 {
+				return nil, errUsage
+			}
+			files[i] = fhs[0]
+		case len(fhs) == 0 && devNull[i]:
+		default:
+			return nil, errUsage
+		}
+	}
+	modes, err := formModes(mf)
+	if err != nil {
+		return nil, err
 	}
-	red, green := redS[0], greenS[0]
 
-	// Create tar.gz writter + buffer.
+	// Create compressed tar writer + buffer.
 	var buf bytes.Buffer
-	gz := gzipWriterPool.Get().(*gzip.Writer)
-	gz.Reset(&buf)
-	defer func() {
-		gzipWriterPool.Put(gz)
-	}()
-	tw := tar.NewWriter(gz)
+	cw, release, err := archiveCompressor(&buf, codec)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tw := tar.NewWriter(cw)
 
 	// Encode multipart files.
-	for _, f := range [...]*multipart.FileHeader{red, green} {
+	for i, f := range files {
+		if f == nil {
+			// omitted /dev/null; name it like the other file.
+			name := files[1-i].Filename
+			if err := tarWriteMultipart(tw, i, name, modes[i], 0, strings.NewReader(""), maxLines); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		r, err := f.Open()
 		if err != nil {
 			return nil, err
 		}
 		defer r.Close()
-		if err := tarWriteMultipart(tw, f.Filename, f.Size, r); err != nil {
+		if err := tarWriteMultipart(tw, i, f.Filename, modes[i], f.Size, r, maxLines); err != nil {
 			return nil, err
 		}
 	}
+	if err := tarWriteMeta(tw, mf); err != nil {
+		return nil, err
+	}
 
 	if err := tw.Close(); err != nil {
 		return nil, err
 	}
-	if err := gz.Close(); err != nil {
+	if err := cw.Close(); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func archiveFromFormValues(mf *multipart.Form) ([]byte, error) {
+func archiveFromFormValues(mf *multipart.Form, maxLines int, codec string) ([]byte, error) {
 	withDefault := func(s []string, def string) string {
 		if len(s) == 0 || s[0] == "" {
 			return def
 		}
 		return s[0]
 	}
+	devNull, err := formDevNull(mf)
+	if err != nil {
+		return nil, err
+	}
 	var (
 		redFile   = mf.Value["red"]
 		greenFile = mf.Value["green"]
 		redName   = withDefault(mf.Value["red_name"], "red")
 		greenName = withDefault(mf.Value["green_name"], "green")
 	)
+	// A file marked as /dev/null may be omitted, and is named like the
+	// other file.
+	switch {
+	case devNull[0]:
+		redFile = withEmpty(redFile)
+		redName = withDefault(mf.Value["red_name"], greenName)
+	case devNull[1]:
+		greenFile = withEmpty(greenFile)
+		greenName = withDefault(mf.Value["green_name"], redName)
+	}
 	if len(redFile) != 1 || len(greenFile) != 1 {
 		return nil, errUsage
 	}
+	if devNull[0] && redFile[0] != "" || devNull[1] && greenFile[0] != "" {
+		return nil, errUsage
+	}
+	modes, err := formModes(mf)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create tar.gz writter + buffer.
+	// Create compressed tar writer + buffer.
 	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	tw := tar.NewWriter(gz)
+	cw, release, err := archiveCompressor(&buf, codec)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tw := tar.NewWriter(cw)
 
 	// Encode multipart files.
-	if err := tarWriteMultipart(tw, redName, int64(len(redFile[0])), strings.NewReader(redFile[0])); err != nil {
+	if err := tarWriteMultipart(tw, 0, redName, modes[0], int64(len(redFile[0])), strings.NewReader(redFile[0]), maxLines); err != nil {
 		return nil, err
 	}
-	if err := tarWriteMultipart(tw, greenName, int64(len(greenFile[0])), strings.NewReader(greenFile[0])); err != nil {
+	if err := tarWriteMultipart(tw, 1, greenName, modes[1], int64(len(greenFile[0])), strings.NewReader(greenFile[0]), maxLines); err != nil {
+		return nil, err
+	}
+	if err := tarWriteMeta(tw, mf); err != nil {
 		return nil, err
 	}
 
 	if err := tw.Close(); err != nil {
 		return nil, err
 	}
-	if err := gz.Close(); err != nil {
+	if err := cw.Close(); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func tarWriteMultipart(tw *tar.Writer, name string, size int64, r io.Reader) error {
+// defaultMode is the mode of the files in the archive, when the upload does
+// not specify it. It is not shown as a git mode.
+const defaultMode = 0o600
+
+// gitModes are the git modes which can be given in red_mode and green_mode.
+// The short forms of regular files are also accepted.
+var gitModes = map[string]int64{
+	"644":    0o100644,
+	"755":    0o100755,
+	"100644": 0o100644,
+	"100755": 0o100755,
+	"120000": 0o120000,
+}
+
+// formModes returns the tar modes of the red and green files, given in the
+// optional red_mode and green_mode values.
+func formModes(mf *multipart.Form) ([2]int64, error) {
+	modes := [2]int64{defaultMode, defaultMode}
+	for i, key := range [...]string{"red_mode", "green_mode"} {
+		if len(mf.Value[key]) == 0 || mf.Value[key][0] == "" {
+			continue
+		}
+		m, ok := gitModes[strings.TrimSpace(mf.Value[key][0])]
+		if !ok {
+			return modes, errUsage
+		}
+		modes[i] = m
+	}
+	return modes, nil
+}
+
+// withEmpty returns s, or a slice containing an empty string if s is empty.
+func withEmpty(s []string) []string {
+	if len(s) == 0 {
+		return []string{""}
+	}
+	return s
+}
+
+// formDevNull parses the optional red_devnull and green_devnull values, which
+// mark a file as nonexistent, to show the other file as added or deleted.
+// At most one of them may be set.
+func formDevNull(mf *multipart.Form) ([2]bool, error) {
+	var res [2]bool
+	for i, key := range [...]string{"red_devnull", "green_devnull"} {
+		if len(mf.Value[key]) == 0 || mf.Value[key][0] == "" {
+			continue
+		}
+		v, err := strconv.ParseBool(mf.Value[key][0])
+		if err != nil {
+			return res, errUsage
+		}
+		res[i] = v
+	}
+	if res[0] && res[1] {
+		return res, errUsage
+	}
+	return res, nil
+}
+
+// sides are the names of the sides of a diff, in the order of the files
+// returned by readArchive.
+var sides = [...]string{"red", "green"}
+
+// paxSide is the PAX record of the archive entries storing the side of the
+// diff of the file, so that the order of the files does not depend on the
+// order of the entries.
+const paxSide = "DIFFY.side"
+
+// tarWriteMultipart writes the file in r to tw, as the given index of sides.
+// If maxLines > 0, it returns errTooManyLines if r contains more than maxLines
+// newlines.
+func tarWriteMultipart(tw *tar.Writer, side int, name string, mode, size int64, r io.Reader, maxLines int) error {
 	err := tw.WriteHeader(&tar.Header{
-		Name: name,
-		Size: size,
-		Mode: 0o600,
+		Name:       name,
+		Size:       size,
+		Mode:       mode,
+		ModTime:    archiveModTime,
+		PAXRecords: map[string]string{paxSide: sides[side]},
 	})
 	if err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(tw, r); err != nil {
+	var dst io.Writer = tw
+	if maxLines > 0 {
+		dst = &lineLimitWriter{w: tw, max: maxLines}
+	}
+	if _, err := io.Copy(dst, r); err != nil {
 		return err
 	}
 	return nil
 }
+
+// maxRefLength is the maximum length of the red_ref and green_ref values.
+const maxRefLength = 256
+
+// tarWriteMeta writes the optional metadata of the upload to tw: the red_ref
+// and green_ref values (or their red_label and green_label aliases), and the
+// red_devnull and green_devnull flags. It must be called after writing both
+// files. If there is no metadata, nothing is written, so that uploads of the
+// same files with and without empty metadata get the same id. This does not
+// keep the ids of the diffs uploaded before the sides of the files, the fixed
+// modification time and the compression level were recorded in the archives,
+// as their bytes differ anyway; see the README.
+func tarWriteMeta(tw *tar.Writer, mf *multipart.Form) error {
+	var meta diffMeta
+	for _, v := range [...]struct {
+		key   string
+		alias string
+		dst   *string
+	}{
+		{"red_ref", "red_label", &meta.RedRef},
+		{"green_ref", "green_label", &meta.GreenRef},
+	} {
+		vals := mf.Value[v.key]
+		if len(vals) == 0 {
+			vals = mf.Value[v.alias]
+		}
+		if len(vals) == 0 {
+			continue
+		}
+		ref := strings.TrimSpace(vals[0])
+		// tabs separate the refs from the names in the diff headers.
+		if len(ref) > maxRefLength || strings.ContainsAny(ref, "\r\n\t") {
+			return errUsage
+		}
+		*v.dst = ref
+	}
+	devNull, err := formDevNull(mf)
+	if err != nil {
+		return err
+	}
+	meta.RedDevNull, meta.GreenDevNull = devNull[0], devNull[1]
+	if meta == (diffMeta{}) {
+		// keep the archive (and thus the id) of uploads without
+		// metadata unchanged.
+		return nil
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    metaName,
+		Size:    int64(len(data)),
+		Mode:    0o600,
+		ModTime: archiveModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// lineLimitWriter is a writer which returns errTooManyLines after more than
+// max lines have been written to it. A final line without a trailing newline
+// counts as well.
+type lineLimitWriter struct {
+	w     io.Writer
+	lines int  // terminated lines
+	open  bool // whether the last byte written was not a newline
+	max   int
+}
+
+func (l *lineLimitWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return l.w.Write(b)
+	}
+	l.lines += bytes.Count(b, []byte{'\n'})
+	l.open = b[len(b)-1] != '\n'
+	lines := l.lines
+	if l.open {
+		lines++
+	}
+	if lines > l.max {
+		return 0, errTooManyLines
+	}
+	return l.w.Write(b)
+}
@@ -0,0 +1,93 @@
+// Package i18n contains the translations of the user-facing strings of diffy.
+package i18n
+
+import (
+	"fmt"
+
+	"golang.org/x/text/language"
+)
+
+// English is the default language, in which the messages are written.
+const English = "en"
+
+// catalog contains the translations of the messages, keyed by language and
+// then by the English message. Missing messages are shown in English.
+var catalog = map[string]map[string]string{
+	"it": {
+		// pkg/http
+		"usage: curl -F red=@before.txt -F green=@after.txt %s": "uso: curl -F red=@prima.txt -F green=@dopo.txt %s",
+		"not found":                 "non trovato",
+		"410 content unavailable":   "410 contenuto non disponibile",
+		"500 internal server error": "500 errore interno del server",
+		"503 the diff took too long to compute; try a different algorithm (?algo=)": "503 il calcolo del diff ha richiesto troppo tempo; prova un altro algoritmo (?algo=)",
+		"error: %s":                                            "errore: %s",
+		"error: files may have at most %d lines":               "errore: i file possono avere al massimo %d righe",
+		"error: the files are identical":                       "errore: i file sono identici",
+		"error: uploads may be at most %d bytes":               "errore: i caricamenti possono essere al massimo di %d byte",
+		"limit exceeded; will reset on %s (in %s)":             "limite superato; verrà azzerato il %s (tra %s)",
+		"too many uploads in progress; retry in a few seconds": "troppi caricamenti in corso; riprova tra qualche secondo",
+		"limit exceeded; retry in a minute":                    "limite superato; riprova tra un minuto",
+		"invalid form token; reload the page and submit again": "token del modulo non valido; ricarica la pagina e invia di nuovo",
+
+		// templates
+		"this diff does not exist.":                "questo diff non esiste.",
+		"double-check the link you were given, or": "controlla il link che ti è stato dato, oppure",
+		"upload a new diff.":                       "carica un nuovo diff.",
+		"a dead stupid diff tool":                  "uno stupidissimo strumento per i diff",
+		"check out an example.":                    "guarda un esempio.",
+		"find the project on github.":              "trova il progetto su github.",
+		"submit":                                   "invia",
+		"files are identical":                      "i file sono identici",
+		"active options:":                          "opzioni attive:",
+		"reset to defaults":                        "ripristina i valori predefiniti",
+		"split view":                               "vista affiancata",
+		"ignoring all whitespace (-w)":             "ignorando tutti gli spazi (-w)",
+		"ignoring whitespace changes (-b)":         "ignorando le modifiche agli spazi (-b)",
+		"marking whitespace changes":               "evidenziando le modifiche agli spazi",
+		"unicode normalization: %s":                "normalizzazione unicode: %s",
+		"mode: %s":                                 "modalità: %s",
+		"algorithm: %s":                            "algoritmo: %s",
+		"full file":                                "file completo",
+		"context: blocks":                          "contesto: blocchi",
+		"context: %d lines":                        "contesto: %d righe",
+	},
+}
+
+// supported are the languages in catalog; the first is the default.
+var supported = []language.Tag{language.English, language.Italian}
+
+var matcher = language.NewMatcher(supported)
+
+// Match returns the language to use for the given preferences: param is an
+// explicit choice, like ?lang=, which takes precedence if it is supported;
+// acceptLanguage is the value of the Accept-Language header.
+// If neither matches a supported language, [English] is returned.
+func Match(param, acceptLanguage string) string {
+	if param != "" {
+		if t, err := language.Parse(param); err == nil {
+			if _, idx, conf := matcher.Match(t); conf != language.No {
+				return tagName(idx)
+			}
+		}
+	}
+	tags, _, _ := language.ParseAcceptLanguage(acceptLanguage)
+	_, idx, _ := matcher.Match(tags...)
+	return tagName(idx)
+}
+
+func tagName(idx int) string {
+	base, _ := supported[idx].Base()
+	return base.String()
+}
+
+// T translates msg into lang, formatting it with args using [fmt.Sprintf] if
+// any are given.
+func T(lang, msg string, args ...any) string {
+	if tr, ok := catalog[lang][msg]; ok {
+		msg = tr
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
@@ -0,0 +1,36 @@
+package i18n
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tt := []struct {
+		param, accept string
+		want          string
+	}{
+		{"", "", "en"},
+		{"", "it-IT,it;q=0.9,en;q=0.8", "it"},
+		{"", "en-US,en;q=0.9,it;q=0.8", "en"},
+		{"", "de-DE,de;q=0.9", "en"},
+		{"", "de-DE,it;q=0.5", "it"},
+		{"it", "en", "it"},
+		{"en", "it", "en"},
+		{"de", "it", "it"},
+		{"invalid!", "", "en"},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.want, Match(tc.param, tc.accept), "%q %q", tc.param, tc.accept)
+	}
+}
+
+func TestT(t *testing.T) {
+	assert.Equal(t, "non trovato", T("it", "not found"))
+	assert.Equal(t, "not found", T("en", "not found"))
+	assert.Equal(t, "not found", T("de", "not found"))
+	assert.Equal(t, "errore: i file possono avere al massimo 10 righe",
+		T("it", "error: files may have at most %d lines", 10))
+	assert.Equal(t, "untranslated 1", T("it", "untranslated %d", 1))
+}
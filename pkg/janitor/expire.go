@@ -0,0 +1,63 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/storage"
+)
+
+// ExpireResult is the result of [DeleteExpired].
+type ExpireResult struct {
+	// Diffs which have been deleted.
+	Deleted []string
+	// Total size of Deleted.
+	DeletedBytes uint64
+}
+
+// String returns a human-readable summary of r.
+func (r ExpireResult) String() string {
+	return fmt.Sprintf("deleted %d expired diffs (%d bytes)\n", len(r.Deleted), r.DeletedBytes)
+}
+
+// DeleteExpired deletes from d and st the diffs whose [db.File.ExpiresAt] is
+// before now, regardless of the quota.
+func DeleteExpired(ctx context.Context, d *db.DB, st storage.Storage, now time.Time) (ExpireResult, error) {
+	var res ExpireResult
+
+	var expired []string
+	err := d.ListFiles(func(name string, f db.File) error {
+		if f.Expired(now) {
+			expired = append(expired, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("listing files: %w", err)
+	}
+
+	for _, id := range expired {
+		// delete the record first, like EnforceQuota. It is checked again
+		// in the same transaction, as the diff may have been uploaded
+		// again without expiry, or with a later one, since listing it.
+		var size uint64
+		deleted, err := d.DelFileIf(id, func(f db.File) bool {
+			size = f.Size
+			return f.Expired(now)
+		})
+		if err != nil {
+			return res, fmt.Errorf("deleting record %q: %w", id, err)
+		}
+		if !deleted {
+			continue
+		}
+		if err := st.Del(ctx, id); err != nil {
+			return res, fmt.Errorf("deleting object %q: %w", id, err)
+		}
+		res.Deleted = append(res.Deleted, id)
+		res.DeletedBytes += size
+	}
+	return res, nil
+}
@@ -0,0 +1,43 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/storage"
+)
+
+func TestDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	d, st := newDBStorage(t)
+	now := time.Now()
+	for id, expiresAt := range map[string]time.Time{
+		"forever": {},
+		"expired": now.Add(-time.Minute),
+		"later":   now.Add(time.Hour),
+	} {
+		require.NoError(t, d.PutFile(id, db.File{CreatedAt: now.Add(-time.Hour), Sum: id, Size: 10, ExpiresAt: expiresAt}))
+		require.NoError(t, st.Put(ctx, id, make([]byte, 10)))
+	}
+
+	res, err := DeleteExpired(ctx, d, st, now)
+	require.NoError(t, err)
+	assert.Equal(t, ExpireResult{Deleted: []string{"expired"}, DeletedBytes: 10}, res)
+	has, err := d.HasFile("expired")
+	require.NoError(t, err)
+	assert.False(t, has)
+	_, err = st.Get(ctx, "expired")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// once their time comes, the others expire as well.
+	res, err = DeleteExpired(ctx, d, st, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"later"}, res.Deleted)
+	has, err = d.HasFile("forever")
+	require.NoError(t, err)
+	assert.True(t, has)
+}
@@ -0,0 +1,116 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/storage"
+)
+
+// QuotaResult is the result of [EnforceQuota].
+type QuotaResult struct {
+	// Total size of the stored diffs, before deleting any.
+	TotalBytes uint64
+	// Diffs which have been deleted, oldest first.
+	Deleted []string
+	// Total size of Deleted.
+	DeletedBytes uint64
+}
+
+// String returns a human-readable summary of r.
+func (r QuotaResult) String() string {
+	return fmt.Sprintf("stored %d bytes; deleted %d diffs (%d bytes)\n",
+		r.TotalBytes, len(r.Deleted), r.DeletedBytes)
+}
+
+// EnforceQuota ensures that the total size of the diffs in d is at most
+// maxBytes, deleting the oldest diffs from d and st until it is.
+//
+// The size of the diffs is determined from [db.File.Size]. For the records
+// without a size, the object is retrieved from st to determine it, and the
+// record is updated.
+func EnforceQuota(ctx context.Context, d *db.DB, st storage.Storage, maxBytes uint64) (QuotaResult, error) {
+	var res QuotaResult
+
+	type entry struct {
+		id string
+		f  db.File
+	}
+	var entries, unknown []entry
+	err := d.ListFiles(func(name string, f db.File) error {
+		if f.Size == 0 {
+			unknown = append(unknown, entry{name, f})
+		} else {
+			entries = append(entries, entry{name, f})
+		}
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("listing files: %w", err)
+	}
+
+	// determine the missing sizes.
+	for _, e := range unknown {
+		b, err := st.Get(ctx, e.id)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			// orphaned record; this is for Reconcile.
+			continue
+		case err != nil:
+			return res, fmt.Errorf("getting %q: %w", e.id, err)
+		}
+		e.f.Size = uint64(len(b))
+		// the record may have changed since listing it, like its expiry
+		// after a re-upload; only set its size.
+		_, err = d.UpdateFile(e.id, func(f *db.File) bool {
+			if f.Size != 0 {
+				return false
+			}
+			f.Size = e.f.Size
+			return true
+		})
+		if err != nil {
+			return res, fmt.Errorf("updating %q: %w", e.id, err)
+		}
+		entries = append(entries, e)
+	}
+
+	for _, e := range entries {
+		res.TotalBytes += e.f.Size
+	}
+	if res.TotalBytes <= maxBytes {
+		return res, nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].f.CreatedAt.Before(entries[j].f.CreatedAt)
+	})
+	total := res.TotalBytes
+	for _, e := range entries {
+		if total <= maxBytes {
+			break
+		}
+		// delete the record first: a record without an object is a broken
+		// link, while an object without a record is simply unreachable.
+		// Diffs uploaded again since listing them are kept.
+		deleted, err := d.DelFileIf(e.id, func(f db.File) bool {
+			return f.CreatedAt.Equal(e.f.CreatedAt) && f.ExpiresAt.Equal(e.f.ExpiresAt)
+		})
+		if err != nil {
+			return res, fmt.Errorf("deleting record %q: %w", e.id, err)
+		}
+		if !deleted {
+			continue
+		}
+		if err := st.Del(ctx, e.id); err != nil {
+			return res, fmt.Errorf("deleting object %q: %w", e.id, err)
+		}
+		total -= e.f.Size
+		res.Deleted = append(res.Deleted, e.id)
+		res.DeletedBytes += e.f.Size
+	}
+	return res, nil
+}
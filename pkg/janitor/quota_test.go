@@ -0,0 +1,97 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/storage"
+)
+
+func TestEnforceQuota(t *testing.T) {
+	ctx := context.Background()
+	d, st := newDBStorage(t)
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		require.NoError(t, d.PutFile(id, db.File{
+			CreatedAt: now.Add(time.Duration(i) * time.Hour),
+			Sum:       id,
+			Size:      10,
+		}))
+		require.NoError(t, st.Put(ctx, id, make([]byte, 10)))
+	}
+	// "old" has no size, and is the oldest.
+	require.NoError(t, d.PutFile("old", db.File{CreatedAt: now.Add(-time.Hour), Sum: "old"}))
+	require.NoError(t, st.Put(ctx, "old", make([]byte, 5)))
+
+	// under quota: nothing is deleted, but the missing size is recorded.
+	res, err := EnforceQuota(ctx, d, st, 100)
+	require.NoError(t, err)
+	assert.Equal(t, QuotaResult{TotalBytes: 35}, res)
+	f, err := d.GetFile("old")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), f.Size)
+
+	// over quota: the oldest are deleted.
+	res, err = EnforceQuota(ctx, d, st, 20)
+	require.NoError(t, err)
+	assert.Equal(t, QuotaResult{TotalBytes: 35, Deleted: []string{"old", "a"}, DeletedBytes: 15}, res)
+	for _, id := range []string{"old", "a"} {
+		has, err := d.HasFile(id)
+		require.NoError(t, err)
+		assert.False(t, has, id)
+		_, err = st.Get(ctx, id)
+		assert.ErrorIs(t, err, storage.ErrNotFound, id)
+	}
+	has, err := d.HasFile("b")
+	require.NoError(t, err)
+	assert.True(t, has)
+}
+
+// hookStorage calls onGet before each Get of the underlying storage.
+type hookStorage struct {
+	storage.Storage
+	onGet func(id string)
+}
+
+func (h hookStorage) Get(ctx context.Context, id string) ([]byte, error) {
+	h.onGet(id)
+	return h.Storage.Get(ctx, id)
+}
+
+func TestEnforceQuotaReupload(t *testing.T) {
+	ctx := context.Background()
+	d, st := newDBStorage(t)
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, d.PutFile("old", db.File{CreatedAt: now.Add(-time.Hour), Sum: "old"}))
+	require.NoError(t, st.Put(ctx, "old", make([]byte, 5)))
+	for i, id := range []string{"a", "b"} {
+		require.NoError(t, d.PutFile(id, db.File{CreatedAt: now.Add(time.Duration(i) * time.Hour), Sum: id, Size: 10}))
+		require.NoError(t, st.Put(ctx, id, make([]byte, 10)))
+	}
+
+	// while the size of "old" is determined, it is uploaded again with a
+	// later expiry, and "a" is stored anew.
+	expiresAt := now.Add(48 * time.Hour)
+	hs := hookStorage{Storage: st, onGet: func(id string) {
+		if id != "old" {
+			return
+		}
+		require.NoError(t, d.PutFile("old", db.File{CreatedAt: now.Add(-time.Hour), Sum: "old", ExpiresAt: expiresAt}))
+		require.NoError(t, d.PutFile("a", db.File{CreatedAt: now.Add(2 * time.Hour), Sum: "a", Size: 10}))
+	}}
+
+	res, err := EnforceQuota(ctx, d, hs, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, res.Deleted)
+	f, err := d.GetFile("old")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), f.Size)
+	assert.True(t, expiresAt.Equal(f.ExpiresAt))
+	has, err := d.HasFile("a")
+	require.NoError(t, err)
+	assert.True(t, has)
+}
@@ -0,0 +1,115 @@
+// Package janitor implements maintenance operations over the diffy database
+// and storage.
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/storage"
+)
+
+// ReconcileResult is the result of [Reconcile].
+type ReconcileResult struct {
+	// Records in the database without a matching object in the storage.
+	OrphanedRecords []string
+	// Objects in the storage without a matching record in the database.
+	OrphanedObjects []string
+	// Total size of OrphanedObjects.
+	OrphanedBytes uint64
+	// Whether the orphans have been deleted.
+	Deleted bool
+}
+
+// String returns a human-readable summary of r.
+func (r ReconcileResult) String() string {
+	var b strings.Builder
+	for _, id := range r.OrphanedRecords {
+		fmt.Fprintf(&b, "orphaned record: %s\n", id)
+	}
+	for _, id := range r.OrphanedObjects {
+		fmt.Fprintf(&b, "orphaned object: %s\n", id)
+	}
+	verb := "found"
+	if r.Deleted {
+		verb = "deleted"
+	}
+	fmt.Fprintf(&b, "%s %d orphaned records, %d orphaned objects (%d bytes)\n",
+		verb, len(r.OrphanedRecords), len(r.OrphanedObjects), r.OrphanedBytes)
+	return b.String()
+}
+
+// Reconcile cross-checks the files in d against the objects in st, finding
+// orphans in both directions. If del is set, the orphans are removed.
+//
+// If st implements [storage.ListStorage], it is used to find objects without
+// a database record; otherwise, only the database records are checked, using
+// st.Get.
+func Reconcile(ctx context.Context, d *db.DB, st storage.Storage, del bool) (ReconcileResult, error) {
+	var res ReconcileResult
+
+	// First, find all the ids in the database.
+	ids := make(map[string]bool)
+	err := d.ListFiles(func(name string, _ db.File) error {
+		ids[name] = false
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("listing files: %w", err)
+	}
+
+	if ls, ok := st.(storage.ListStorage); ok {
+		err := ls.List(ctx, func(id string, b []byte) error {
+			if _, ok := ids[id]; ok {
+				ids[id] = true
+				return nil
+			}
+			res.OrphanedObjects = append(res.OrphanedObjects, id)
+			res.OrphanedBytes += uint64(len(b))
+			return nil
+		})
+		if err != nil {
+			return res, fmt.Errorf("listing storage: %w", err)
+		}
+	} else {
+		for id := range ids {
+			_, err := st.Get(ctx, id)
+			switch {
+			case err == nil:
+				ids[id] = true
+			case errors.Is(err, storage.ErrNotFound):
+			default:
+				return res, fmt.Errorf("getting %q: %w", id, err)
+			}
+		}
+	}
+
+	for id, found := range ids {
+		if !found {
+			res.OrphanedRecords = append(res.OrphanedRecords, id)
+		}
+	}
+	sort.Strings(res.OrphanedRecords)
+	sort.Strings(res.OrphanedObjects)
+
+	if !del {
+		return res, nil
+	}
+
+	for _, id := range res.OrphanedRecords {
+		if err := d.DelFile(id); err != nil {
+			return res, fmt.Errorf("deleting record %q: %w", id, err)
+		}
+	}
+	for _, id := range res.OrphanedObjects {
+		if err := st.Del(ctx, id); err != nil {
+			return res, fmt.Errorf("deleting object %q: %w", id, err)
+		}
+	}
+	res.Deleted = true
+	return res, nil
+}
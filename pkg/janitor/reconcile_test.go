@@ -0,0 +1,79 @@
+package janitor
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thehowl/diffy/pkg/db"
+	"github.com/thehowl/diffy/pkg/storage"
+	"go.etcd.io/bbolt"
+)
+
+func newDBStorage(t *testing.T) (*db.DB, storage.Storage) {
+	t.Helper()
+	bdb, err := bbolt.Open(filepath.Join(t.TempDir(), "db.bolt"), 0o600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, bdb.Close())
+	})
+	return &db.DB{DB: bdb}, storage.NewDBStorage(bdb, []byte("storage"))
+}
+
+// getOnlyStorage hides the List method of the underlying storage.
+type getOnlyStorage struct{ storage.Storage }
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T) (*db.DB, storage.Storage) {
+		t.Helper()
+		d, st := newDBStorage(t)
+		// "ok" is consistent; "record" is only in the db, "object" only in
+		// the storage.
+		require.NoError(t, d.PutFile("ok", db.File{Sum: "1"}))
+		require.NoError(t, st.Put(ctx, "ok", []byte("hello")))
+		require.NoError(t, d.PutFile("record", db.File{Sum: "2"}))
+		require.NoError(t, st.Put(ctx, "object", []byte("world!")))
+		return d, st
+	}
+
+	t.Run("List", func(t *testing.T) {
+		d, st := setup(t)
+		res, err := Reconcile(ctx, d, st, false)
+		require.NoError(t, err)
+		assert.Equal(t, ReconcileResult{
+			OrphanedRecords: []string{"record"},
+			OrphanedObjects: []string{"object"},
+			OrphanedBytes:   6,
+		}, res)
+		assert.Contains(t, res.String(), "found 1 orphaned records, 1 orphaned objects (6 bytes)")
+	})
+	t.Run("Get", func(t *testing.T) {
+		// without List, storage orphans cannot be found.
+		d, st := setup(t)
+		res, err := Reconcile(ctx, d, getOnlyStorage{st}, false)
+		require.NoError(t, err)
+		assert.Equal(t, ReconcileResult{
+			OrphanedRecords: []string{"record"},
+		}, res)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		d, st := setup(t)
+		res, err := Reconcile(ctx, d, st, true)
+		require.NoError(t, err)
+		assert.True(t, res.Deleted)
+
+		has, err := d.HasFile("record")
+		require.NoError(t, err)
+		assert.False(t, has)
+		_, err = st.Get(ctx, "object")
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		// running again should find no orphans.
+		res, err = Reconcile(ctx, d, st, false)
+		require.NoError(t, err)
+		assert.Equal(t, ReconcileResult{}, res)
+	})
+}
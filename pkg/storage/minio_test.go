@@ -0,0 +1,144 @@
+//go:build integration
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file run against a real MinIO (or S3-compatible) server,
+// like the one of docker-compose.yaml:
+//
+//	docker compose up -d minio createbuckets
+//	MINIO_ENDPOINT=localhost:9000 go test -tags integration ./pkg/storage
+//
+// MINIO_ACCESS_KEY and MINIO_SECRET_KEY default to the credentials of
+// docker-compose.yaml, and MINIO_BUCKET to "diffy"; the bucket is created if
+// it does not exist.
+
+func newMinioStorage(t *testing.T, prefix string) ListStorage {
+	t.Helper()
+
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_ENDPOINT is not set")
+	}
+	cl, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(
+			envOr("MINIO_ACCESS_KEY", "admin"),
+			envOr("MINIO_SECRET_KEY", "password"),
+			""),
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	bucket := envOr("MINIO_BUCKET", "diffy")
+	ok, err := cl.BucketExists(ctx, bucket)
+	require.NoError(t, err)
+	if !ok {
+		require.NoError(t, cl.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}))
+	}
+
+	// a new prefix for each run, so that runs don't see each other's objects.
+	prefix = "test-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "/" + prefix
+	st := NewMinioStorage(cl, bucket, prefix)
+	t.Cleanup(func() {
+		var ids []string
+		st.List(context.Background(), func(id string, _ []byte) error {
+			ids = append(ids, id)
+			return nil
+		})
+		for _, id := range ids {
+			st.Del(context.Background(), id)
+		}
+	})
+	return st
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func TestMinioStorage(t *testing.T) {
+	ctx := context.Background()
+	st := newMinioStorage(t, "")
+
+	assert.NoError(t, Ping(ctx, st))
+
+	_, err := st.Get(ctx, "hello")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, st.Put(ctx, "hello", []byte("world")))
+	require.NoError(t, st.Put(ctx, "foo", []byte("bar")))
+	b, err := st.Get(ctx, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+
+	// overwrite.
+	require.NoError(t, st.Put(ctx, "foo", []byte("baz")))
+
+	listed := map[string]string{}
+	require.NoError(t, st.List(ctx, func(id string, b []byte) error {
+		listed[id] = string(b)
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"hello": "world", "foo": "baz"}, listed)
+
+	require.NoError(t, st.Del(ctx, "hello"))
+	require.NoError(t, st.Del(ctx, "hello"))
+	_, err = st.Get(ctx, "hello")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMinioCachedStorage(t *testing.T) {
+	ctx := context.Background()
+	cache, perm := newMinioStorage(t, "cache/"), newMinioStorage(t, "permanent/")
+
+	// an object which was already cached is found when listing the cache.
+	require.NoError(t, perm.Put(ctx, "a", []byte("aaaa")))
+	require.NoError(t, cache.Put(ctx, "a", []byte("aaaa")))
+	cs, err := NewCachedStorage(cache, perm, 10, EvictLRU)
+	require.NoError(t, err)
+	assert.NoError(t, Ping(ctx, cs))
+
+	b, err := cs.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", string(b))
+
+	// exceed the size of the cache, and wait for the cleaner to evict the
+	// least recently accessed object, "a".
+	require.NoError(t, cs.Put(ctx, "b", []byte("bbbb")))
+	require.NoError(t, cs.Put(ctx, "c", []byte("cccc")))
+	require.Eventually(t, func() bool {
+		_, err := cache.Get(ctx, "a")
+		return errors.Is(err, ErrNotFound)
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, uint64(1), cs.Stats().Evictions)
+
+	// evicted objects are retrieved again from the permanent storage.
+	b, err = cs.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", string(b))
+	st := cs.Stats()
+	assert.Equal(t, uint64(1), st.Hits)
+	assert.Equal(t, uint64(1), st.Misses)
+
+	require.NoError(t, cs.Del(ctx, "b"))
+	for _, s := range []Storage{cs, cache, perm} {
+		_, err := s.Get(ctx, "b")
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+}
@@ -2,13 +2,19 @@ package storage
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -40,24 +46,94 @@ type ListStorage interface {
 	List(ctx context.Context, cb func(id string, b []byte) error) error
 }
 
+// Verifier is implemented by the storages whose Get does not necessarily
+// return the stored object, like caches, and which can check it otherwise.
+type Verifier interface {
+	// Verify returns an error if the object id is not stored as data.
+	Verify(ctx context.Context, id string, data []byte) error
+}
+
+// ErrMismatch is returned by [Verify] if the stored object differs from the
+// one which was written.
+var ErrMismatch = errors.New("storage: stored object differs from the written one")
+
+// Verify checks that the object id is stored in st as data, using st.Verify
+// if it implements [Verifier], or retrieving the object otherwise.
+func Verify(ctx context.Context, st Storage, id string, data []byte) error {
+	if v, ok := st.(Verifier); ok {
+		return v.Verify(ctx, id, data)
+	}
+	b, err := st.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, data) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Pinger is implemented by the storages which can check whether they are
+// available.
+type Pinger interface {
+	// Ping returns an error if the storage cannot currently be reached.
+	Ping(ctx context.Context) error
+}
+
+// CacheStats are the statistics of a cache in front of a storage.
+type CacheStats struct {
+	Hits      uint64 // number of objects retrieved from the cache
+	Misses    uint64 // number of objects retrieved from the permanent storage
+	Evictions uint64 // number of objects evicted from the cache
+	Objects   int    // number of objects currently in the cache
+	Bytes     uint64 // current size of the cache, in bytes
+}
+
+// StatsStorage is implemented by the storages which cache objects, and keep
+// statistics about it.
+type StatsStorage interface {
+	Storage
+	Stats() CacheStats
+}
+
+// Ping pings st, if it implements [Pinger]. Otherwise, it returns nil.
+func Ping(ctx context.Context, st Storage) error {
+	if p, ok := st.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
 type minioStorage struct {
 	cl         *minio.Client
 	bucketName string
+	prefix     string
 }
 
-var _ Storage = (*minioStorage)(nil)
+var _ ListStorage = (*minioStorage)(nil)
 
-func NewMinioStorage(cl *minio.Client, bucketName string) Storage {
+// NewMinioStorage creates a new storage saving objects in the given bucket.
+// The keys of the objects are the ids, prepended with prefix; the prefix is
+// transparent to the users of the storage.
+func NewMinioStorage(cl *minio.Client, bucketName, prefix string) ListStorage {
 	return &minioStorage{
 		cl:         cl,
 		bucketName: bucketName,
+		prefix:     prefix,
 	}
 }
 
 const s3NotFound = "NoSuchKey"
 
 func (m *minioStorage) Get(ctx context.Context, id string) ([]byte, error) {
-	obj, err := m.cl.GetObject(ctx, m.bucketName, id, minio.GetObjectOptions{})
+	obj, err := m.cl.GetObject(ctx, m.bucketName, m.prefix+id, minio.GetObjectOptions{})
+	var b []byte
+	if err == nil {
+		// the object is only requested when reading it, so this is where
+		// NoSuchKey is returned.
+		b, err = io.ReadAll(obj)
+		obj.Close()
+	}
 	if err != nil {
 		var eResp minio.ErrorResponse
 		if errors.As(err, &eResp) && eResp.Code == s3NotFound {
@@ -65,18 +141,56 @@ func (m *minioStorage) Get(ctx context.Context, id string) ([]byte, error) {
 		}
 		return nil, err
 	}
-	defer obj.Close()
-	return io.ReadAll(obj)
+	return b, nil
 }
 
 func (m *minioStorage) Put(ctx context.Context, id string, data []byte) error {
-	_, err := m.cl.PutObject(ctx, m.bucketName, id,
+	info, err := m.cl.PutObject(ctx, m.bucketName, m.prefix+id,
 		bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	if err == nil && info.Size != int64(len(data)) {
+		err = fmt.Errorf("storage: stored %d bytes of %d", info.Size, len(data))
+	}
 	return err
 }
 
 func (m *minioStorage) Del(ctx context.Context, id string) error {
-	return m.cl.RemoveObject(ctx, m.bucketName, id, minio.RemoveObjectOptions{})
+	return m.cl.RemoveObject(ctx, m.bucketName, m.prefix+id, minio.RemoveObjectOptions{})
+}
+
+func (m *minioStorage) Ping(ctx context.Context) error {
+	ok, err := m.cl.BucketExists(ctx, m.bucketName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("storage: bucket %q does not exist", m.bucketName)
+	}
+	return nil
+}
+
+// List retrieves each object in the bucket and passes it to cb. This is
+// expensive, and should only be used for maintenance operations.
+func (m *minioStorage) List(ctx context.Context, cb func(id string, b []byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := m.cl.ListObjects(ctx, m.bucketName, minio.ListObjectsOptions{
+		Prefix:    m.prefix,
+		Recursive: true,
+	})
+	for info := range objects {
+		if info.Err != nil {
+			return info.Err
+		}
+		id := strings.TrimPrefix(info.Key, m.prefix)
+		b, err := m.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := cb(id, b); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type dbStorage struct {
@@ -90,7 +204,7 @@ var _ ListStorage = (*dbStorage)(nil)
 // bucketName exists in the db.
 //
 // It panics if db.Update returns an error.
-func NewDBStorage(db *bbolt.DB, bucketName []byte) Storage {
+func NewDBStorage(db *bbolt.DB, bucketName []byte) ListStorage {
 	err := db.Update(func(tx *bbolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(bucketName)
 		return err
@@ -132,6 +246,15 @@ func (m *dbStorage) Del(ctx context.Context, id string) error {
 	})
 }
 
+func (m *dbStorage) Ping(ctx context.Context) error {
+	return m.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(m.bucketName) == nil {
+			return fmt.Errorf("storage: bucket %q does not exist", m.bucketName)
+		}
+		return nil
+	})
+}
+
 func (m *dbStorage) List(ctx context.Context, cb func(id string, b []byte) error) error {
 	return m.db.View(func(tx *bbolt.Tx) error {
 		bx := tx.Bucket(m.bucketName)
@@ -141,15 +264,153 @@ func (m *dbStorage) List(ctx context.Context, cb func(id string, b []byte) error
 	})
 }
 
+type fsStorage struct {
+	dir string
+}
+
+var _ ListStorage = (*fsStorage)(nil)
+
+// NewFSStorage creates a new storage which saves each object as a file in dir.
+// dir is created if it does not exist.
+func NewFSStorage(dir string) (ListStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fsStorage{dir: dir}, nil
+}
+
+func (f *fsStorage) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("storage: invalid id %q", id)
+	}
+	return filepath.Join(f.dir, id), nil
+}
+
+func (f *fsStorage) Get(ctx context.Context, id string) ([]byte, error) {
+	p, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (f *fsStorage) Put(ctx context.Context, id string, data []byte) error {
+	p, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that concurrent readers never see
+	// a partially written object.
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (f *fsStorage) Del(ctx context.Context, id string) error {
+	p, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *fsStorage) Ping(ctx context.Context) error {
+	_, err := os.Stat(f.dir)
+	return err
+}
+
+func (f *fsStorage) List(ctx context.Context, cb func(id string, b []byte) error) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if ent.IsDir() || strings.HasPrefix(ent.Name(), ".tmp-") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(f.dir, ent.Name()))
+		if err != nil {
+			return err
+		}
+		if err := cb(ent.Name(), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EvictionPolicy determines which objects are evicted first from a cache
+// created with [NewCachedStorage], once it is full.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently accessed objects first.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the least frequently accessed objects first, so that
+	// objects accessed often, but sporadically, are kept. Objects accessed
+	// the same number of times are evicted by LRU. The numbers of accesses
+	// are kept in memory, and restart from 0 on startup.
+	EvictLFU
+)
+
+// ParseEvictionPolicy parses the name of an EvictionPolicy: "lru" or "lfu".
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	}
+	return 0, fmt.Errorf("invalid eviction policy %q", s)
+}
+
+// compare returns the order in which a and b are evicted. The lastAccessM of
+// both must be locked, and their accessesSnapshot taken.
+func (p EvictionPolicy) compare(a, b *cachedObject) int {
+	if p == EvictLFU {
+		if c := cmp.Compare(a.accessesSnapshot, b.accessesSnapshot); c != 0 {
+			return c
+		}
+	}
+	return a.lastAccess.Compare(b.lastAccess)
+}
+
 type cachedObject struct {
 	id          string
 	size        uint64
 	lastAccess  time.Time
 	lastAccessM sync.Mutex
-	ready       chan struct{}
+	// accesses is the number of times the object was accessed, for
+	// EvictLFU.
+	accesses atomic.Uint64
+	// accessesSnapshot is accesses when the cache is cleaned, so that
+	// sorting the objects uses consistent values, even if they are
+	// accessed meanwhile. It is guarded by lastAccessM.
+	accessesSnapshot uint64
+	ready            chan struct{}
 }
 
 func (c *cachedObject) access() {
+	c.accesses.Add(1)
 	n := time.Now()
 	// TryLock allows us to fast path in case another goroutine is
 	// accessing c.lastAccess right now, and allows us to report the time
@@ -165,17 +426,21 @@ type cachedStorage struct {
 	cache     Storage
 	permanent Storage
 	maxSize   uint64 // bytes. actual storage may be slightly higher.
+	policy    EvictionPolicy
 
 	sync.RWMutex
 	objects map[string]*cachedObject
 	// send in this channel after adding new objects.
 	cleaning chan struct{}
+
+	hits, misses, evictions atomic.Uint64
 }
 
 func NewCachedStorage(
 	cache ListStorage,
 	permanent Storage,
 	maxSize uint64,
+	policy EvictionPolicy,
 ) (*cachedStorage, error) {
 	objects := make(map[string]*cachedObject)
 	ready := make(chan struct{})
@@ -196,6 +461,7 @@ func NewCachedStorage(
 		cache:     cache,
 		permanent: permanent,
 		maxSize:   maxSize,
+		policy:    policy,
 
 		objects:  objects,
 		cleaning: make(chan struct{}, 1),
@@ -204,7 +470,10 @@ func NewCachedStorage(
 	return c, nil
 }
 
-var _ Storage = (*cachedStorage)(nil)
+var (
+	_ StatsStorage = (*cachedStorage)(nil)
+	_ Verifier     = (*cachedStorage)(nil)
+)
 
 const (
 	cleanSleep = time.Second
@@ -220,6 +489,25 @@ func (c *cachedStorage) cacheSize() uint64 {
 	return sz
 }
 
+// Stats implements [StatsStorage].
+func (c *cachedStorage) Stats() CacheStats {
+	st := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	c.RLock()
+	for _, obj := range c.objects {
+		// objects being retrieved have no size yet.
+		if obj.size > 0 {
+			st.Objects++
+			st.Bytes += obj.size
+		}
+	}
+	c.RUnlock()
+	return st
+}
+
 func (c *cachedStorage) evict(els []*cachedObject) {
 	// We're essentially putting the c.objects map in read-only while evicting
 	// cache. This is hacky, but it avoids race conditions, ie. deleting in the
@@ -246,12 +534,11 @@ func (c *cachedStorage) doClean() {
 	for _, obj := range c.objects {
 		objects = append(objects, obj)
 		obj.lastAccessM.Lock()
+		obj.accessesSnapshot = obj.accesses.Load()
 		sz += obj.size
 	}
 
-	slices.SortFunc(objects, func(i, j *cachedObject) int {
-		return i.lastAccess.Compare(j.lastAccess)
-	})
+	slices.SortFunc(objects, c.policy.compare)
 
 	// Target reaching 95% of maxSize, to give some leeway until next doClean.
 	collectTarget := (sz - c.maxSize) + c.maxSize/20
@@ -263,12 +550,13 @@ func (c *cachedStorage) doClean() {
 			// collected enough.
 			// set del if not set, unlock lastAccess
 			if del == nil {
-				del = del[:i]
+				del = objects[:i]
 			}
 			obj.lastAccessM.Unlock()
 		} else {
 			collected += obj.size
 			delete(c.objects, obj.id)
+			c.evictions.Add(1)
 		}
 	}
 	if del == nil {
@@ -312,6 +600,7 @@ func (c *cachedStorage) cacheStore(ctx context.Context, id string, b []byte, x *
 		return
 	}
 	x.lastAccess = time.Now()
+	x.accesses.Add(1)
 	x.size = uint64(len(b))
 
 	// new object added; schedule cleaning.
@@ -324,6 +613,7 @@ func (c *cachedStorage) cacheStore(ctx context.Context, id string, b []byte, x *
 func (c *cachedStorage) Get(ctx context.Context, id string) ([]byte, error) {
 	// fast path: object is cached
 	if c.cacheHas(id) {
+		c.hits.Add(1)
 		return c.cache.Get(ctx, id)
 	}
 
@@ -342,15 +632,23 @@ func (c *cachedStorage) Get(ctx context.Context, id string) ([]byte, error) {
 	if !ours {
 		<-co.ready
 		if co.size > 0 {
+			c.hits.Add(1)
 			return c.cache.Get(ctx, id)
 		}
 		return nil, ErrNotFound
 	}
 
 	// we are responsible for retrieving the object and putting it in cache.
+	c.misses.Add(1)
 	defer close(co.ready)
 	b, err := c.permanent.Get(ctx, id)
 	if err != nil {
+		// remove the object, so that subsequent calls may retry.
+		c.Lock()
+		if c.objects[id] == co {
+			delete(c.objects, id)
+		}
+		c.Unlock()
 		return nil, err
 	}
 
@@ -376,6 +674,20 @@ func (c *cachedStorage) Put(ctx context.Context, id string, data []byte) error {
 	return nil
 }
 
+// Verify verifies the object in the permanent storage, as Get could return
+// the cached copy.
+func (c *cachedStorage) Verify(ctx context.Context, id string, data []byte) error {
+	return Verify(ctx, c.permanent, id, data)
+}
+
+// Ping pings both the cache and the permanent storage.
+func (c *cachedStorage) Ping(ctx context.Context) error {
+	if err := Ping(ctx, c.cache); err != nil {
+		return fmt.Errorf("cache: %w", err)
+	}
+	return Ping(ctx, c.permanent)
+}
+
 func (c *cachedStorage) Del(ctx context.Context, id string) error {
 	// try deleting in permanent
 	if err := c.permanent.Del(ctx, id); err != nil {
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestFSStorage(t *testing.T) {
+	ctx := context.Background()
+	st, err := NewFSStorage(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = st.Get(ctx, "hello")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, st.Put(ctx, "hello", []byte("world")))
+	b, err := st.Get(ctx, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+
+	// invalid ids.
+	for _, id := range []string{"", "..", "a/b"} {
+		assert.Error(t, st.Put(ctx, id, []byte("x")), id)
+	}
+
+	listed := map[string]string{}
+	require.NoError(t, st.List(ctx, func(id string, b []byte) error {
+		listed[id] = string(b)
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"hello": "world"}, listed)
+
+	require.NoError(t, st.Del(ctx, "hello"))
+	require.NoError(t, st.Del(ctx, "hello"))
+	_, err = st.Get(ctx, "hello")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	fs, err := NewFSStorage(t.TempDir())
+	require.NoError(t, err)
+	bdb, err := bbolt.Open(filepath.Join(t.TempDir(), "db.bolt"), 0o600, nil)
+	require.NoError(t, err)
+	defer bdb.Close()
+	perm := NewDBStorage(bdb, []byte("storage"))
+
+	require.NoError(t, perm.Put(ctx, "a", []byte("hello")))
+	assert.NoError(t, Verify(ctx, perm, "a", []byte("hello")))
+	assert.ErrorIs(t, Verify(ctx, perm, "a", []byte("hell")), ErrMismatch)
+	assert.ErrorIs(t, Verify(ctx, perm, "b", []byte("hello")), ErrNotFound)
+
+	// the cache verifies the permanent storage, not its own copy.
+	cs, err := NewCachedStorage(fs, perm, 1<<20, EvictLRU)
+	require.NoError(t, err)
+	require.NoError(t, cs.Put(ctx, "c", []byte("world")))
+	assert.NoError(t, Verify(ctx, cs, "c", []byte("world")))
+	require.NoError(t, perm.Put(ctx, "c", []byte("wor")))
+	assert.ErrorIs(t, Verify(ctx, cs, "c", []byte("world")), ErrMismatch)
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	p, err := ParseEvictionPolicy("lfu")
+	require.NoError(t, err)
+	assert.Equal(t, EvictLFU, p)
+	_, err = ParseEvictionPolicy("random")
+	assert.Error(t, err)
+}
+
+func TestPing(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "fs")
+	fs, err := NewFSStorage(dir)
+	require.NoError(t, err)
+	bdb, err := bbolt.Open(filepath.Join(t.TempDir(), "db.bolt"), 0o600, nil)
+	require.NoError(t, err)
+	defer bdb.Close()
+	cs, err := NewCachedStorage(fs, NewDBStorage(bdb, []byte("storage")), 1<<20, EvictLRU)
+	require.NoError(t, err)
+
+	assert.NoError(t, Ping(ctx, cs))
+
+	require.NoError(t, os.RemoveAll(dir))
+	assert.ErrorContains(t, Ping(ctx, cs), "cache: ")
+}
+
+func TestCacheStats(t *testing.T) {
+	ctx := context.Background()
+	fs, err := NewFSStorage(t.TempDir())
+	require.NoError(t, err)
+	bdb, err := bbolt.Open(filepath.Join(t.TempDir(), "db.bolt"), 0o600, nil)
+	require.NoError(t, err)
+	defer bdb.Close()
+	perm := NewDBStorage(bdb, []byte("storage"))
+	require.NoError(t, perm.Put(ctx, "a", []byte("hello")))
+	// without the cleaner, so that objects are only evicted by doClean.
+	cs := &cachedStorage{
+		cache:     fs,
+		permanent: perm,
+		maxSize:   8,
+		objects:   make(map[string]*cachedObject),
+		cleaning:  make(chan struct{}, 1),
+	}
+
+	require.NoError(t, cs.Put(ctx, "b", []byte("world!")))
+	for _, id := range []string{"a", "a", "b"} {
+		_, err := cs.Get(ctx, id)
+		require.NoError(t, err)
+	}
+	_, err = cs.Get(ctx, "c")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	assert.Equal(t, CacheStats{
+		Hits:    2,
+		Misses:  2,
+		Objects: 2,
+		Bytes:   11,
+	}, cs.Stats())
+
+	// evicts the least recently accessed object, "a".
+	cs.doClean()
+	st := cs.Stats()
+	assert.Equal(t, uint64(1), st.Evictions)
+	assert.Equal(t, 1, st.Objects)
+	assert.Equal(t, uint64(6), st.Bytes)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		policy  EvictionPolicy
+		evicted string
+	}{
+		{EvictLRU, "a"},
+		{EvictLFU, "b"},
+	} {
+		fs, err := NewFSStorage(t.TempDir())
+		require.NoError(t, err)
+		bdb, err := bbolt.Open(filepath.Join(t.TempDir(), "db.bolt"), 0o600, nil)
+		require.NoError(t, err)
+		defer bdb.Close()
+		perm := NewDBStorage(bdb, []byte("storage"))
+		require.NoError(t, perm.Put(ctx, "a", []byte("hello")))
+		require.NoError(t, perm.Put(ctx, "b", []byte("world")))
+		// without the cleaner, so that objects are only evicted by doClean.
+		cs := &cachedStorage{
+			cache:     fs,
+			permanent: perm,
+			maxSize:   8,
+			policy:    tc.policy,
+			objects:   make(map[string]*cachedObject),
+			cleaning:  make(chan struct{}, 1),
+		}
+
+		// a is accessed often, but b was accessed last.
+		for _, id := range []string{"a", "a", "a", "b"} {
+			_, err := cs.Get(ctx, id)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, uint64(3), cs.objects["a"].accesses.Load())
+		assert.Equal(t, uint64(1), cs.objects["b"].accesses.Load())
+
+		cs.doClean()
+		assert.Equal(t, uint64(1), cs.Stats().Evictions)
+		assert.NotContains(t, cs.objects, tc.evicted)
+		assert.Len(t, cs.objects, 1)
+	}
+}
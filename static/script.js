@@ -32,3 +32,94 @@
 			});
 		});
 })();
+
+// Palette selector. Like the theme, the stored palette is applied in the head
+// tags, unless the page sets one using ?palette=.
+(function () {
+	var root = document.documentElement;
+	var links = document.querySelectorAll(".palette-selector [data-palette]");
+
+	function updateSelectors() {
+		var current = root.getAttribute("data-palette") || "";
+		links.forEach(function (sel) {
+			if (sel.getAttribute("data-palette") == current) {
+				sel.removeAttribute("href");
+			} else {
+				sel.setAttribute("href", "#");
+			}
+		});
+	}
+
+	updateSelectors();
+	links.forEach(function (el) {
+		el.addEventListener("click", function (e) {
+			e.preventDefault();
+			var palette = el.getAttribute("data-palette");
+			if (palette === "") {
+				root.removeAttribute("data-palette");
+				window.localStorage.removeItem("data-palette");
+			} else {
+				root.setAttribute("data-palette", palette);
+				window.localStorage.setItem("data-palette", palette);
+			}
+			updateSelectors();
+		});
+	});
+})();
+
+// Font selector. The stored font is applied in the head tags (see
+// templates/bits.tmpl), unless the page sets one using ?font=.
+(function () {
+	var root = document.documentElement;
+	var settings = [
+		{ sel: "[data-font-family]", prop: "--diff-font", key: "diff-font" },
+		{ sel: "[data-font-size]", prop: "--diff-font-size", key: "diff-font-size" },
+	];
+	settings.forEach(function (s) {
+		var el = document.querySelector(".font-selector " + s.sel);
+		if (!el) {
+			return;
+		}
+		el.value = root.style.getPropertyValue(s.prop).trim();
+		el.addEventListener("change", function () {
+			if (el.value === "") {
+				root.style.removeProperty(s.prop);
+				window.localStorage.removeItem(s.key);
+			} else {
+				root.style.setProperty(s.prop, el.value);
+				window.localStorage.setItem(s.key, el.value);
+			}
+		});
+	});
+})();
+
+// Expand the unchanged lines between hunks.
+(function () {
+	document.querySelectorAll(".gap-expand").forEach(function (el) {
+		el.addEventListener("click", function (e) {
+			e.preventDefault();
+			var gap = el.getAttribute("data-gap");
+			document
+				.querySelectorAll('[data-gap-line="' + gap + '"]')
+				.forEach(function (line) {
+					line.removeAttribute("hidden");
+				});
+			document
+				.querySelectorAll('[data-gap-marker="' + gap + '"]')
+				.forEach(function (marker) {
+					marker.setAttribute("hidden", "");
+				});
+		});
+	});
+})();
+
+// Show the rest of truncated lines.
+(function () {
+	document.querySelectorAll(".line-expand").forEach(function (el) {
+		el.addEventListener("click", function (e) {
+			e.preventDefault();
+			el.previousElementSibling.removeAttribute("hidden");
+			el.remove();
+		});
+	});
+})();
@@ -0,0 +1,133 @@
+package templates
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// languageDetectLines is the number of lines inspected by detectLanguage.
+const languageDetectLines = 20
+
+var languageExtensions = map[string]string{
+	".c":    "c",
+	".h":    "c",
+	".cc":   "cpp",
+	".cpp":  "cpp",
+	".hpp":  "cpp",
+	".css":  "css",
+	".go":   "go",
+	".html": "html",
+	".htm":  "html",
+	".java": "java",
+	".js":   "javascript",
+	".mjs":  "javascript",
+	".json": "json",
+	".md":   "markdown",
+	".php":  "php",
+	".py":   "python",
+	".rb":   "ruby",
+	".rs":   "rust",
+	".sh":   "bash",
+	".sql":  "sql",
+	".toml": "toml",
+	".ts":   "typescript",
+	".xml":  "xml",
+	".yaml": "yaml",
+	".yml":  "yaml",
+}
+
+var shebangInterpreters = map[string]string{
+	"bash":    "bash",
+	"sh":      "bash",
+	"zsh":     "bash",
+	"node":    "javascript",
+	"perl":    "perl",
+	"php":     "php",
+	"python":  "python",
+	"python3": "python",
+	"ruby":    "ruby",
+}
+
+var (
+	reGoPackage   = regexp.MustCompile(`^package [a-zA-Z_][a-zA-Z0-9_]*\s*(?://.*)?$`)
+	reJavaPackage = regexp.MustCompile(`^package [a-zA-Z_][a-zA-Z0-9_.]*;$`)
+	reYAMLKey     = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*:(?:\s|$)`)
+)
+
+// detectLanguage determines the language of a file, for syntax highlighting.
+// The first lines of the content are inspected first; if they are not
+// decisive, the extension of name is used. It returns "plain" if the language
+// cannot be determined.
+func detectLanguage(name, content string) string {
+	if lang := detectLanguageContent(content); lang != "" {
+		return lang
+	}
+	if lang, ok := languageExtensions[strings.ToLower(path.Ext(name))]; ok {
+		return lang
+	}
+	return "plain"
+}
+
+func detectLanguageContent(content string) string {
+	lines := strings.SplitN(content, "\n", languageDetectLines+1)
+	if len(lines) > languageDetectLines {
+		lines = lines[:languageDetectLines]
+	}
+
+	// shebang line.
+	if first := lines[0]; strings.HasPrefix(first, "#!") {
+		fields := strings.Fields(first[2:])
+		if len(fields) > 0 {
+			interp := path.Base(fields[0])
+			if interp == "env" && len(fields) > 1 {
+				interp = fields[1]
+			}
+			if lang, ok := shebangInterpreters[interp]; ok {
+				return lang
+			}
+		}
+	}
+
+	// first non-empty line.
+	var first string
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			first = l
+			break
+		}
+	}
+	lower := strings.ToLower(first)
+	switch {
+	case first == "":
+		return ""
+	case strings.HasPrefix(lower, "<?php"):
+		return "php"
+	case strings.HasPrefix(lower, "<!doctype html"), strings.HasPrefix(lower, "<html"):
+		return "html"
+	case strings.HasPrefix(first, "<"):
+		return "xml"
+	case strings.HasPrefix(first, "{"), strings.HasPrefix(first, "["):
+		return "json"
+	case first == "---":
+		return "yaml"
+	}
+
+	yamlKeys := 0
+	for _, l := range lines {
+		switch {
+		case reGoPackage.MatchString(l):
+			return "go"
+		case reJavaPackage.MatchString(l):
+			return "java"
+		case strings.HasPrefix(l, "#include "):
+			return "c"
+		case reYAMLKey.MatchString(l):
+			yamlKeys++
+		}
+	}
+	if yamlKeys >= 2 {
+		return "yaml"
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package templates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thehowl/diffy/pkg/diff"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tt := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"a.go", "", "go"},
+		{"red", "package main\n\nfunc main() {}\n", "go"},
+		{"red", "// comment\npackage diff // import \"x\"\n", "go"},
+		{"red", "package com.example.app;\n\nclass X {}\n", "java"},
+		{"red", "#!/bin/sh\necho hello\n", "bash"},
+		{"red", "#!/usr/bin/env python3\nprint(1)\n", "python"},
+		{"script.js", "#!/usr/bin/env node\n", "javascript"},
+		{"red", "<?xml version=\"1.0\"?>\n<a/>\n", "xml"},
+		{"red", "<!DOCTYPE html>\n<html>\n", "html"},
+		{"red", "<?php echo 1;\n", "php"},
+		{"red", "\n  {\"a\": 1}\n", "json"},
+		{"red", "---\na: 1\n", "yaml"},
+		{"red", "name: diffy\nversion: 1\n", "yaml"},
+		{"red", "#include <stdio.h>\n", "c"},
+		// content is not decisive: fall back to extension.
+		{"main.rs", "fn main() {}\n", "rust"},
+		{"CONFIG.YML", "", "yaml"},
+		{"red", "hello world\n", "plain"},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.want, detectLanguage(tc.name, tc.content), "%s: %q", tc.name, tc.content)
+	}
+}
+
+func TestFileLanguage(t *testing.T) {
+	f := &FileTemplateData{
+		Diff:     diff.Unified{OldName: "red", NewName: "green"},
+		OldLines: []string{"#!/bin/sh"},
+		NewLines: []string{"package main"},
+	}
+	assert.Equal(t, "go", f.Language())
+
+	// a deleted file has no lines of its own.
+	f.Diff.NewDevNull, f.NewLines = true, []string{}
+	assert.Equal(t, "bash", f.Language())
+	f.Diff.OldName, f.OldLines = "a.py", []string{"x = 1"}
+	assert.Equal(t, "python", f.Language())
+}
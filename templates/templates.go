@@ -1,26 +1,60 @@
 package templates
 
 import (
+	"bytes"
 	"embed"
 	"fmt"
 	"html"
 	"html/template"
 	"maps"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/thehowl/diffy/pkg/diff"
+	"github.com/thehowl/diffy/pkg/i18n"
+	"github.com/thehowl/diffy/static"
 )
 
 var (
 	funcMap = map[string]any{
 		"hunk_header": func(hunk diff.Hunk) string {
-			return fmt.Sprintf("@@ -%d,%d +%d,%d @@", hunk.LineOld, hunk.CountOld, hunk.LineNew, hunk.CountNew)
+			return hunk.Header()
 		},
 		"repeat": func(n int) []struct{} {
 			return make([]struct{}, n)
 		},
+		"add": func(a, b int) int {
+			return a + b
+		},
+		"reltime": func(t time.Time) string {
+			return relTime(t, time.Now())
+		},
+		"bytes":   humanBytes,
+		"visible": visible,
+		// fonts and font_sizes are the choices of the font selector.
+		"fonts": func() []string {
+			return fonts
+		},
+		"font_sizes": func() []int {
+			return []int{11, 12, 13, 14, 16, 18, 20}
+		},
+		"font_family": fontFamily,
+		// tr translates a message into the given language.
+		"tr": i18n.T,
+		// static_css and static_js return the contents of the given file
+		// in the static directory, to inline it in standalone pages.
+		"static_css": func(name string) (template.CSS, error) {
+			b, err := static.FS.ReadFile(name)
+			return template.CSS(b), err
+		},
+		"static_js": func(name string) (template.JS, error) {
+			b, err := static.FS.ReadFile(name)
+			return template.JS(b), err
+		},
 	}
 	Templates = template.Must(
 		template.New("").
@@ -31,13 +65,318 @@ var (
 	templateFS embed.FS
 )
 
+// visible escapes s for HTML, showing the characters which would otherwise be
+// invisible or break the layout: control characters are replaced with their
+// Unicode control pictures (ie. ␀ for NUL, ␛ for ESC), and byte order marks
+// with "BOM". Tabs and newlines are kept.
+func visible(s string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		var repl string
+		switch {
+		case r == '\t' || r == '\n':
+		case r < 0x20:
+			repl = string(0x2400 + r)
+		case r == 0x7f:
+			repl = "\u2421"
+		case r == '\ufeff':
+			repl = "BOM"
+		}
+		if repl != "" {
+			b.WriteString(html.EscapeString(s[last:i]))
+			fmt.Fprintf(&b, `<span class="ctrl" title="U+%04X">%s</span>`, r, repl)
+			last = i + size
+		}
+		i += size
+	}
+	b.WriteString(html.EscapeString(s[last:]))
+	return template.HTML(b.String())
+}
+
+// fonts are the font families offered by the font selector. Any other
+// installed font can be used with ?font=.
+var fonts = []string{
+	"ui-monospace",
+	"Menlo",
+	"Consolas",
+	"DejaVu Sans Mono",
+	"Fira Code",
+	"JetBrains Mono",
+	"Source Code Pro",
+}
+
+// fontFamily returns the value of the CSS font-family property for the given
+// font, falling back to the default monospace font.
+func fontFamily(name string) string {
+	return strconv.Quote(name) + ", monospace"
+}
+
+var reFontName = regexp.MustCompile(`^[A-Za-z0-9 -]{1,64}$`)
+
+// parseFont parses the value of the ?font= query parameter: a font family,
+// optionally preceded by the font size in pixels, ie. "14px Fira Code".
+// Invalid values are ignored.
+func parseFont(s string) (family string, size int) {
+	flds := strings.Fields(s)
+	if len(flds) > 0 && strings.HasSuffix(flds[0], "px") {
+		n, err := strconv.Atoi(strings.TrimSuffix(flds[0], "px"))
+		if err == nil && n >= 6 && n <= 48 {
+			size = n
+		}
+		flds = flds[1:]
+	}
+	family = strings.Join(flds, " ")
+	if !reFontName.MatchString(family) {
+		family = ""
+	}
+	return family, size
+}
+
+// humanBytes formats n as a size in bytes, ie. "512 B" or "1.5 KiB".
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatUint(n, 10) + " B"
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + "KMGT"[exp:exp+1] + "iB"
+}
+
+var relTimeUnits = [...]struct {
+	name string
+	dur  time.Duration
+}{
+	{"year", 365 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+	{"day", 24 * time.Hour},
+	{"hour", time.Hour},
+	{"minute", time.Minute},
+	{"second", time.Second},
+}
+
+// relTime formats t relative to now, ie. "3 minutes ago" or "in 2 days".
+func relTime(t, now time.Time) string {
+	d := t.UTC().Sub(now.UTC())
+	future := d > 0
+	if !future {
+		d = -d
+	}
+	if d < time.Second {
+		return "just now"
+	}
+
+	var res string
+	for _, unit := range relTimeUnits {
+		if d < unit.dur {
+			continue
+		}
+		n := int64(d / unit.dur)
+		res = strconv.FormatInt(n, 10) + " " + unit.name
+		if n != 1 {
+			res += "s"
+		}
+		break
+	}
+	if future {
+		return "in " + res
+	}
+	return res + " ago"
+}
+
 type FileTemplateData struct {
-	ID      string
-	Diff    diff.Unified
+	ID   string
+	Diff diff.Unified
+	// OldLines are the lines of the old file, as split by [diff.SplitLines].
+	// They are used to render the unchanged lines between hunks.
+	OldLines []string
+	// NewLines are the lines of the new file, as split by [diff.SplitLines].
+	// They are used to detect its language; see [FileTemplateData.Language].
+	NewLines []string
+	// Table is the diff of the rows of the files, if they were parsed as
+	// tables (mode=csv). If set, it is shown instead of Diff.
+	Table   []diff.TableRow
 	Space   string
+	Mode    string
+	Unicode string
+	Algo    string
 	Context int
-	Split   bool
+	// Full is set when the whole file is shown (c=full). Context then
+	// holds the number of lines of the longest file.
+	Full bool
+	// Block is set when the context is expanded to the blocks around the
+	// changes (c=block), rather than being Context lines.
+	Block bool
+	// OldRef and NewRef are the optional revision labels of the files,
+	// like commit hashes, given at upload.
+	OldRef string
+	NewRef string
+	Split  bool
+	// CreatedAt and Size are the upload time and the stored size of the
+	// diff. They are zero for the example.
+	CreatedAt time.Time
+	Size      uint64
+	// Standalone inlines the stylesheet and scripts in the page, so that it
+	// can be viewed without the server. The links to the server, like the
+	// ones to the files, are omitted.
+	Standalone bool
+	// MaxColumns is the number of characters after which lines are
+	// truncated, showing an expander for the rest. If 0, lines are shown in
+	// full.
+	MaxColumns int
+	// Font is the font of the diff set with ?font=, overriding the one
+	// chosen with the font selector; see parseFont.
+	Font string
+	// Palette is the color palette set with ?palette=, overriding the one
+	// chosen with the palette selector: "cb" for the colorblind-friendly
+	// one, or empty.
+	Palette string
 	Query   url.Values
+	// ExtraCSS is the URL of the stylesheet of the instance, loaded after the
+	// default one. It is not used in standalone pages.
+	ExtraCSS string
+	// Lang is the language of the page; see [i18n.Match].
+	Lang string
+}
+
+// LineParts is a line of the diff, split into the part which is always shown
+// and the rest, shown on request; see [FileTemplateData.Cut].
+type LineParts struct {
+	Head string
+	Rest string
+}
+
+// Cut splits the content of a line after f.MaxColumns characters.
+func (f *FileTemplateData) Cut(s string) LineParts {
+	if f.MaxColumns <= 0 || len(s) <= f.MaxColumns {
+		return LineParts{Head: s}
+	}
+	n := 0
+	for i := range s {
+		if n == f.MaxColumns {
+			return LineParts{Head: s[:i], Rest: s[i:]}
+		}
+		n++
+	}
+	// fewer than MaxColumns characters, but more bytes.
+	return LineParts{Head: s}
+}
+
+// FontStyle returns the style setting the font of the diff, if f.Font is a
+// valid font.
+func (f *FileTemplateData) FontStyle() template.CSS {
+	family, size := parseFont(f.Font)
+	var parts []string
+	if family != "" {
+		parts = append(parts, "--diff-font: "+fontFamily(family))
+	}
+	if size != 0 {
+		parts = append(parts, "--diff-font-size: "+strconv.Itoa(size)+"px")
+	}
+	// the values are validated by parseFont, so they can be trusted.
+	return template.CSS(strings.Join(parts, "; "))
+}
+
+// ActiveOptions describes the diff settings which differ from the defaults,
+// so that they can be shown to the user, in f.Lang.
+func (f *FileTemplateData) ActiveOptions() []string {
+	var opts []string
+	add := func(msg string, args ...any) {
+		opts = append(opts, i18n.T(f.Lang, msg, args...))
+	}
+	if f.Split {
+		add("split view")
+	}
+	switch f.Space {
+	case "w":
+		add("ignoring all whitespace (-w)")
+	case "b":
+		add("ignoring whitespace changes (-b)")
+	case "show":
+		add("marking whitespace changes")
+	}
+	if f.Unicode != "" {
+		add("unicode normalization: %s", f.Unicode)
+	}
+	if f.Mode != "" {
+		add("mode: %s", f.Mode)
+	}
+	if f.Algo != "" {
+		add("algorithm: %s", f.Algo)
+	}
+	switch {
+	case f.Full:
+		add("full file")
+	case f.Block:
+		add("context: blocks")
+	case f.Context != 3:
+		add("context: %d lines", f.Context)
+	}
+	return opts
+}
+
+// DiffHTML renders the diff, in the split or unified view depending on
+// f.Split, or as a table if f.Table is set.
+func (f *FileTemplateData) DiffHTML() (template.HTML, error) {
+	name := "diff_unified"
+	switch {
+	case f.Table != nil:
+		name = "diff_table"
+	case f.Split:
+		name = "diff_split"
+	}
+	var buf bytes.Buffer
+	if err := Templates.ExecuteTemplate(&buf, name, f); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// RenderOptions are the options of [RenderHTML].
+//
+// The context and the handling of whitespace are not part of the options, as
+// they are determined when computing the diff; see [diff.Options].
+type RenderOptions struct {
+	// ID is the id of the diff on diffy, used to link the files. If empty,
+	// the file names are not links.
+	ID string
+	// OldLines are the lines of the old file, as split by [diff.SplitLines].
+	// If set, the unchanged lines between hunks can be expanded.
+	OldLines []string
+	// NewLines are the lines of the new file. If set, they are used to
+	// detect its language.
+	NewLines []string
+	// OldRef and NewRef are optional revision labels of the files.
+	OldRef string
+	NewRef string
+	// Split renders the diff side-by-side rather than unified.
+	Split bool
+	// MaxColumns truncates lines longer than the given number of
+	// characters, showing an expander for the rest. If 0, lines are not
+	// truncated.
+	MaxColumns int
+}
+
+// RenderHTML renders u as an HTML fragment, without the rest of the page.
+// The fragment uses the classes of static/style.css.
+func RenderHTML(u diff.Unified, opts RenderOptions) (template.HTML, error) {
+	f := &FileTemplateData{
+		ID:       opts.ID,
+		Diff:     u,
+		OldLines: opts.OldLines,
+		NewLines: opts.NewLines,
+		OldRef:   opts.OldRef,
+		NewRef:   opts.NewRef,
+		Split:    opts.Split,
+
+		MaxColumns: opts.MaxColumns,
+	}
+	return f.DiffHTML()
 }
 
 func (f *FileTemplateData) WithQueryValue(key, value string) string {
@@ -60,13 +399,191 @@ func (f *FileTemplateData) WithQueryValue(key, value string) string {
 	return "?" + uvCopy.Encode()
 }
 
+// Title returns the names of the diffed files, as "old → new", or only one
+// name if they are the same.
+// If the files have refs, they are appended as "(oldref → newref)".
+func (f *FileTemplateData) Title() string {
+	if f.OldRef == "" && f.NewRef == "" && f.Diff.OldName == f.Diff.NewName {
+		return f.Diff.OldName
+	}
+	return withRef(f.Diff.OldName, f.OldRef) + " → " + withRef(f.Diff.NewName, f.NewRef)
+}
+
+// withRef returns the name of a file, followed by its ref in parentheses, if
+// any.
+func withRef(name, ref string) string {
+	if ref == "" {
+		return name
+	}
+	return name + " (" + ref + ")"
+}
+
+// Language returns the language of the new file, as determined by its name
+// and its first lines. If the new file was deleted, or its lines are not set,
+// the old file is used instead.
+func (f *FileTemplateData) Language() string {
+	name, lines := f.Diff.NewName, f.NewLines
+	if f.Diff.NewDevNull || lines == nil {
+		name, lines = f.Diff.OldName, f.OldLines
+	}
+	n := min(len(lines), languageDetectLines)
+	return detectLanguage(name, strings.Join(lines[:n], "\n"))
+}
+
+// Gap is a range of unchanged lines which are not part of any hunk.
+type Gap struct {
+	Index    int
+	OldStart int
+	NewStart int
+	Lines    []string
+}
+
+// Gaps returns the unchanged lines around the hunks: element i is the gap
+// before f.Diff.Hunks[i], while the last element is the gap after the last
+// hunk. It returns nil if there are no hunks.
+func (f *FileTemplateData) Gaps() []Gap {
+	hunks := f.Diff.Hunks
+	if len(hunks) == 0 {
+		return nil
+	}
+
+	// hunkStart returns the first line of a hunk side; a side without
+	// lines instead contains the line after which the hunk should be
+	// placed.
+	hunkStart := func(line, count int) int {
+		if count == 0 {
+			return line + 1
+		}
+		return line
+	}
+
+	gaps := make([]Gap, len(hunks)+1)
+	oldPos, newPos := 1, 1
+	for i, h := range hunks {
+		oldStart := hunkStart(h.LineOld, h.CountOld)
+		gaps[i] = Gap{
+			Index:    i,
+			OldStart: oldPos,
+			NewStart: newPos,
+			Lines:    f.oldLines(oldPos, oldStart),
+		}
+		oldPos = oldStart + h.CountOld
+		newPos = hunkStart(h.LineNew, h.CountNew) + h.CountNew
+	}
+	gaps[len(hunks)] = Gap{
+		Index:    len(hunks),
+		OldStart: oldPos,
+		NewStart: newPos,
+		Lines:    f.oldLines(oldPos, len(f.OldLines)+1),
+	}
+	return gaps
+}
+
+// MinimapMark is a run of changed lines in the minimap of the diff.
+type MinimapMark struct {
+	// Hunk is the index of the hunk of the lines, to which the mark links.
+	Hunk int
+	// Type is [diff.TypeInsert], [diff.TypeDelete], or "change" if lines
+	// are both deleted and inserted.
+	Type string
+	// Top and Height are the position and the height of the run in the new
+	// file, as percentages of its length.
+	Top    float64
+	Height float64
+}
+
+// Style returns the style positioning the mark in the minimap.
+func (m MinimapMark) Style() template.CSS {
+	return template.CSS(fmt.Sprintf("top: %.2f%%; height: %.2f%%", m.Top, m.Height))
+}
+
+// minimapMinLines is the length of the new file from which the minimap is
+// shown by default.
+const minimapMinLines = 200
+
+// Minimap returns the marks of the minimap of the changes, shown next to long
+// diffs. ?minimap=1 shows it for any diff, and ?minimap=0 hides it. It
+// returns nil for tables and for diffs without hunks.
+func (f *FileTemplateData) Minimap() []MinimapMark {
+	hunks := f.Diff.Hunks
+	if f.Table != nil || len(hunks) == 0 {
+		return nil
+	}
+	last := hunks[len(hunks)-1]
+	st := f.Diff.Stats()
+	total := max(len(f.OldLines)+st.Added-st.Deleted, last.LineNew+last.CountNew-1, 1)
+	switch f.Query.Get("minimap") {
+	case "0":
+		return nil
+	case "1":
+	default:
+		if total < minimapMinLines {
+			return nil
+		}
+	}
+
+	var marks []MinimapMark
+	for i, h := range hunks {
+		// pos is the line of the new file before which the next line is.
+		pos := h.LineNew
+		if h.CountNew == 0 {
+			pos++
+		}
+		for j := 0; j < len(h.Lines); {
+			if h.Lines[j].Type() == diff.TypeEqual {
+				pos = h.Lines[j].NumberY + 1
+				j++
+				continue
+			}
+			start, ins, del := pos, 0, 0
+			for ; j < len(h.Lines) && h.Lines[j].Type() != diff.TypeEqual; j++ {
+				switch h.Lines[j].Type() {
+				case diff.TypeInsert:
+					ins++
+					pos = h.Lines[j].NumberY + 1
+				case diff.TypeDelete:
+					del++
+				}
+			}
+			typ := "change"
+			switch {
+			case del == 0:
+				typ = diff.TypeInsert
+			case ins == 0:
+				typ = diff.TypeDelete
+			}
+			top := min(float64(start-1)/float64(total)*100, 100)
+			marks = append(marks, MinimapMark{
+				Hunk:   i,
+				Type:   typ,
+				Top:    top,
+				Height: min(float64(max(ins, del))/float64(total)*100, 100-top),
+			})
+		}
+	}
+	return marks
+}
+
+// oldLines returns the old lines in the 1-indexed range [start, end).
+func (f *FileTemplateData) oldLines(start, end int) []string {
+	start, end = max(start-1, 0), min(end-1, len(f.OldLines))
+	if start >= end {
+		return nil
+	}
+	return f.OldLines[start:end]
+}
+
 func (f *FileTemplateData) ContextLinks() template.HTML {
 	const (
 		minVal = 0
 		maxVal = 1000
 	)
-	smallest := f.Context - 3
-	greatest := f.Context + 3
+	cur := f.Context
+	if f.Full || f.Block {
+		cur = 3
+	}
+	smallest := cur - 3
+	greatest := cur + 3
 	if smallest < minVal {
 		greatest += (minVal - smallest)
 		smallest = minVal
@@ -81,7 +598,7 @@ func (f *FileTemplateData) ContextLinks() template.HTML {
 		if bld.Len() != 0 {
 			bld.WriteString(" | ")
 		}
-		if i == f.Context {
+		if i == f.Context && !f.Full && !f.Block {
 			bld.WriteString("<b>" + strconv.Itoa(f.Context) + "</b>")
 			continue
 		}
@@ -95,5 +612,16 @@ func (f *FileTemplateData) ContextLinks() template.HTML {
 				strconv.Itoa(i) + `</a>`,
 		)
 	}
+	for _, v := range []struct {
+		name    string
+		current bool
+	}{{"block", f.Block}, {"full", f.Full}} {
+		if v.current {
+			bld.WriteString(" | <b>" + v.name + "</b>")
+			continue
+		}
+		uri := "/" + f.ID + f.WithQueryValue("c", v.name)
+		bld.WriteString(` | <a href="` + html.EscapeString(uri) + `">` + v.name + `</a>`)
+	}
 	return template.HTML(bld.String())
 }
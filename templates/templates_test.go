@@ -0,0 +1,253 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thehowl/diffy/pkg/diff"
+)
+
+func TestRelTime(t *testing.T) {
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	tt := []struct {
+		t    time.Time
+		want string
+	}{
+		{now, "just now"},
+		{now.Add(-time.Second), "1 second ago"},
+		{now.Add(-3 * time.Minute), "3 minutes ago"},
+		{now.Add(-90 * time.Minute), "1 hour ago"},
+		{now.Add(48 * time.Hour), "in 2 days"},
+		{now.Add(-45 * 24 * time.Hour), "1 month ago"},
+		{now.Add(3 * 365 * 24 * time.Hour), "in 3 years"},
+		// the same instant in a different time zone.
+		{now.Add(-time.Hour).In(time.FixedZone("UTC+5", 5*60*60)), "1 hour ago"},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.want, relTime(tc.t, now), tc.t.String())
+	}
+}
+
+func TestGaps(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	new := "1\n2\nthree\n4\n5\n6\n7\n8\n9\nten\n"
+	f := &FileTemplateData{
+		Diff:     diff.DiffWithOptions("a", []byte(old), "b", []byte(new), diff.Options{Context: 1}),
+		OldLines: diff.SplitLines([]byte(old)),
+	}
+	assert.Equal(t, []Gap{
+		{Index: 0, OldStart: 1, NewStart: 1, Lines: []string{"1"}},
+		{Index: 1, OldStart: 5, NewStart: 5, Lines: []string{"5", "6", "7", "8"}},
+		{Index: 2, OldStart: 11, NewStart: 11},
+	}, f.Gaps())
+
+	// no hunks, no gaps.
+	f = &FileTemplateData{
+		Diff:     diff.Diff("a", []byte(old), "b", []byte(old)),
+		OldLines: diff.SplitLines([]byte(old)),
+	}
+	assert.Nil(t, f.Gaps())
+}
+
+func TestMinimap(t *testing.T) {
+	var old, new strings.Builder
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&old, "%d\n", i)
+		switch i {
+		case 3:
+			new.WriteString("three\n")
+		case 100:
+		case 150:
+			new.WriteString("150\ninserted\n")
+		default:
+			fmt.Fprintf(&new, "%d\n", i)
+		}
+	}
+	f := &FileTemplateData{
+		Diff:     diff.DiffWithOptions("a", []byte(old.String()), "b", []byte(new.String()), diff.Options{Context: 1}),
+		OldLines: diff.SplitLines([]byte(old.String())),
+	}
+	assert.Equal(t, []MinimapMark{
+		{Hunk: 0, Type: "change", Top: 1, Height: 0.5},
+		{Hunk: 1, Type: diff.TypeDelete, Top: 49.5, Height: 0.5},
+		{Hunk: 2, Type: diff.TypeInsert, Top: 74.5, Height: 0.5},
+	}, f.Minimap())
+	assert.Equal(t, template.CSS("top: 49.50%; height: 0.50%"), f.Minimap()[1].Style())
+
+	f.Query = url.Values{"minimap": {"0"}}
+	assert.Nil(t, f.Minimap())
+
+	// short diffs only have it on request.
+	f = &FileTemplateData{
+		Diff:     diff.Diff("a", []byte("a\nb\n"), "b", []byte("a\nc\n")),
+		OldLines: []string{"a", "b"},
+	}
+	assert.Nil(t, f.Minimap())
+	f.Query = url.Values{"minimap": {"1"}}
+	assert.Equal(t, []MinimapMark{{Hunk: 0, Type: "change", Top: 50, Height: 50}}, f.Minimap())
+
+	// the marks link to the headers of the hunks.
+	var buf bytes.Buffer
+	require.NoError(t, Templates.ExecuteTemplate(&buf, "file.tmpl", f))
+	assert.Contains(t, buf.String(), `<a href="#hunk-0" class="minimap-change" style="top: 50.00%; height: 50.00%"></a>`)
+	assert.Contains(t, buf.String(), `id="hunk-0"`)
+}
+
+func TestTitle(t *testing.T) {
+	f := &FileTemplateData{Diff: diff.Unified{OldName: "red.go", NewName: "green.go"}}
+	assert.Equal(t, "red.go → green.go", f.Title())
+	f = &FileTemplateData{Diff: diff.Unified{OldName: "main.go", NewName: "main.go"}}
+	assert.Equal(t, "main.go", f.Title())
+	f.OldRef, f.NewRef = "v1", "v2"
+	assert.Equal(t, "main.go (v1) → main.go (v2)", f.Title())
+	f.OldRef = ""
+	assert.Equal(t, "main.go → main.go (v2)", f.Title())
+}
+
+func TestContextLinks(t *testing.T) {
+	f := &FileTemplateData{ID: "abc", Context: 3}
+	links := string(f.ContextLinks())
+	assert.Contains(t, links, "<b>3</b>")
+	assert.Contains(t, links, `<a href="/abc?c=full">full</a>`)
+	assert.Contains(t, links, `<a href="/abc?c=block">block</a>`)
+
+	f = &FileTemplateData{ID: "abc", Context: 120, Full: true}
+	links = string(f.ContextLinks())
+	assert.Contains(t, links, "<b>full</b>")
+	assert.Contains(t, links, `<a href="/abc">3</a>`)
+	assert.NotContains(t, links, "120")
+
+	f = &FileTemplateData{ID: "abc", Block: true}
+	links = string(f.ContextLinks())
+	assert.Contains(t, links, "<b>block</b>")
+	assert.Contains(t, links, `<a href="/abc">3</a>`)
+	assert.Contains(t, links, `<a href="/abc?c=full">full</a>`)
+	assert.NotContains(t, links, "<b>0</b>")
+}
+
+func TestRenderHTML(t *testing.T) {
+	u := diff.Diff("a.go", []byte("a\nb\n"), "b.go", []byte("a\nc\n"))
+
+	h, err := RenderHTML(u, RenderOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, string(h), `class="diff diff-unified"`)
+	assert.Contains(t, string(h), "--- a.go")
+	assert.NotContains(t, string(h), "<a href")
+	assert.NotContains(t, string(h), "<html")
+
+	h, err = RenderHTML(u, RenderOptions{ID: "abc", Split: true})
+	require.NoError(t, err)
+	assert.Contains(t, string(h), `class="diff-split-columns"`)
+	assert.Contains(t, string(h), `<a href="/abc/red">a.go</a>`)
+}
+
+func TestRenderHTMLInvalidLine(t *testing.T) {
+	u := diff.Unified{OldName: "a", NewName: "b", Hunks: []diff.Hunk{{
+		LineOld: 1, CountOld: 1, LineNew: 1, CountNew: 1,
+		Lines: []diff.HunkLine{{NumberX: 1, NumberY: 1, Value: "<bad>"}, {NumberX: 2, NumberY: 2}},
+	}}}
+	for _, split := range []bool{false, true} {
+		h, err := RenderHTML(u, RenderOptions{Split: split})
+		require.NoError(t, err)
+		assert.Contains(t, string(h), `<div class="source line-invalid">&lt;bad&gt;</div>`)
+	}
+}
+
+func TestCut(t *testing.T) {
+	f := &FileTemplateData{MaxColumns: 3}
+	assert.Equal(t, LineParts{Head: "abc"}, f.Cut("abc"))
+	assert.Equal(t, LineParts{Head: "abc", Rest: "d"}, f.Cut("abcd"))
+	// characters, not bytes.
+	assert.Equal(t, LineParts{Head: "àèì"}, f.Cut("àèì"))
+	assert.Equal(t, LineParts{Head: "àèì", Rest: "òù"}, f.Cut("àèìòù"))
+
+	f.MaxColumns = 0
+	assert.Equal(t, LineParts{Head: "abcd"}, f.Cut("abcd"))
+
+	u := diff.Diff("a", []byte("a\n"), "b", []byte("abcdef\n"))
+	h, err := RenderHTML(u, RenderOptions{MaxColumns: 4})
+	require.NoError(t, err)
+	assert.Contains(t, string(h), `abcd<span class="line-rest" hidden>ef</span>`)
+}
+
+func TestVisible(t *testing.T) {
+	assert.Equal(t, template.HTML("a &lt;b&gt;\tc"), visible("a <b>\tc"))
+	assert.Equal(t,
+		template.HTML(`a<span class="ctrl" title="U+0000">␀</span>b<span class="ctrl" title="U+001B">␛</span>[0m`),
+		visible("a\x00b\x1b[0m"))
+	assert.Equal(t,
+		template.HTML(`<span class="ctrl" title="U+FEFF">BOM</span>x<span class="ctrl" title="U+007F">␡</span><span class="ctrl" title="U+000D">␍</span>`),
+		visible("\ufeffx\x7f\r"))
+	// the missing newline warning is kept.
+	assert.Equal(t, template.HTML("x\n\\ No newline at end of file"), visible("x\n\\ No newline at end of file"))
+
+	u := diff.Diff("a", []byte("\ufeffa\n"), "b", []byte("a\x00\n"))
+	h, err := RenderHTML(u, RenderOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, string(h), `<span class="ctrl" title="U+FEFF">BOM</span>a`)
+	assert.Contains(t, string(h), `a<span class="ctrl" title="U+0000">␀</span>`)
+}
+
+func TestActiveOptions(t *testing.T) {
+	f := &FileTemplateData{Context: 3}
+	assert.Empty(t, f.ActiveOptions())
+
+	f = &FileTemplateData{Space: "b", Context: 5, Split: true}
+	assert.Equal(t, []string{
+		"split view",
+		"ignoring whitespace changes (-b)",
+		"context: 5 lines",
+	}, f.ActiveOptions())
+
+	f.Lang = "it"
+	assert.Equal(t, []string{
+		"vista affiancata",
+		"ignorando le modifiche agli spazi (-b)",
+		"contesto: 5 righe",
+	}, f.ActiveOptions())
+}
+
+func TestParseFont(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		family string
+		size   int
+	}{
+		{"Fira Code", "Fira Code", 0},
+		{"14px Fira Code", "Fira Code", 14},
+		{"14px", "", 14},
+		{"100px Menlo", "Menlo", 0},
+		{"Menlo; color: red", "", 0},
+		{`x"y`, "", 0},
+		{"", "", 0},
+	} {
+		family, size := parseFont(tc.in)
+		assert.Equal(t, tc.family, family, tc.in)
+		assert.Equal(t, tc.size, size, tc.in)
+	}
+}
+
+func TestFontStyle(t *testing.T) {
+	var buf bytes.Buffer
+	err := Templates.ExecuteTemplate(&buf, "file.tmpl", &FileTemplateData{
+		Diff: diff.Diff("a", []byte("a\n"), "b", []byte("b\n")),
+		Font: "14px Fira Code",
+	})
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `<html style="--diff-font: &#34;Fira Code&#34;, monospace; --diff-font-size: 14px">`)
+	assert.Contains(t, buf.String(), `<option value="&#34;Fira Code&#34;, monospace">Fira Code</option>`)
+}
+
+func TestHumanBytes(t *testing.T) {
+	assert.Equal(t, "0 B", humanBytes(0))
+	assert.Equal(t, "1023 B", humanBytes(1023))
+	assert.Equal(t, "1.5 KiB", humanBytes(1536))
+	assert.Equal(t, "5.0 MiB", humanBytes(5<<20))
+}